@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// checkpoint records the position of the last series that was completely
+// written, so that an interrupted dump can be resumed from that point.
+type checkpoint struct {
+	Block        string `json:"block"`
+	Shard        string `json:"shard,omitempty"`
+	SeriesRef    uint64 `json:"seriesRef"`
+	OutputOffset int64  `json:"outputOffset"`
+	// TimeShift is the shift applied to timestamps in milliseconds, which
+	// depends on the start time of the dump with a relative -rebase-to.
+	TimeShift int64 `json:"timeShift,omitempty"`
+	Done      bool  `json:"done"`
+}
+
+// checkpointer persists checkpoints for a single dump.
+type checkpointer struct {
+	path  string
+	block string
+	shard string
+	out   *countingWriter
+	// timeShift is recorded in every checkpoint.
+	timeShift int64
+	// resumeFrom is the checkpoint loaded with -resume, nil when starting over.
+	resumeFrom *checkpoint
+
+	// interval is the minimum time between checkpoints saved by update.
+	interval time.Duration
+	saved    time.Time
+	// pending is the last written series if it was not saved yet.
+	pending *uint64
+}
+
+func newCheckpointer(checkpointPath, blockPath, shard string, interval time.Duration) *checkpointer {
+	return &checkpointer{path: checkpointPath, block: blockID(blockPath), shard: shard, interval: interval}
+}
+
+// load reads an existing checkpoint to resume from. A missing checkpoint file
+// is not an error; the dump simply starts from the beginning.
+func (c *checkpointer) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var cp checkpoint
+	if err := json.NewDecoder(f).Decode(&cp); err != nil {
+		return pkgerrors.Wrap(err, "decode checkpoint")
+	}
+	if cp.Block != c.block {
+		return fmt.Errorf("checkpoint %s is for block %s, not %s", c.path, cp.Block, c.block)
+	}
+	if cp.Shard != c.shard {
+		return fmt.Errorf("checkpoint %s is for shard %q, not %q", c.path, cp.Shard, c.shard)
+	}
+	c.resumeFrom = &cp
+	return nil
+}
+
+// skip reports whether the series with the given ref was already written
+// before the dump was interrupted.
+func (c *checkpointer) skip(ref uint64) bool {
+	if c == nil || c.resumeFrom == nil {
+		return false
+	}
+	return c.resumeFrom.Done || ref <= c.resumeFrom.SeriesRef
+}
+
+// update records ref as the last fully written series. It is saved if the
+// interval passed since the last checkpoint, and by flush otherwise.
+func (c *checkpointer) update(ref uint64) error {
+	if c == nil {
+		return nil
+	}
+	if time.Since(c.saved) < c.interval {
+		c.pending = &ref
+		return nil
+	}
+	return c.save(ref, false)
+}
+
+// flush saves the last series recorded by update if it was not saved yet.
+func (c *checkpointer) flush() error {
+	if c == nil || c.pending == nil {
+		return nil
+	}
+	return c.save(*c.pending, false)
+}
+
+// save records ref as the last fully written series.
+func (c *checkpointer) save(ref uint64, done bool) error {
+	if c == nil {
+		return nil
+	}
+	c.saved, c.pending = time.Now(), nil
+	cp := checkpoint{Block: c.block, Shard: c.shard, SeriesRef: ref, TimeShift: c.timeShift, Done: done}
+	if c.resumeFrom != nil && ref < c.resumeFrom.SeriesRef {
+		cp.SeriesRef = c.resumeFrom.SeriesRef
+	}
+	if c.out != nil {
+		cp.OutputOffset = c.out.count()
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// truncated checkpoint behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(tmp).Encode(cp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// openResumedOutput opens the output file of an interrupted dump and discards
+// anything written after the last checkpoint, such as a partially written
+// series.
+func openResumedOutput(name string, offset int64) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, pkgerrors.Wrap(err, "truncate output")
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, pkgerrors.Wrap(err, "seek output")
+	}
+	return f, nil
+}
+
+// blockID returns the ULID of the block at blockPath, which is the last
+// element of the path for both local and S3 blocks.
+func blockID(blockPath string) string {
+	return path.Base(strings.TrimSuffix(blockPath, "/"))
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// countingCreator wraps create so that the bytes written to all files it
+// creates are counted by c instead of the bytes written to c itself.
+func countingCreator(create func(name string) (io.WriteCloser, error), c *countingWriter) func(name string) (io.WriteCloser, error) {
+	return func(name string) (io.WriteCloser, error) {
+		f, err := create(name)
+		if err != nil {
+			return nil, err
+		}
+		return &countedFile{WriteCloser: f, c: c}, nil
+	}
+}
+
+// countedFile is a file created by countingCreator.
+type countedFile struct {
+	io.WriteCloser
+	c *countingWriter
+}
+
+func (f *countedFile) Write(p []byte) (int, error) {
+	n, err := f.WriteCloser.Write(p)
+	atomic.AddInt64(&f.c.n, int64(n))
+	return n, err
+}
+
+// Abort aborts the file if it implements writer.Aborter, like files on S3,
+// and closes it otherwise.
+func (f *countedFile) Abort() error {
+	if a, ok := f.WriteCloser.(writer.Aborter); ok {
+		return a.Abort()
+	}
+	return f.Close()
+}
+
+// count returns the number of bytes written so far.
+func (c *countingWriter) count() int64 { return atomic.LoadInt64(&c.n) }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestCheckpointerInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint")
+	read := func() checkpoint {
+		var cp checkpoint
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &cp); err != nil {
+			t.Fatal(err)
+		}
+		return cp
+	}
+
+	c := newCheckpointer(path, "/blocks/01E0ZS9RVPJ5H3Z8M5P7A4M4QW", "", time.Hour)
+	c.timeShift = -3600000
+	for _, ref := range []uint64{10, 20, 30} {
+		if err := c.update(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first series is saved within the interval.
+	if cp := read(); cp.SeriesRef != 10 || cp.Block != "01E0ZS9RVPJ5H3Z8M5P7A4M4QW" {
+		t.Fatalf("unexpected checkpoint %+v", cp)
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cp := read(); cp.SeriesRef != 30 || cp.TimeShift != -3600000 || cp.Done {
+		t.Fatalf("unexpected checkpoint %+v", cp)
+	}
+
+	resumed := newCheckpointer(path, "/blocks/01E0ZS9RVPJ5H3Z8M5P7A4M4QW", "", time.Hour)
+	if err := resumed.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.skip(30) || resumed.skip(31) {
+		t.Fatal("expected series up to 30 to be skipped")
+	}
+	if err := newCheckpointer(path, "/blocks/01E0ZS9RVPJ5H3Z8M5P7A4M4QX", "", 0).load(); err == nil {
+		t.Fatal("expected an error for a checkpoint of another block")
+	}
+}
+
+// cancelingWriter cancels the dump after the first series is written.
+type cancelingWriter struct {
+	writer.Writer
+	cancel context.CancelFunc
+}
+
+func (w cancelingWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	w.cancel()
+	return w.Writer.Write(lset, timestamps, values)
+}
+
+func TestRunResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "a", "instance", "1"),
+		labels.FromStrings("__name__", "a", "instance", "2"),
+		labels.FromStrings("__name__", "a", "instance", "3"),
+	)
+	checkpointPath := filepath.Join(dir, "checkpoint")
+	output := filepath.Join(dir, "output")
+
+	// dumpTo dumps the block into name the way main does, resuming from the
+	// checkpoint if resume is set and canceling after the first series if
+	// cancel is set.
+	dumpTo := func(name string, resume, cancel bool) error {
+		cp := newCheckpointer(checkpointPath, block, "", 0)
+		var f *os.File
+		var err error
+		if resume {
+			if err := cp.load(); err != nil {
+				t.Fatal(err)
+			}
+			f, err = openResumedOutput(name, cp.resumeFrom.OutputOffset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Anything written after the checkpoint is discarded.
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != cp.resumeFrom.OutputOffset {
+				t.Fatalf("expected the output to be truncated to %d bytes, got %d", cp.resumeFrom.OutputOffset, fi.Size())
+			}
+		} else {
+			f, err = os.Create(name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cw := &countingWriter{w: f}
+		cp.out = cw
+		if resume {
+			cw.n = cp.resumeFrom.OutputOffset
+		}
+
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		defer cancelFunc()
+		wr, err := writer.NewWriter("victoriametrics", cw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cancel {
+			wr = cancelingWriter{Writer: wr, cancel: cancelFunc}
+		}
+		return run(ctx, runOptions{
+			Block:          block,
+			MinTime:        math.MinInt64,
+			MaxTime:        math.MaxInt64,
+			ExternalLabels: "{}",
+			Checkpoint:     cp,
+			Writer:         wr,
+		})
+	}
+
+	if err := dumpTo(filepath.Join(dir, "uninterrupted"), false, false); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join(dir, "uninterrupted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dumpTo(output, false, true); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the dump to be canceled, got %v", err)
+	}
+	// A crash after the checkpoint leaves a partially written series behind.
+	f, err := os.OpenFile(output, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"metric":{"__name__":"a","inst`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	interrupted, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checkpoint points to the end of the first series, which was
+	// written completely.
+	b, err := ioutil.ReadFile(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Done || cp.OutputOffset == 0 || cp.OutputOffset >= int64(len(want)) || !bytes.HasPrefix(want, interrupted[:cp.OutputOffset]) {
+		t.Fatalf("expected a checkpoint after the first series, got %+v", cp)
+	}
+
+	if err := dumpTo(output, true, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("resumed output differs from an uninterrupted dump:\n%s\nwant:\n%s", got, want)
+	}
+}
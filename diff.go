@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// errDiffFound is returned by runDiff when the blocks differ.
+var errDiffFound = errors.New("blocks differ")
+
+// maxDiffExamples is the number of differing samples listed per series in
+// the detailed diff.
+const maxDiffExamples = 10
+
+type diffSummary struct {
+	BlockA                string `json:"blockA"`
+	BlockB                string `json:"blockB"`
+	Identical             bool   `json:"identical"`
+	SeriesOnlyInA         int64  `json:"seriesOnlyInA"`
+	SeriesOnlyInB         int64  `json:"seriesOnlyInB"`
+	CommonSeries          int64  `json:"commonSeries"`
+	SeriesWithDifferences int64  `json:"seriesWithDifferences"`
+	SamplesCompared       int64  `json:"samplesCompared"`
+	SamplesOnlyInA        int64  `json:"samplesOnlyInA"`
+	SamplesOnlyInB        int64  `json:"samplesOnlyInB"`
+	SamplesDiffering      int64  `json:"samplesDiffering"`
+}
+
+type diffDetail struct {
+	Kind      string            `json:"kind"`
+	Labels    map[string]string `json:"labels"`
+	OnlyInA   int64             `json:"onlyInA,omitempty"`
+	OnlyInB   int64             `json:"onlyInB,omitempty"`
+	Differing int64             `json:"differing,omitempty"`
+	Examples  []diffExample     `json:"examples,omitempty"`
+}
+
+// diffExample is a sample that differs between the blocks. A or B is nil if
+// the sample only exists in the other block or is a native histogram, which
+// is given in HistogramA or HistogramB instead.
+type diffExample struct {
+	Timestamp  int64                 `json:"timestamp"`
+	A          *float64              `json:"a"`
+	B          *float64              `json:"b"`
+	HistogramA *writer.JSONHistogram `json:"histogramA,omitempty"`
+	HistogramB *writer.JSONHistogram `json:"histogramB,omitempty"`
+}
+
+// diffBlock holds the readers of one side of a diff.
+type diffBlock struct {
+	indexr   *index.Reader
+	chunkr   tsdb.ChunkReader
+	postings index.Postings
+	lset     labels.Labels
+	chks     []chunks.Meta
+	done     bool
+}
+
+func openDiffBlock(ctx context.Context, blockPath string, awsProfile string, labelKey string, labelValues []string, metricName string) (*diffBlock, error) {
+	indexr, err := dump.OpenIndexReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "open index")
+	}
+	chunkr, err := dump.OpenChunkReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		indexr.Close()
+		return nil, pkgerrors.Wrap(err, "open chunks")
+	}
+	postings, err := dump.SelectPostings(indexr, labelKey, labelValues, metricName)
+	if err != nil {
+		indexr.Close()
+		chunkr.Close()
+		return nil, err
+	}
+	b := &diffBlock{indexr: indexr, chunkr: chunkr, postings: postings}
+	return b, b.next()
+}
+
+// next advances to the next series. Series are ordered by their labels
+// because the index stores them sorted.
+func (b *diffBlock) next() error {
+	if !b.postings.Next() {
+		b.done = true
+		return pkgerrors.Wrap(b.postings.Err(), "postings.Err")
+	}
+	b.lset = labels.Labels{}
+	b.chks = []chunks.Meta{}
+	return pkgerrors.Wrap(b.indexr.Series(b.postings.At(), &b.lset, &b.chks), "indexr.Series")
+}
+
+func (b *diffBlock) Close() {
+	b.indexr.Close()
+	b.chunkr.Close()
+}
+
+// runDiff compares the series and samples of two blocks within
+// [minTimestamp, maxTimestamp] and writes a summary to out. If detailsPath is
+// not empty, every series that differs is written there as a JSON line.
+// errDiffFound is returned if the blocks differ.
+func runDiff(ctx context.Context, blockPathA string, blockPathB string, labelKey string, labelValues []string, metricName string, minTimestamp int64, maxTimestamp int64, awsProfile string, detailsPath string, out io.Writer) error {
+	a, err := openDiffBlock(ctx, blockPathA, awsProfile, labelKey, labelValues, metricName)
+	if err != nil {
+		return pkgerrors.Wrapf(err, "open %s", blockPathA)
+	}
+	defer a.Close()
+	b, err := openDiffBlock(ctx, blockPathB, awsProfile, labelKey, labelValues, metricName)
+	if err != nil {
+		return pkgerrors.Wrapf(err, "open %s", blockPathB)
+	}
+	defer b.Close()
+
+	var details *json.Encoder
+	if detailsPath != "" {
+		f, err := os.Create(detailsPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		details = json.NewEncoder(f)
+	}
+	writeDetail := func(d *diffDetail) error {
+		if details == nil {
+			return nil
+		}
+		return details.Encode(d)
+	}
+
+	summary := &diffSummary{BlockA: blockPathA, BlockB: blockPathB}
+	for !a.done || !b.done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var cmp int
+		switch {
+		case a.done:
+			cmp = 1
+		case b.done:
+			cmp = -1
+		default:
+			cmp = labels.Compare(a.lset, b.lset)
+		}
+
+		switch {
+		case cmp < 0:
+			summary.SeriesOnlyInA++
+			if err := writeDetail(&diffDetail{Kind: "series_only_in_a", Labels: a.lset.Map()}); err != nil {
+				return err
+			}
+			if err := a.next(); err != nil {
+				return err
+			}
+		case cmp > 0:
+			summary.SeriesOnlyInB++
+			if err := writeDetail(&diffDetail{Kind: "series_only_in_b", Labels: b.lset.Map()}); err != nil {
+				return err
+			}
+			if err := b.next(); err != nil {
+				return err
+			}
+		default:
+			summary.CommonSeries++
+			d, err := diffSeries(a, b, minTimestamp, maxTimestamp, summary)
+			if err != nil {
+				return pkgerrors.Wrapf(err, "compare %s", a.lset)
+			}
+			if d != nil {
+				summary.SeriesWithDifferences++
+				if err := writeDetail(d); err != nil {
+					return err
+				}
+			}
+			if err := a.next(); err != nil {
+				return err
+			}
+			if err := b.next(); err != nil {
+				return err
+			}
+		}
+	}
+
+	summary.Identical = summary.SeriesOnlyInA == 0 && summary.SeriesOnlyInB == 0 && summary.SeriesWithDifferences == 0
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		return pkgerrors.Wrap(err, "encode summary")
+	}
+	if !summary.Identical {
+		return errDiffFound
+	}
+	return nil
+}
+
+// diffSeries compares the samples of the current series of a and b, which
+// have the same labels. It returns nil if they are identical.
+func diffSeries(a, b *diffBlock, minTimestamp, maxTimestamp int64, summary *diffSummary) (*diffDetail, error) {
+	sa, err := readSeriesSamples(a.chunkr, a.chks, minTimestamp, maxTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := readSeriesSamples(b.chunkr, b.chks, minTimestamp, maxTimestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &diffDetail{Kind: "samples_differ", Labels: a.lset.Map()}
+	example := func(t int64, i, j int) {
+		if len(d.Examples) >= maxDiffExamples {
+			return
+		}
+		e := diffExample{Timestamp: t}
+		if i >= 0 {
+			e.A, e.HistogramA = sa.example(i)
+		}
+		if j >= 0 {
+			e.B, e.HistogramB = sb.example(j)
+		}
+		d.Examples = append(d.Examples, e)
+	}
+	ta, tb := sa.timestamps, sb.timestamps
+	i, j := 0, 0
+	for i < len(ta) || j < len(tb) {
+		switch {
+		case j == len(tb) || (i < len(ta) && ta[i] < tb[j]):
+			d.OnlyInA++
+			example(ta[i], i, -1)
+			i++
+		case i == len(ta) || tb[j] < ta[i]:
+			d.OnlyInB++
+			example(tb[j], -1, j)
+			j++
+		default:
+			summary.SamplesCompared++
+			if !sameSample(sa, i, sb, j) {
+				d.Differing++
+				example(ta[i], i, j)
+			}
+			i++
+			j++
+		}
+	}
+
+	summary.SamplesOnlyInA += d.OnlyInA
+	summary.SamplesOnlyInB += d.OnlyInB
+	summary.SamplesDiffering += d.Differing
+	if d.OnlyInA == 0 && d.OnlyInB == 0 && d.Differing == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// seriesSamples are the samples of a series. histograms holds the native
+// histogram of every sample read from a histogram chunk and nil for float
+// samples.
+type seriesSamples struct {
+	timestamps []int64
+	values     []float64
+	histograms []*histogram.FloatHistogram
+}
+
+func (s *seriesSamples) example(i int) (*float64, *writer.JSONHistogram) {
+	if h := s.histograms[i]; h != nil {
+		jh := writer.NewJSONHistogram(h)
+		return nil, &jh
+	}
+	return &s.values[i], nil
+}
+
+// sameSample reports whether the i-th sample of a equals the j-th sample of
+// b. A float sample never equals a histogram.
+func sameSample(a *seriesSamples, i int, b *seriesSamples, j int) bool {
+	ha, hb := a.histograms[i], b.histograms[j]
+	if ha == nil || hb == nil {
+		return ha == nil && hb == nil && sameValue(a.values[i], b.values[j])
+	}
+	return sameHistogram(ha, hb)
+}
+
+// sameValue reports whether two sample values are identical, treating NaNs
+// such as staleness markers as equal if their bits are equal.
+func sameValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.Float64bits(a) == math.Float64bits(b)
+	}
+	return a == b
+}
+
+func sameHistogram(a, b *histogram.FloatHistogram) bool {
+	return a.CounterResetHint == b.CounterResetHint &&
+		a.Schema == b.Schema &&
+		sameValue(a.ZeroThreshold, b.ZeroThreshold) &&
+		sameValue(a.ZeroCount, b.ZeroCount) &&
+		sameValue(a.Count, b.Count) &&
+		sameValue(a.Sum, b.Sum) &&
+		sameSpans(a.PositiveSpans, b.PositiveSpans) &&
+		sameSpans(a.NegativeSpans, b.NegativeSpans) &&
+		sameValues(a.PositiveBuckets, b.PositiveBuckets) &&
+		sameValues(a.NegativeBuckets, b.NegativeBuckets) &&
+		sameValues(a.CustomValues, b.CustomValues)
+}
+
+func sameSpans(a, b []histogram.Span) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameValues(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameValue(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// readSeriesSamples reads all samples of a series within [mint, maxt].
+// Chunks outside of the range are not read at all.
+func readSeriesSamples(chunkr tsdb.ChunkReader, chks []chunks.Meta, mint, maxt int64) (*seriesSamples, error) {
+	s := &seriesSamples{}
+	add := func(t int64, v float64, h *histogram.FloatHistogram) {
+		if t < mint || maxt < t {
+			return
+		}
+		s.timestamps = append(s.timestamps, t)
+		s.values = append(s.values, v)
+		s.histograms = append(s.histograms, h)
+	}
+	for _, meta := range chks {
+		if !meta.OverlapsClosedInterval(mint, maxt) {
+			continue
+		}
+		chk, err := chunkr.Chunk(meta.Ref)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "chunkr.Chunk")
+		}
+		if hc, ok := chk.(*histogram.Chunk); ok {
+			timestamps, histograms, err := hc.Histograms()
+			if err != nil {
+				return nil, pkgerrors.Wrap(err, "decode histograms")
+			}
+			for i, t := range timestamps {
+				add(t, 0, histograms[i])
+			}
+			continue
+		}
+		it := chk.Iterator(nil)
+		for it.Next() {
+			t, v := it.At()
+			add(t, v, nil)
+		}
+		if it.Err() != nil {
+			return nil, pkgerrors.Wrap(it.Err(), "iterator.Err")
+		}
+	}
+	return s, nil
+}
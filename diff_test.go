@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func runDiffSummary(t *testing.T, a, b string, labelKey string, labelValues []string, maxt int64, detailsPath string) (*diffSummary, error) {
+	var buf bytes.Buffer
+	err := runDiff(context.Background(), a, b, labelKey, labelValues, "", math.MinInt64, maxt, "", detailsPath, &buf)
+	var summary diffSummary
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatalf("decode summary %q: %s", buf.String(), err)
+	}
+	return &summary, err
+}
+
+func TestRunDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := testblock.Write(t, filepath.Join(dir, "a"), 240,
+		labels.FromStrings("__name__", "a", "i", "1"),
+		labels.FromStrings("__name__", "a", "i", "2"),
+		labels.FromStrings("__name__", "b", "i", "1"),
+		labels.FromStrings("__name__", "c", "i", "1"),
+	)
+
+	// b lacks {__name__="a", i="1"} and adds {__name__="b", i="3"}. One
+	// sample of {__name__="b", i="1"} differs and {__name__="c", i="1"}
+	// ends 40 samples earlier.
+	w, err := writer.NewTSDBWriter(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timestamps []int64
+	var values []float64
+	for i := 0; i < 240; i++ {
+		timestamps = append(timestamps, int64(i)*1000)
+		values = append(values, float64(i))
+	}
+	for _, s := range []struct {
+		lset labels.Labels
+		n    int
+		diff bool
+	}{
+		{lset: labels.FromStrings("__name__", "a", "i", "2"), n: 240},
+		{lset: labels.FromStrings("__name__", "b", "i", "1"), n: 240, diff: true},
+		{lset: labels.FromStrings("__name__", "b", "i", "3"), n: 240},
+		{lset: labels.FromStrings("__name__", "c", "i", "1"), n: 200},
+	} {
+		vs := append([]float64(nil), values[:s.n]...)
+		if s.diff {
+			vs[5] = -1
+		}
+		if err := w.Write(&s.lset, timestamps[:s.n], vs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := filepath.Join(dir, "b", w.ULID().String())
+
+	summary, err := runDiffSummary(t, a, a, "", nil, math.MaxInt64, "")
+	if err != nil || !summary.Identical || summary.CommonSeries != 4 || summary.SamplesCompared != 960 {
+		t.Fatalf("expected a block to equal itself, got %v %+v", err, summary)
+	}
+
+	details := filepath.Join(dir, "details.json")
+	summary, err = runDiffSummary(t, a, b, "", nil, math.MaxInt64, details)
+	if err != errDiffFound {
+		t.Fatalf("expected %v, got %v", errDiffFound, err)
+	}
+	want := diffSummary{
+		BlockA:                a,
+		BlockB:                b,
+		SeriesOnlyInA:         1,
+		SeriesOnlyInB:         1,
+		CommonSeries:          3,
+		SeriesWithDifferences: 2,
+		SamplesCompared:       680,
+		SamplesOnlyInA:        40,
+		SamplesDiffering:      1,
+	}
+	if *summary != want {
+		t.Fatalf("expected %+v, got %+v", want, summary)
+	}
+
+	f, err := os.Open(details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var kinds []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var d diffDetail
+		if err := json.Unmarshal(sc.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, d.Kind+" "+labels.FromMap(d.Labels).String())
+		if d.Kind == "samples_differ" && d.Labels["__name__"] == "b" {
+			if len(d.Examples) != 1 || d.Examples[0].Timestamp != 5000 || *d.Examples[0].A != 5 || *d.Examples[0].B != -1 {
+				t.Fatalf("unexpected examples %+v", d.Examples)
+			}
+		}
+	}
+	wantKinds := []string{
+		`series_only_in_a {__name__="a", i="1"}`,
+		`samples_differ {__name__="b", i="1"}`,
+		`series_only_in_b {__name__="b", i="3"}`,
+		`samples_differ {__name__="c", i="1"}`,
+	}
+	if len(kinds) != len(wantKinds) {
+		t.Fatalf("expected details %v, got %v", wantKinds, kinds)
+	}
+	for i := range kinds {
+		if kinds[i] != wantKinds[i] {
+			t.Fatalf("expected details %v, got %v", wantKinds, kinds)
+		}
+	}
+
+	// The postings of several label values are merged by series ref, which
+	// the walk relies on to follow the order of the labels.
+	summary, err = runDiffSummary(t, a, b, "i", []string{"3", "1"}, 100000, "")
+	if err != errDiffFound {
+		t.Fatalf("expected %v, got %v", errDiffFound, err)
+	}
+	if summary.SeriesOnlyInA != 1 || summary.SeriesOnlyInB != 1 || summary.CommonSeries != 2 || summary.SeriesWithDifferences != 1 || summary.SamplesOnlyInA != 0 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestRunDiffHistograms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lset := labels.FromStrings("__name__", "h")
+	a := testblock.WriteChunks(t, filepath.Join(dir, "a"), lset, testblock.HistogramChunk(t))
+	b := testblock.WriteChunks(t, filepath.Join(dir, "b"), lset, testblock.HistogramChunk(t))
+	summary, err := runDiffSummary(t, a, b, "", nil, math.MaxInt64, "")
+	if err != nil || summary.SamplesCompared != 4 {
+		t.Fatalf("expected identical histograms, got %v %+v", err, summary)
+	}
+
+	// Float samples with the count of every histogram as value differ
+	// from the histograms.
+	var samples [][2]float64
+	for i := 0; i < 4; i++ {
+		samples = append(samples, [2]float64{float64(i+1) * 1000, float64(10 + 3*i)})
+	}
+	c := testblock.WriteChunks(t, filepath.Join(dir, "c"), lset, testblock.XORChunk(t, samples...))
+	details := filepath.Join(dir, "details.json")
+	summary, err = runDiffSummary(t, a, c, "", nil, math.MaxInt64, details)
+	if err != errDiffFound || summary.SamplesDiffering != 4 {
+		t.Fatalf("expected 4 differing samples, got %v %+v", err, summary)
+	}
+	raw, err := ioutil.ReadFile(details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d struct {
+		Examples []struct {
+			A          *float64         `json:"a"`
+			B          *float64         `json:"b"`
+			HistogramA *json.RawMessage `json:"histogramA"`
+			HistogramB *json.RawMessage `json:"histogramB"`
+		} `json:"examples"`
+	}
+	if err := json.Unmarshal(raw, &d); err != nil {
+		t.Fatal(err)
+	}
+	e := d.Examples[0]
+	if len(d.Examples) != 4 || e.A != nil || e.HistogramA == nil || e.B == nil || *e.B != 10 || e.HistogramB != nil {
+		t.Fatalf("unexpected examples %s", raw)
+	}
+}
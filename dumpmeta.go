@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+
+	"github.com/oklog/ulid"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+type metaDump struct {
+	Block   string          `json:"block"`
+	Summary metaSummary     `json:"summary"`
+	Meta    json.RawMessage `json:"meta"`
+}
+
+// metaSummary holds values computed from meta.json that are hard to read from
+// the raw file.
+type metaSummary struct {
+	Created              string            `json:"created"`
+	MinTime              string            `json:"minTime"`
+	MaxTime              string            `json:"maxTime"`
+	Duration             string            `json:"duration"`
+	CompactionLevel      int               `json:"compactionLevel"`
+	Sources              int               `json:"sources"`
+	Parents              int               `json:"parents"`
+	SamplesPerSeries     float64           `json:"samplesPerSeries"`
+	SamplesPerChunk      float64           `json:"samplesPerChunk"`
+	ThanosLabels         map[string]string `json:"thanosLabels,omitempty"`
+	ThanosSource         string            `json:"thanosSource,omitempty"`
+	ThanosResolution     string            `json:"thanosResolution,omitempty"`
+	ThanosFilesSizeBytes int64             `json:"thanosFilesSizeBytes,omitempty"`
+}
+
+// thanosMeta is the part of the Thanos extension of meta.json that is
+// summarized. The full extension is kept in the raw meta.json.
+type thanosMeta struct {
+	Thanos *struct {
+		Labels     map[string]string `json:"labels"`
+		Source     string            `json:"source"`
+		Downsample struct {
+			Resolution int64 `json:"resolution"`
+		} `json:"downsample"`
+		Files []struct {
+			SizeBytes int64 `json:"size_bytes"`
+		} `json:"files"`
+	} `json:"thanos"`
+}
+
+// runDumpMeta writes meta.json of a block together with a summary of it,
+// including the time range of the block in human-readable form.
+func runDumpMeta(ctx context.Context, blockPath string, awsProfile string, out io.Writer) error {
+	b, err := dump.ReadMetaFile(ctx, blockPath, awsProfile)
+	if err != nil {
+		return pkgerrors.Wrap(err, "read meta.json")
+	}
+	var meta tsdb.BlockMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return pkgerrors.Wrap(err, "decode meta.json")
+	}
+	var thanos thanosMeta
+	if err := json.Unmarshal(b, &thanos); err != nil {
+		return pkgerrors.Wrap(err, "decode thanos meta")
+	}
+
+	s := metaSummary{
+		Created:         formatTimestamp(int64(meta.ULID.Time())),
+		MinTime:         formatTimestamp(meta.MinTime),
+		MaxTime:         formatTimestamp(meta.MaxTime),
+		Duration:        (time.Duration(meta.MaxTime-meta.MinTime) * time.Millisecond).String(),
+		CompactionLevel: meta.Compaction.Level,
+		Sources:         len(meta.Compaction.Sources),
+		Parents:         len(meta.Compaction.Parents),
+	}
+	if meta.ULID == (ulid.ULID{}) {
+		s.Created = ""
+	}
+	if meta.Stats.NumSeries > 0 {
+		s.SamplesPerSeries = float64(meta.Stats.NumSamples) / float64(meta.Stats.NumSeries)
+	}
+	if meta.Stats.NumChunks > 0 {
+		s.SamplesPerChunk = float64(meta.Stats.NumSamples) / float64(meta.Stats.NumChunks)
+	}
+	if t := thanos.Thanos; t != nil {
+		s.ThanosLabels = t.Labels
+		s.ThanosSource = t.Source
+		s.ThanosResolution = (time.Duration(t.Downsample.Resolution) * time.Millisecond).String()
+		for _, f := range t.Files {
+			s.ThanosFilesSizeBytes += f.SizeBytes
+		}
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&metaDump{Block: blockID(blockPath), Summary: s, Meta: json.RawMessage(b)})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestRunDumpMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumpmeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "a", "instance", "1"),
+		labels.FromStrings("__name__", "a", "instance", "2"),
+	)
+	dump := func() *metaDump {
+		var buf bytes.Buffer
+		if err := runDumpMeta(context.Background(), block, "", &buf); err != nil {
+			t.Fatal(err)
+		}
+		var d metaDump
+		if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		return &d
+	}
+
+	d := dump()
+	if d.Block != filepath.Base(block) {
+		t.Fatalf("unexpected block %s", d.Block)
+	}
+	want := metaSummary{
+		Created: d.Summary.Created,
+		MinTime: "1970-01-01T00:00:00Z",
+		// The block ends 1ms after its last sample at 239s.
+		MaxTime:          "1970-01-01T00:03:59Z",
+		Duration:         "3m59.001s",
+		CompactionLevel:  1,
+		Sources:          1,
+		SamplesPerSeries: 240,
+		SamplesPerChunk:  120,
+	}
+	if d.Summary.Created == "" || !reflect.DeepEqual(d.Summary, want) {
+		t.Fatalf("expected summary %+v, got %+v", want, d.Summary)
+	}
+
+	// The Thanos extension is summarized and kept in the raw meta.json.
+	path := filepath.Join(block, "meta.json")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	meta["thanos"] = map[string]interface{}{
+		"labels":     map[string]string{"cluster": "c"},
+		"source":     "compactor",
+		"downsample": map[string]int64{"resolution": 300000},
+		"files":      []map[string]interface{}{{"rel_path": "index", "size_bytes": 100}, {"rel_path": "chunks/000001", "size_bytes": 1000}},
+	}
+	if b, err = json.Marshal(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	d = dump()
+	s := d.Summary
+	if s.ThanosLabels["cluster"] != "c" || s.ThanosSource != "compactor" || s.ThanosResolution != "5m0s" || s.ThanosFilesSizeBytes != 1100 {
+		t.Fatalf("unexpected thanos summary %+v", s)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(d.Meta, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["thanos"]; !ok {
+		t.Fatalf("expected the raw meta.json, got %s", d.Meta)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runDumpMeta(context.Background(), block, "", ioutil.Discard); err == nil {
+		t.Fatal("expected an error for an invalid meta.json")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/redact"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// errorHandler decides what happens when a chunk or series of a block cannot
+// be read: "fail" aborts the dump, while "skip" and "log" skip the chunk or
+// series and continue. "log" additionally logs every skipped item. All errors
+// are recorded in the error report if one is configured. Labels are redacted
+// in the report and logs if a redactor is set.
+type errorHandler struct {
+	mode     string
+	redactor *redact.Redactor
+	report   io.WriteCloser
+	enc      *json.Encoder
+	skipped  int
+}
+
+type errorRecord struct {
+	SeriesRef uint64            `json:"seriesRef"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	ChunkRef  uint64            `json:"chunkRef,omitempty"`
+	Error     string            `json:"error"`
+}
+
+// newErrorHandler creates an errorHandler. If reportPath is not empty, errors
+// are recorded there as JSON lines, appended to an existing report if
+// appendReport is set.
+func newErrorHandler(mode string, reportPath string, appendReport bool, redactor *redact.Redactor) (*errorHandler, error) {
+	switch mode {
+	case "fail", "skip", "log":
+	default:
+		return nil, fmt.Errorf("invalid -on-error mode: %s", mode)
+	}
+	h := &errorHandler{mode: mode, redactor: redactor}
+	if reportPath != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if appendReport {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(reportPath, flags, 0666)
+		if err != nil {
+			return nil, err
+		}
+		h.report = f
+		h.enc = json.NewEncoder(f)
+	}
+	return h, nil
+}
+
+// handle records an error for a series (chunkRef 0) or chunk. It returns err
+// if the dump should be aborted, or nil if the series or chunk should be
+// skipped.
+func (h *errorHandler) handle(ref uint64, lset labels.Labels, chunkRef uint64, err error) error {
+	if h == nil {
+		return err
+	}
+	if h.redactor != nil && len(lset) > 0 {
+		lset = h.redactor.Labels(lset)
+	}
+	if h.enc != nil {
+		rec := errorRecord{SeriesRef: ref, ChunkRef: chunkRef, Error: err.Error()}
+		if len(lset) > 0 {
+			rec.Labels = lset.Map()
+		}
+		if encErr := h.enc.Encode(rec); encErr != nil {
+			return encErr
+		}
+	}
+	if h.mode == "fail" {
+		return err
+	}
+	h.skipped++
+	if h.mode == "log" {
+		if chunkRef != 0 {
+			log.Printf("skipping chunk %d of series %s: %s", chunkRef, lset, err)
+		} else {
+			log.Printf("skipping series %d: %s", ref, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the error report and logs how many items were skipped.
+func (h *errorHandler) Close() error {
+	if h == nil {
+		return nil
+	}
+	if h.skipped > 0 {
+		log.Printf("skipped %d unreadable chunks or series", h.skipped)
+	}
+	if h.report != nil {
+		return h.report.Close()
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/redact"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+func TestErrorHandlerRedactsReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errreport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := redact.New(redact.Options{Replace: []string{"customer"}, DropValues: `^10\.`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "errors.json")
+	h, err := newErrorHandler("skip", path, false, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lset := labels.FromStrings("__name__", "up", "customer", "acme", "ip", "10.0.0.1")
+	if err := h.handle(1, lset, 2, errors.New("checksum mismatch")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"seriesRef":1,"labels":{"__name__":"up","customer":"redacted"},"chunkRef":2,"error":"checksum mismatch"}`
+	if got := strings.TrimSpace(string(b)); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+// seriesSamplesWriter counts the samples written for every series.
+type seriesSamplesWriter map[string]int
+
+func (w seriesSamplesWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	w[lset.String()] += len(values)
+	return nil
+}
+
+func (w seriesSamplesWriter) Close() error { return nil }
+
+func TestRunOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errreport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every series has two chunks of 120 samples. The first chunk of
+	// instance 2 is corrupted.
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "a", "instance", "1"),
+		labels.FromStrings("__name__", "a", "instance", "2"),
+		labels.FromStrings("__name__", "a", "instance", "3"),
+	)
+	indexr, err := dump.OpenIndexReader(context.Background(), block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := indexr.Postings("instance", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seriesRef, chunkRef uint64
+	for p.Next() {
+		var lset labels.Labels
+		var chks []chunks.Meta
+		if err := indexr.Series(p.At(), &lset, &chks); err != nil {
+			t.Fatal(err)
+		}
+		seriesRef, chunkRef = p.At(), chks[0].Ref
+	}
+	indexr.Close()
+	testblock.CorruptChunk(t, block, chunkRef)
+
+	runWith := func(mode string) (seriesSamplesWriter, []errorRecord, string, error) {
+		report := filepath.Join(dir, mode+".json")
+		h, err := newErrorHandler(mode, report, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		w := seriesSamplesWriter{}
+		runErr := run(context.Background(), runOptions{
+			Block:          block,
+			MinTime:        math.MinInt64,
+			MaxTime:        math.MaxInt64,
+			ExternalLabels: "{}",
+			OnError:        h,
+			Writer:         w,
+		})
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []errorRecord
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for dec.More() {
+			var rec errorRecord
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rec)
+		}
+		return w, records, logs.String(), runErr
+	}
+
+	for _, mode := range []string{"skip", "log"} {
+		w, records, logs, err := runWith(mode)
+		if err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		// The other chunk of instance 2 and all other series are dumped.
+		want := seriesSamplesWriter{
+			`{__name__="a", instance="1"}`: 240,
+			`{__name__="a", instance="2"}`: 120,
+			`{__name__="a", instance="3"}`: 240,
+		}
+		if len(w) != len(want) {
+			t.Fatalf("%s: expected %v, got %v", mode, want, w)
+		}
+		for s, n := range want {
+			if w[s] != n {
+				t.Fatalf("%s: expected %v, got %v", mode, want, w)
+			}
+		}
+		if len(records) != 1 || records[0].SeriesRef != seriesRef || records[0].ChunkRef != chunkRef || !strings.Contains(records[0].Error, "checksum mismatch") {
+			t.Fatalf("%s: unexpected report %+v", mode, records)
+		}
+		if !strings.Contains(logs, "skipped 1 unreadable chunks or series") {
+			t.Fatalf("%s: expected the skipped chunk to be counted, got logs %q", mode, logs)
+		}
+		if logged := strings.Contains(logs, "skipping chunk"); logged != (mode == "log") {
+			t.Fatalf("%s: unexpected logs %q", mode, logs)
+		}
+	}
+
+	// fail stops at the corrupted chunk, after recording it.
+	w, records, _, err := runWith("fail")
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("fail: expected a checksum mismatch, got %v", err)
+	}
+	if _, ok := w[`{__name__="a", instance="3"}`]; ok {
+		t.Fatalf("fail: expected the dump to stop, got %v", w)
+	}
+	if len(records) != 1 || records[0].ChunkRef != chunkRef {
+		t.Fatalf("fail: unexpected report %+v", records)
+	}
+}
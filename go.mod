@@ -10,7 +10,13 @@ require (
 	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.17.78
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.80.1
 	github.com/go-kit/kit v0.9.0
+	github.com/golang/snappy v0.0.1
+	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.17.11
+	github.com/klauspost/pgzip v1.2.6
+	github.com/oklog/ulid v1.3.1
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.2.0
 	github.com/prometheus/prometheus v1.8.2-0.20200106144642-d9613e5c466c
 )
 
@@ -35,11 +41,8 @@ require (
 	github.com/cespare/xxhash/v2 v2.1.0 // indirect
 	github.com/go-logfmt/logfmt v0.4.0 // indirect
 	github.com/golang/protobuf v1.3.2 // indirect
-	github.com/golang/snappy v0.0.1 // indirect
 	github.com/kr/logfmt v0.0.0-20140226030751-b84e30acd515 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
-	github.com/oklog/ulid v1.3.1 // indirect
-	github.com/prometheus/client_golang v1.2.0 // indirect
 	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4 // indirect
 	github.com/prometheus/common v0.7.0 // indirect
 	github.com/prometheus/procfs v0.0.5 // indirect
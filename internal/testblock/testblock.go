@@ -0,0 +1,152 @@
+// Package testblock writes small blocks for tests.
+package testblock
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// Write writes a block into dir holding the given series with n samples each,
+// one per second with the values 0 to n-1, and returns its path.
+func Write(t testing.TB, dir string, n int, series ...labels.Labels) string {
+	w, err := writer.NewTSDBWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timestamps []int64
+	var values []float64
+	for i := 0; i < n; i++ {
+		timestamps = append(timestamps, int64(i)*1000)
+		values = append(values, float64(i))
+	}
+	for _, lset := range series {
+		if err := w.Write(&lset, timestamps, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, w.ULID().String())
+}
+
+// WriteChunks writes a block into the directory block holding a single series
+// with the chunks of metas, and returns block. Unlike Write, the chunks are
+// written as they are, so they may overlap, be of any encoding or disagree
+// with their metas.
+func WriteChunks(t testing.TB, block string, lset labels.Labels, metas ...chunks.Meta) string {
+	chunkw, err := chunks.NewWriter(filepath.Join(block, "chunks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// WriteChunks sets the refs of the metas passed to it.
+	if err := chunkw.WriteChunks(metas...); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	indexw, err := index.NewWriter(context.Background(), filepath.Join(block, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var symbols []string
+	for _, l := range lset {
+		symbols = append(symbols, l.Name, l.Value)
+	}
+	sort.Strings(symbols)
+	for _, s := range symbols {
+		if err := indexw.AddSymbol(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := indexw.AddSeries(0, lset, metas...); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := tsdb.BlockMeta{
+		MinTime: metas[0].MinTime,
+		MaxTime: metas[0].MaxTime + 1,
+		Stats:   tsdb.BlockStats{NumSeries: 1, NumChunks: uint64(len(metas))},
+		Version: 1,
+	}
+	for _, m := range metas {
+		if m.MinTime < meta.MinTime {
+			meta.MinTime = m.MinTime
+		}
+		if m.MaxTime+1 > meta.MaxTime {
+			meta.MaxTime = m.MaxTime + 1
+		}
+		meta.Stats.NumSamples += uint64(m.Chunk.NumSamples())
+	}
+	b, err := json.Marshal(&meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(block, "meta.json"), b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// CorruptChunk flips a byte in the data of the chunk with the given ref, so
+// that its checksum no longer matches.
+func CorruptChunk(t testing.TB, block string, ref uint64) {
+	segment := filepath.Join(block, "chunks", fmt.Sprintf("%06d", ref>>32+1))
+	b, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Skip the length and encoding of the chunk.
+	b[int(uint32(ref))+4] ^= 0xff
+	if err := ioutil.WriteFile(segment, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// XORChunk returns a float chunk holding the given timestamp and value pairs
+// with a meta covering them.
+func XORChunk(t testing.TB, samples ...[2]float64) chunks.Meta {
+	chk := chunkenc.NewXORChunk()
+	app, err := chk.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range samples {
+		app.Append(int64(s[0]), s[1])
+	}
+	return chunks.Meta{MinTime: int64(samples[0][0]), MaxTime: int64(samples[len(samples)-1][0]), Chunk: chk}
+}
+
+// HistogramChunk returns a histogram chunk written by Prometheus v2.54 with 4
+// samples at 1000 to 4000 and a meta covering them.
+func HistogramChunk(t testing.TB) chunks.Meta {
+	b, err := hex.DecodeString("000400ff3f50624dd2f1a9fc8ca48c631bf8fa31400000000000000008c6ef1f44e388bfff1243097ffc06b13400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk, err := histogram.NewChunk(histogram.EncHistogram, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks.Meta{MinTime: 1000, MaxTime: 4000, Chunk: chk}
+}
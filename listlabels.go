@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// runListLabels writes the label names of a block, or the values of labelName
+// if it is not empty, one per line in sorted order. Without a selector they
+// are read from the label indices without looking at any series.
+func runListLabels(ctx context.Context, blockPath string, labelKey string, labelValues []string, metricName string, awsProfile string, labelName string, out io.Writer) error {
+	indexr, err := dump.OpenIndexReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		return pkgerrors.Wrap(err, "open index")
+	}
+	defer indexr.Close()
+
+	var res []string
+	if labelKey == "" && metricName == "" {
+		res, err = indexLabels(indexr, labelName)
+	} else {
+		res, err = seriesLabels(ctx, indexr, labelKey, labelValues, metricName, labelName)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, s := range res {
+		if _, err := fmt.Fprintln(out, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexLabels(indexr *index.Reader, labelName string) ([]string, error) {
+	if labelName == "" {
+		names, err := indexr.LabelNames()
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "indexr.LabelNames")
+		}
+		return names, nil
+	}
+
+	tuples, err := indexr.LabelValues(labelName)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "indexr.LabelValues")
+	}
+	values := make([]string, 0, tuples.Len())
+	for i := 0; i < tuples.Len(); i++ {
+		t, err := tuples.At(i)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "tuples.At")
+		}
+		values = append(values, t[0])
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// seriesLabels collects label names or values from the selected series.
+func seriesLabels(ctx context.Context, indexr *index.Reader, labelKey string, labelValues []string, metricName string, labelName string) ([]string, error) {
+	postings, err := dump.SelectPostings(indexr, labelKey, labelValues, metricName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{}
+	for postings.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lset := labels.Labels{}
+		chks := []chunks.Meta{}
+		if err := indexr.Series(postings.At(), &lset, &chks); err != nil {
+			return nil, pkgerrors.Wrap(err, "indexr.Series")
+		}
+		for _, l := range lset {
+			if labelName == "" {
+				seen[l.Name] = struct{}{}
+			} else if l.Name == labelName {
+				seen[l.Value] = struct{}{}
+			}
+		}
+	}
+	if postings.Err() != nil {
+		return nil, pkgerrors.Wrap(postings.Err(), "postings.Err")
+	}
+
+	res := make([]string, 0, len(seen))
+	for s := range seen {
+		res = append(res, s)
+	}
+	sort.Strings(res)
+	return res, nil
+}
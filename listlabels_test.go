@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestRunListLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listlabels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "a", "job", "api", "instance", "1"),
+		labels.FromStrings("__name__", "a", "job", "db", "instance", "2"),
+		labels.FromStrings("__name__", "b", "job", "api", "path", "/"),
+	)
+
+	for _, tc := range []struct {
+		name        string
+		labelKey    string
+		labelValues []string
+		metricName  string
+		labelName   string
+		want        string
+	}{
+		{name: "label names", want: "__name__\ninstance\njob\npath\n"},
+		{name: "label values", labelName: "job", want: "api\ndb\n"},
+		{name: "names by metric", metricName: "a", want: "__name__\ninstance\njob\n"},
+		{name: "values by label", labelKey: "job", labelValues: []string{"api"}, labelName: "__name__", want: "a\nb\n"},
+		{name: "values by label and metric", labelKey: "job", labelValues: []string{"api", "db"}, metricName: "a", labelName: "instance", want: "1\n2\n"},
+		{name: "missing label", labelName: "tenant", want: ""},
+	} {
+		var buf bytes.Buffer
+		if err := runListLabels(context.Background(), block, tc.labelKey, tc.labelValues, tc.metricName, "", tc.labelName, &buf); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if buf.String() != tc.want {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, buf.String())
+		}
+	}
+}
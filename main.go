@@ -1,27 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
-	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/ryotarai/prometheus-tsdb-dump/pkg/chunkreader"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/redact"
 	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
 
 	"errors"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	gokitlog "github.com/go-kit/kit/log"
@@ -29,24 +31,76 @@ import (
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
-	"github.com/prometheus/prometheus/tsdb/chunks"
-	"github.com/prometheus/prometheus/tsdb/index"
 )
 
-const s3DownloadTimeout = 5 * time.Minute
+// exitInterrupted is the exit status of a dump stopped by SIGINT or SIGTERM
+// after a complete series, which can be resumed if -checkpoint was set. Other
+// errors exit with 1.
+const exitInterrupted = 3
 
 func main() {
 	blockPath := flag.String("block", "", "Path to block directory")
 	labelKey := flag.String("label-key", "", "")
 	labelValue := flag.String("label-value", "", "")
+	dedup := flag.String("dedup", "", "Sort the samples of every series and keep one sample per timestamp, resolving conflicting values by first, last or max; samples are written verbatim if empty")
 	externalLabels := flag.String("external-labels", "{}", "Labels to be added to dumped result in JSON")
+	redactHash := flag.String("redact-hash", "", "Comma-separated label names, or ~regex matching label names, whose values are replaced with a keyed hash")
+	redactReplace := flag.String("redact-replace", "", "Comma-separated label names, or ~regex matching label names, whose values are replaced with -redact-replacement")
+	redactDrop := flag.String("redact-drop", "", "Comma-separated label names, or ~regex matching label names, to remove from every series")
+	redactHashValues := flag.String("redact-hash-values", "", "Regular expression matched against all label values but __name__; every match is replaced with a keyed hash")
+	redactReplaceValues := flag.String("redact-replace-values", "", "Regular expression matched against all label values but __name__; every match is replaced with -redact-replacement")
+	redactDropValues := flag.String("redact-drop-values", "", "Regular expression matched against all label values but __name__; labels whose value matches are removed")
+	redactReplacement := flag.String("redact-replacement", redact.DefaultReplacement, "Value of the labels selected by -redact-replace")
+	redactAllowMerge := flag.Bool("redact-allow-merge", false, "Write series whose labels equal those of another series after redaction instead of failing; not supported with -format tsdb")
+	redactKeyFile := flag.String("redact-key-file", "", "File holding the secret key of the HMAC used by -redact-hash and -redact-hash-values")
 	metricName := flag.String("metric-name", "", "Only dump series for this metric (__name__)")
-	minTimestamp := flag.Int64("min-timestamp", 0, "min of timestamp of datapoints to be dumped; unix time in msec")
-	maxTimestamp := flag.Int64("max-timestamp", math.MaxInt64, "min of timestamp of datapoints to be dumped; unix time in msec")
-	format := flag.String("format", "victoriametrics", "")
+	shardFlag := flag.String("shard", "", "Dump only the i-th of n disjoint subsets of the series, given as i/n with 0 <= i < n, to split a block across n workers")
+	minTimestampFlag := flag.String("min-timestamp", "", "min of timestamp of datapoints to be dumped; unix time in msec, @unix seconds, RFC3339 or a duration relative to the block max time such as -24h")
+	maxTimestampFlag := flag.String("max-timestamp", "", "max of timestamp of datapoints to be dumped; unix time in msec, @unix seconds, RFC3339 or a duration relative to the block max time such as -1h")
+	timeShiftFlag := flag.Duration("time-shift", 0, "Add this duration, which may be negative, to the timestamp of every dumped sample")
+	rebaseTo := flag.String("rebase-to", "", "Shift timestamps so that the dumped samples start at this time; unix time in msec, @unix seconds, RFC3339, now or a duration relative to now such as -24h")
+	allowOverlap := flag.Bool("allow-overlap", false, "Write shifted samples with -format tsdb even if blocks in -output overlap their time range")
+	format := flag.String("format", "victoriametrics", "Output format (victoriametrics, victoriametrics-native, json, openmetrics, tsdb or remote-write with -push-url); json, openmetrics and remote-write also write native histograms")
+	skipHistograms := flag.Bool("skip-histograms", false, "Skip native histograms with formats that cannot write them instead of failing")
+	metadataFile := flag.String("metadata-file", "", "File with metric types, help and units written with -format openmetrics or remote-write, as returned by the Prometheus /api/v1/metadata API")
+	inferMetadata := flag.Bool("infer-metadata", false, "Guess the types of metrics not found in -metadata-file from their names (_total, _bucket, _count and _sum) for -format openmetrics or remote-write")
 	dumpIndex := flag.Bool("dump-index", false, "Dump index information in JSON and exit")
+	dumpMeta := flag.Bool("dump-meta", false, "Dump meta.json of the block with a human-readable summary in JSON and exit")
+	stats := flag.Bool("stats", false, "Report cardinality and size statistics of the block and exit; reads the header of every selected chunk, one request per chunk on S3")
+	statsFormat := flag.String("stats-format", "json", "Format of -stats output (json or table)")
+	statsTop := flag.Int("stats-top", 10, "Number of metrics and label/value pairs with the most series to report with -stats; 0 reports all")
+	listLabels := flag.Bool("list-labels", false, "List label names in the block and exit")
+	listLabelValues := flag.String("list-label-values", "", "List values of this label name in the block and exit")
+	verify := flag.Bool("verify", false, "Verify the integrity of every series and chunk in the block, write a JSON report and exit; exits nonzero if problems are found")
+	verifyMaxProblems := flag.Int("verify-max-problems", 100, "Maximum number of problems listed in detail by -verify; 0 lists all")
+	diff := flag.String("diff", "", "Compare the block with this block (local or s3://), write a JSON summary and exit; exits nonzero if they differ")
+	diffDetails := flag.String("diff-details", "", "File to write every series that differs between the blocks of -diff to, as JSON lines")
+	splitBy := flag.String("split-by", "", "Split the output of -format tsdb into several blocks by time or label")
+	splitWindow := flag.Duration("split-window", 2*time.Hour, "Time range of each block written with -split-by time; blocks are aligned to multiples of it")
+	splitLabel := flag.String("split-label", "", "Label whose values the blocks written with -split-by label are partitioned by")
 	awsProfile := flag.String("aws-profile", "", "AWS profile to use when accessing S3")
-	output := flag.String("output", "", "File to write output to instead of stdout")
+	output := flag.String("output", "", "File to write output to instead of stdout; the directory to write the block into for -format tsdb")
+	compress := flag.String("compress", "", "Compress the output with gzip, zstd or snappy; detected from the -output file extension if empty, none disables compression")
+	outputDir := flag.String("output-dir", "", "Directory to write the output into as several files, rotated by -rotate-* and sharded by -output-shards, with a manifest")
+	rotateBytes := flag.Int64("rotate-bytes", 0, "Start a new file in -output-dir once the current one holds this many bytes before compression; 0 disables")
+	rotateSamples := flag.Int64("rotate-samples", 0, "Start a new file in -output-dir once the current one holds this many samples; 0 disables")
+	rotateSeries := flag.Int64("rotate-series", 0, "Start a new file in -output-dir once the current one holds this many series; 0 disables")
+	outputShards := flag.Int("output-shards", 1, "Number of files in -output-dir written at the same time, each holding a disjoint set of series")
+	outputShardBy := flag.String("output-shard-by", "hash", "How series are assigned to -output-shards: hash (of all labels) or metric (name)")
+	pushURL := flag.String("push-url", "", "URL of VictoriaMetrics (or vminsert) to push the output to with the /api/v1/import API (/api/v1/import/native with -format victoriametrics-native) instead of writing it, or of a remote write endpoint with -format remote-write")
+	pushTenant := flag.String("push-tenant", "", "Tenant (accountID or accountID:projectID) to push to with the cluster version of VictoriaMetrics")
+	pushExtraLabels := flag.String("push-extra-label", "", "Comma-separated name=value labels for VictoriaMetrics to add to every pushed series")
+	pushBatchBytes := flag.Int("push-batch-bytes", 4<<20, "Size of the JSON lines, native blocks or remote write series sent in each push request before compression")
+	pushConcurrency := flag.Int("push-concurrency", 2, "Number of push requests sent at the same time")
+	pushRetries := flag.Int("push-retries", 5, "Number of times a failed push request is retried with exponential backoff")
+	checkpointPath := flag.String("checkpoint", "", "File to record the last fully written series in, so that the dump can be resumed")
+	checkpointInterval := flag.Duration("checkpoint-interval", 10*time.Second, "Minimum time between updates of -checkpoint; a checkpoint is always saved when the dump stops")
+	resume := flag.Bool("resume", false, "Resume an interrupted dump from the position recorded in -checkpoint")
+	progressInterval := flag.Duration("progress-interval", 0, "Report progress on stderr at this interval; 0 disables progress reporting")
+	progressFormat := flag.String("progress-format", "text", "Format of progress reports (text or json)")
+	onErrorMode := flag.String("on-error", "fail", "What to do when a chunk or series cannot be read: fail, skip, or log (skip and log it)")
+	errorReport := flag.String("error-report", "", "File to record chunks and series that could not be read in, as JSON lines")
+	webListenAddress := flag.String("web.listen-address", "", "Address to expose Prometheus metrics of the dump on at /metrics, e.g. :9090")
 	flag.Parse()
 
 	labelValues := parseLabelValues(*labelValue)
@@ -54,229 +108,633 @@ func main() {
 	if *blockPath == "" {
 		log.Fatal("-block argument is required")
 	}
+	if *output != "" && *outputDir != "" {
+		log.Fatal("-output and -output-dir cannot be used together")
+	}
+	if *pushURL != "" && (*output != "" || *outputDir != "") {
+		log.Fatal("-push-url cannot be used together with -output or -output-dir")
+	}
+	if *format == "remote-write" && *pushURL == "" {
+		log.Fatal("-format remote-write requires -push-url")
+	}
 
-	var out io.Writer = os.Stdout
-	if *output != "" {
-		f, err := os.Create(*output)
+	var shard, shards int
+	if *shardFlag != "" {
+		var err error
+		shard, shards, err = dump.ParseShard(*shardFlag)
 		if err != nil {
-			log.Fatalf("error: %s", err)
+			log.Fatalf("error: -shard: %s", err)
 		}
-		defer f.Close()
-		out = f
 	}
 
-	if *dumpIndex {
-		if err := runDumpIndex(*blockPath, *labelKey, labelValues, *metricName, *awsProfile, out); err != nil {
-			log.Fatalf("error: %s", err)
-		}
-		return
+	if err := dump.ValidateDedup(*dedup); err != nil {
+		log.Fatalf("error: -dedup: %s", err)
 	}
 
-	if err := run(*blockPath, *labelKey, labelValues, *metricName, *format, *minTimestamp, *maxTimestamp, *externalLabels, *awsProfile, out); err != nil {
-		log.Fatalf("error: %s", err)
+	var redactor *redact.Redactor
+	if *redactHash != "" || *redactReplace != "" || *redactDrop != "" || *redactHashValues != "" || *redactReplaceValues != "" || *redactDropValues != "" {
+		var key []byte
+		if *redactKeyFile != "" {
+			b, err := ioutil.ReadFile(*redactKeyFile)
+			if err != nil {
+				log.Fatalf("error: -redact-key-file: %s", err)
+			}
+			key = bytes.TrimRight(b, "\r\n")
+		}
+		var err error
+		redactor, err = redact.New(redact.Options{
+			Hash:          parseLabelValues(*redactHash),
+			Key:           key,
+			Replace:       parseLabelValues(*redactReplace),
+			Replacement:   *redactReplacement,
+			Drop:          parseLabelValues(*redactDrop),
+			HashValues:    *redactHashValues,
+			ReplaceValues: *redactReplaceValues,
+			DropValues:    *redactDropValues,
+			AllowMerge:    *redactAllowMerge,
+		})
+		if err != nil {
+			log.Fatalf("error: redact: %s", err)
+		}
+		if *redactAllowMerge && writer.IsDirFormat(*format) {
+			log.Fatalf("-redact-allow-merge is not supported with -format %s, which cannot hold merged series", *format)
+		}
 	}
-}
 
-func run(blockPath string, labelKey string, labelValues []string, metricName string, outFormat string, minTimestamp int64, maxTimestamp int64, externalLabelsJSON string, awsProfile string, out io.Writer) error {
-	externalLabelsMap := map[string]string{}
-	if err := json.NewDecoder(strings.NewReader(externalLabelsJSON)).Decode(&externalLabelsMap); err != nil {
-		return pkgerrors.Wrap(err, "decode external labels")
+	if (*metadataFile != "" || *inferMetadata) && *format != "openmetrics" && *format != "remote-write" {
+		log.Fatal("-metadata-file and -infer-metadata require -format openmetrics or remote-write")
 	}
-	var externalLabels labels.Labels
-	for k, v := range externalLabelsMap {
-		externalLabels = append(externalLabels, labels.Label{Name: k, Value: v})
+	if (*format == "openmetrics" || *format == "victoriametrics-native") && *checkpointPath != "" {
+		log.Fatalf("-checkpoint is not supported with -format %s", *format)
 	}
 
-	wr, err := writer.NewWriter(outFormat, out)
+	ctx := shutdownContext()
 
-	indexr, err := openIndexReader(blockPath, awsProfile)
+	var blockMeta *tsdb.BlockMeta
+	readBlockMeta := func() (*tsdb.BlockMeta, error) {
+		if blockMeta == nil {
+			meta, err := dump.ReadBlockMeta(ctx, *blockPath, *awsProfile)
+			if err != nil {
+				return nil, pkgerrors.Wrap(err, "read block meta")
+			}
+			blockMeta = meta
+		}
+		return blockMeta, nil
+	}
+	readBlockMaxTime := func() (int64, error) {
+		meta, err := readBlockMeta()
+		if err != nil {
+			return 0, err
+		}
+		return meta.MaxTime, nil
+	}
+	minTimestamp, err := parseTimestamp(*minTimestampFlag, math.MinInt64, readBlockMaxTime)
+	if err != nil {
+		log.Fatalf("error: -min-timestamp: %s", err)
+	}
+	maxTimestamp, err := parseTimestamp(*maxTimestampFlag, math.MaxInt64, readBlockMaxTime)
 	if err != nil {
-		return pkgerrors.Wrap(err, "open index")
+		log.Fatalf("error: -max-timestamp: %s", err)
 	}
-	defer indexr.Close()
 
-	var chunkr tsdb.ChunkReader
-	if strings.HasPrefix(blockPath, "s3://") {
-		bucket, key, err := parseS3Path(blockPath)
+	if *timeShiftFlag != 0 && *rebaseTo != "" {
+		log.Fatal("-time-shift and -rebase-to cannot be used together")
+	}
+	if isRelativeRebaseTime(*rebaseTo) && *shardFlag != "" {
+		log.Fatal("-rebase-to relative to now is not supported with -shard, as workers started at different times would shift timestamps differently; use an absolute time")
+	}
+	timeShift := timeShiftFlag.Milliseconds()
+	if *rebaseTo != "" {
+		to, err := parseRebaseTime(*rebaseTo, time.Now())
 		if err != nil {
-			return pkgerrors.Wrap(err, "parse s3 path")
+			log.Fatalf("error: -rebase-to: %s", err)
 		}
-		cfg, err := newAWSConfig(context.Background(), bucket, awsProfile)
+		meta, err := readBlockMeta()
 		if err != nil {
-			return pkgerrors.Wrap(err, "new aws config")
+			log.Fatalf("error: %s", err)
+		}
+		timeShift = to - dumpedRange(meta, minTimestamp, maxTimestamp).mint
+	}
+
+	if *webListenAddress != "" {
+		if err := serveMetrics(*webListenAddress); err != nil {
+			log.Fatalf("error: %s", err)
 		}
-		cli := s3.NewFromConfig(cfg)
-		chunkr = chunkreader.NewS3ChunkReader(cli, bucket, key)
-	} else {
-		chunkr = chunkreader.NewLocalChunkReader(path.Join(blockPath, "chunks"))
 	}
-	defer chunkr.Close()
 
-	// default to all postings if no label key provided
-	if labelKey == "" {
-		allKey, allValue := index.AllPostingsKey()
-		labelKey = allKey
-		labelValues = []string{allValue}
+	var cp *checkpointer
+	if *checkpointPath != "" {
+		cp = newCheckpointer(*checkpointPath, *blockPath, *shardFlag, *checkpointInterval)
+	}
+	if *resume {
+		if cp == nil {
+			log.Fatal("-resume requires -checkpoint")
+		}
+		if err := cp.load(); err != nil {
+			log.Fatalf("error: %s", err)
+		}
+	}
+	if cp != nil {
+		if cp.resumeFrom != nil && cp.resumeFrom.TimeShift != timeShift {
+			// A relative -rebase-to results in another shift on every
+			// run, so the one the dump started with is kept.
+			if !isRelativeRebaseTime(*rebaseTo) {
+				log.Fatalf("checkpoint %s was written with timestamps shifted by %s, not %s", *checkpointPath, time.Duration(cp.resumeFrom.TimeShift)*time.Millisecond, time.Duration(timeShift)*time.Millisecond)
+			}
+			timeShift = cp.resumeFrom.TimeShift
+		}
+		cp.timeShift = timeShift
 	}
 
-	var metricPostings index.Postings
-	if metricName != "" {
+	var out io.Writer = os.Stdout
+	var outFile, compressed io.WriteCloser
+	// abortOutput discards the output if it can, so that no object is left
+	// on S3, and closes it otherwise.
+	abortOutput := func() {
+		compressed = nil
+		if a, ok := outFile.(writer.Aborter); ok {
+			if err := a.Abort(); err != nil {
+				log.Printf("error: discard output: %s", err)
+			}
+		} else if outFile != nil {
+			outFile.Close()
+		}
+		outFile = nil
+	}
+	// closeOutput flushes the compressed stream and closes the output, which
+	// completes uploads to S3.
+	closeOutput := func() error {
+		if compressed != nil {
+			if err := compressed.Close(); err != nil {
+				abortOutput()
+				return err
+			}
+			compressed = nil
+		}
+		if outFile != nil {
+			err := outFile.Close()
+			outFile = nil
+			return err
+		}
+		return nil
+	}
+	// fatalf is log.Fatalf for errors once the output is opened.
+	fatalf := func(format string, args ...interface{}) {
+		abortOutput()
+		log.Fatalf(format, args...)
+	}
+	if *output != "" && !writer.IsDirFormat(*format) {
 		var err error
-		metricPostings, err = indexr.Postings(labels.MetricName, metricName)
+		switch {
+		case strings.HasPrefix(*output, "s3://"):
+			if cp != nil {
+				log.Fatal("-checkpoint is not supported with output to S3")
+			}
+			outFile, err = newS3Output(*output, *awsProfile)
+		case cp != nil && cp.resumeFrom != nil:
+			outFile, err = openResumedOutput(*output, cp.resumeFrom.OutputOffset)
+		default:
+			outFile, err = os.Create(*output)
+		}
 		if err != nil {
-			return pkgerrors.Wrap(err, "indexr.Postings metric")
+			fatalf("error: %s", err)
 		}
+		out = outFile
 	}
+	cw := &countingWriter{w: out}
+	if cp != nil {
+		cp.out = cw
+		if cp.resumeFrom != nil && *output != "" {
+			cw.n = cp.resumeFrom.OutputOffset
+		}
+	}
+	out = cw
 
-	var it chunkenc.Iterator
-	for _, val := range labelValues {
-		postings, err := indexr.Postings(labelKey, val)
+	compression := *compress
+	if compression == "" && *output != "" && !writer.IsDirFormat(*format) {
+		compression = writer.CompressionFromExtension(*output)
+	}
+	if compression == "none" {
+		compression = ""
+	}
+	if compression != "" && *pushURL != "" {
+		fatalf("-compress is not supported with -push-url, which always compresses requests with gzip")
+	}
+	if compression != "" && *outputDir == "" {
+		if writer.IsDirFormat(*format) {
+			fatalf("-compress is not supported with -format %s", *format)
+		}
+		if cp != nil {
+			fatalf("-checkpoint is not supported with compressed output")
+		}
+		var err error
+		compressed, err = writer.NewCompressedWriter(cw, compression)
 		if err != nil {
-			return pkgerrors.Wrap(err, "indexr.Postings")
+			fatalf("error: %s", err)
+		}
+		out = compressed
+	}
+
+	var prog *progress
+	if *progressInterval > 0 {
+		// The bytes sent by -push-url and the blocks of -format tsdb are
+		// not counted, so progress leaves out bytes written for them.
+		progressOut := cw
+		if *pushURL != "" || writer.IsDirFormat(*format) {
+			progressOut = nil
 		}
-		if metricPostings != nil {
-			postings = index.Intersect(postings, metricPostings)
+		var err error
+		prog, err = newProgress(os.Stderr, *progressFormat, progressOut)
+		if err != nil {
+			fatalf("error: %s", err)
 		}
+	}
 
-		for postings.Next() {
-			ref := postings.At()
-			lset := labels.Labels{}
-			chks := []chunks.Meta{}
-			if err := indexr.Series(ref, &lset, &chks); err != nil {
-				return pkgerrors.Wrap(err, "indexr.Series")
+	// The modes other than the dump write a single report to out and exit.
+	if *dumpIndex || *dumpMeta || *listLabels || *listLabelValues != "" || *verify || *diff != "" || *stats {
+		var modeErr error
+		switch {
+		case *dumpIndex:
+			d := dump.New(dump.Options{
+				Block:       *blockPath,
+				AWSProfile:  *awsProfile,
+				LabelKey:    *labelKey,
+				LabelValues: labelValues,
+				MetricName:  *metricName,
+				Shard:       shard,
+				Shards:      shards,
+				MinTime:     minTimestamp,
+				MaxTime:     maxTimestamp,
+			})
+			modeErr = d.DumpIndex(ctx, out)
+		case *dumpMeta:
+			modeErr = runDumpMeta(ctx, *blockPath, *awsProfile, out)
+		case *listLabels || *listLabelValues != "":
+			modeErr = runListLabels(ctx, *blockPath, *labelKey, labelValues, *metricName, *awsProfile, *listLabelValues, out)
+		case *verify:
+			modeErr = runVerify(ctx, *blockPath, *awsProfile, *verifyMaxProblems, out)
+		case *diff != "":
+			modeErr = runDiff(ctx, *blockPath, *diff, *labelKey, labelValues, *metricName, minTimestamp, maxTimestamp, *awsProfile, *diffDetails, out)
+		case *stats:
+			modeErr = runStats(ctx, *blockPath, *labelKey, labelValues, *metricName, *awsProfile, *statsFormat, *statsTop, out)
+		}
+		switch {
+		case interrupted(modeErr):
+			abortOutput()
+			log.Printf("interrupted")
+			os.Exit(exitInterrupted)
+		case modeErr == nil || modeErr == errVerifyFailed || modeErr == errDiffFound:
+			// -verify and -diff fail after writing their report.
+			if err := closeOutput(); err != nil {
+				log.Fatalf("error: %s", err)
 			}
-			if len(externalLabels) > 0 {
-				lset = append(lset, externalLabels...)
+			if modeErr != nil {
+				log.Fatalf("error: %s", modeErr)
 			}
+		default:
+			fatalf("error: %s", modeErr)
+		}
+		return
+	}
 
-			for _, meta := range chks {
-				chunk, err := chunkr.Chunk(meta.Ref)
-				if err != nil {
-					return pkgerrors.Wrap(err, "chunkr.Chunk")
-				}
+	onError, err := newErrorHandler(*onErrorMode, *errorReport, *resume, redactor)
+	if err != nil {
+		fatalf("error: %s", err)
+	}
 
-				var timestamps []int64
-				var values []float64
-
-				it := chunk.Iterator(it)
-				for it.Next() {
-					t, v := it.At()
-					if math.IsNaN(v) {
-						continue
-					}
-					if math.IsInf(v, -1) || math.IsInf(v, 1) {
-						continue
-					}
-					if t < minTimestamp || maxTimestamp < t {
-						continue
-					}
-					timestamps = append(timestamps, t)
-					values = append(values, v)
-				}
-				if it.Err() != nil {
-					return pkgerrors.Wrap(err, "iterator.Err")
-				}
+	var md *metadata.Store
+	if *metadataFile != "" || *inferMetadata {
+		md, err = loadMetadata(ctx, *blockPath, *awsProfile, *metadataFile, *inferMetadata)
+		if interrupted(err) {
+			abortOutput()
+			log.Printf("interrupted")
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			fatalf("error: %s", err)
+		}
+	}
 
-				if len(timestamps) == 0 {
-					continue
-				}
+	if timeShift != 0 {
+		meta, err := readBlockMeta()
+		if err != nil {
+			fatalf("error: %s", err)
+		}
+		r := dumpedRange(meta, minTimestamp, maxTimestamp).shift(timeShift)
+		log.Printf("shifting timestamps by %s to %s", time.Duration(timeShift)*time.Millisecond, r)
+		if r.maxt > time.Now().UnixMilli() {
+			log.Printf("warning: shifted samples lie in the future")
+		}
+		if *pushURL != "" {
+			log.Printf("warning: not checking whether %s already holds samples in the shifted time range", *pushURL)
+		}
+		if writer.IsDirFormat(*format) && !*allowOverlap {
+			blocks, err := writer.OverlappingBlocks(*output, r.mint, r.maxt)
+			if err != nil {
+				fatalf("error: %s", err)
+			}
+			if len(blocks) > 0 {
+				fatalf("shifted samples overlap existing blocks in %s: %s; use -allow-overlap to write them anyway", *output, strings.Join(blocks, ", "))
+			}
+		}
+	}
 
-				if err := wr.Write(&lset, timestamps, values); err != nil {
-					return pkgerrors.Wrap(err, fmt.Sprintf("Writer.Write(%v, %v, %v)", lset, timestamps, values))
-				}
+	var wr writer.Writer
+	if writer.IsDirFormat(*format) {
+		if *output == "" || strings.HasPrefix(*output, "s3://") {
+			fatalf("-format %s requires -output to be set to a local directory", *format)
+		}
+		if cp != nil {
+			fatalf("-checkpoint is not supported with -format %s", *format)
+		}
+		if *splitBy != "" {
+			wr, err = writer.NewSplitTSDBWriter(*output, *splitBy, *splitWindow, *splitLabel)
+		} else {
+			wr, err = writer.NewDirWriter(*format, *output)
+		}
+	} else if *splitBy != "" {
+		fatalf("-split-by requires -format tsdb")
+	} else if *pushURL != "" {
+		if cp != nil {
+			fatalf("-checkpoint is not supported with -push-url")
+		}
+		var extraLabels []string
+		if *pushExtraLabels != "" {
+			extraLabels = strings.Split(*pushExtraLabels, ",")
+		}
+		// Pushing is not canceled on shutdown, so that the series dumped
+		// until then are still sent; a second signal exits immediately.
+		wr, err = writer.NewPushWriter(*format, writer.PushOptions{
+			URL:         *pushURL,
+			Tenant:      *pushTenant,
+			ExtraLabels: extraLabels,
+			BatchBytes:  *pushBatchBytes,
+			Concurrency: *pushConcurrency,
+			MaxRetries:  *pushRetries,
+			Metadata:    md,
+		})
+	} else if *outputDir != "" {
+		if cp != nil {
+			fatalf("-checkpoint is not supported with -output-dir")
+		}
+		create := writer.NewDirCreator(*outputDir)
+		if strings.HasPrefix(*outputDir, "s3://") {
+			create, err = newS3DirOutput(*outputDir, *awsProfile)
+			if err != nil {
+				fatalf("error: %s", err)
 			}
 		}
+		// Count the bytes written to the files for progress.
+		create = countingCreator(create, cw)
+		wr, err = writer.NewRotatingWriter(writer.RotateOptions{
+			Format:      *format,
+			Compression: compression,
+			Metadata:    md,
+			MaxBytes:    *rotateBytes,
+			MaxSamples:  *rotateSamples,
+			MaxSeries:   *rotateSeries,
+			Shards:      *outputShards,
+			ShardBy:     *outputShardBy,
+			Create:      create,
+		})
+	} else {
+		wr, err = writer.NewWriterWithMetadata(*format, out, md)
+	}
+	if err != nil {
+		fatalf("error: %s", err)
+	}
 
-		if postings.Err() != nil {
-			return pkgerrors.Wrap(postings.Err(), "postings.Err")
+	runErr := run(ctx, runOptions{
+		Block:            *blockPath,
+		AWSProfile:       *awsProfile,
+		LabelKey:         *labelKey,
+		LabelValues:      labelValues,
+		MetricName:       *metricName,
+		Shard:            shard,
+		Shards:           shards,
+		Dedup:            *dedup,
+		SkipHistograms:   *skipHistograms,
+		MinTime:          minTimestamp,
+		MaxTime:          maxTimestamp,
+		TimeShift:        timeShift,
+		ExternalLabels:   *externalLabels,
+		Redactor:         redactor,
+		Checkpoint:       cp,
+		OnError:          onError,
+		Progress:         prog,
+		ProgressInterval: *progressInterval,
+		Writer:           wr,
+	})
+	if runErr != nil && !errors.Is(runErr, context.Canceled) {
+		if a, ok := wr.(writer.Aborter); ok {
+			if err := a.Abort(); err != nil {
+				log.Printf("error: discard output: %s", err)
+			}
+		}
+		fatalf("error: %s", runErr)
+	}
+	// The writer is flushed even if the dump was interrupted, as it stops
+	// only after a complete series.
+	if err := wr.Close(); err != nil {
+		fatalf("error: %s", err)
+	}
+	reportErr := onError.Close()
+	if err := closeOutput(); err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	if reportErr != nil {
+		log.Fatalf("error: %s", reportErr)
+	}
+	if runErr != nil {
+		if cp != nil {
+			log.Printf("interrupted; the output ends with a complete series, run again with -resume to continue")
+		} else {
+			log.Printf("interrupted; the output ends with a complete series")
 		}
+		os.Exit(exitInterrupted)
 	}
+}
 
-	return nil
+// interrupted reports whether err is the result of a shutdown signal.
+func interrupted(err error) bool {
+	return errors.Is(pkgerrors.Cause(err), context.Canceled)
 }
 
-func runDumpIndex(blockPath string, labelKey string, labelValues []string, metricName string, awsProfile string, out io.Writer) error {
-	indexr, err := openIndexReader(blockPath, awsProfile)
+// newS3Output creates the S3 object at the s3:// URL u for the output.
+func newS3Output(u string, awsProfile string) (io.WriteCloser, error) {
+	bucket, key, err := dump.ParseS3Path(u)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer indexr.Close()
-
-	enc := json.NewEncoder(out)
-
-	// default to all postings if no label key provided
-	if labelKey == "" {
-		allKey, allValue := index.AllPostingsKey()
-		labelKey = allKey
-		labelValues = []string{allValue}
+	cfg, err := dump.NewAWSConfig(context.Background(), bucket, awsProfile)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "new aws config")
 	}
+	// The upload is not canceled on shutdown, so that the output written
+	// until then is kept.
+	return writer.NewS3File(context.Background(), s3.NewFromConfig(cfg), bucket, key), nil
+}
 
-	var metricPostings index.Postings
-	if metricName != "" {
-		metricPostings, err = indexr.Postings(labels.MetricName, metricName)
-		if err != nil {
-			return pkgerrors.Wrap(err, "indexr.Postings metric")
-		}
+// newS3DirOutput returns a function creating the files of -output-dir below
+// the s3:// URL u.
+func newS3DirOutput(u string, awsProfile string) (func(name string) (io.WriteCloser, error), error) {
+	bucket, prefix, err := dump.ParseS3Path(u)
+	if err != nil {
+		return nil, err
 	}
+	cfg, err := dump.NewAWSConfig(context.Background(), bucket, awsProfile)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "new aws config")
+	}
+	return writer.NewS3Creator(context.Background(), s3.NewFromConfig(cfg), bucket, prefix), nil
+}
 
-	for _, val := range labelValues {
-		postings, err := indexr.Postings(labelKey, val)
-		if err != nil {
-			return pkgerrors.Wrap(err, "indexr.Postings")
-		}
-		if metricPostings != nil {
-			postings = index.Intersect(postings, metricPostings)
-		}
-
-		for postings.Next() {
-			ref := postings.At()
-			lset := labels.Labels{}
-			chks := []chunks.Meta{}
-			if err := indexr.Series(ref, &lset, &chks); err != nil {
-				return pkgerrors.Wrap(err, "indexr.Series")
-			}
+// shutdownContext returns a context that is canceled on the first SIGINT or
+// SIGTERM, which stops the dump after the current series. A second signal
+// exits immediately.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		log.Printf("received %s, stopping after the current series; send it again to exit immediately", sig)
+		cancel()
+		<-sigc
+		os.Exit(1)
+	}()
+	return ctx
+}
 
-			metric := map[string]string{}
-			for _, l := range lset {
-				metric[l.Name] = l.Value
-			}
+// runOptions configures a dump by run.
+type runOptions struct {
+	Block       string
+	AWSProfile  string
+	LabelKey    string
+	LabelValues []string
+	MetricName  string
+	// Shard and Shards select the series of one of several workers.
+	Shard          int
+	Shards         int
+	Dedup          string
+	SkipHistograms bool
+	MinTime        int64
+	MaxTime        int64
+	TimeShift      int64
+	// ExternalLabels are the labels added to every series as a JSON object.
+	ExternalLabels string
+	// Redactor, Checkpoint, OnError and Progress are optional.
+	Redactor         *redact.Redactor
+	Checkpoint       *checkpointer
+	OnError          *errorHandler
+	Progress         *progress
+	ProgressInterval time.Duration
+	Writer           writer.Writer
+}
 
-			type meta struct {
-				Ref     uint64 `json:"ref"`
-				MinTime int64  `json:"minTime"`
-				MaxTime int64  `json:"maxTime"`
-			}
+func run(ctx context.Context, opts runOptions) error {
+	redactor, cp, prog, wr := opts.Redactor, opts.Checkpoint, opts.Progress, opts.Writer
 
-			metas := make([]meta, 0, len(chks))
-			for _, m := range chks {
-				metas = append(metas, meta{Ref: m.Ref, MinTime: m.MinTime, MaxTime: m.MaxTime})
-			}
+	externalLabelsMap := map[string]string{}
+	if err := json.NewDecoder(strings.NewReader(opts.ExternalLabels)).Decode(&externalLabelsMap); err != nil {
+		return pkgerrors.Wrap(err, "decode external labels")
+	}
+	var externalLabels labels.Labels
+	for k, v := range externalLabelsMap {
+		externalLabels = append(externalLabels, labels.Label{Name: k, Value: v})
+	}
 
-			line := struct {
-				Labels map[string]string `json:"labels"`
-				Chunks []meta            `json:"chunks"`
-			}{Labels: metric, Chunks: metas}
+	// Series are redacted after external labels are added, so that these
+	// can be redacted as well.
+	if redactor != nil {
+		wr = redact.NewWriter(wr, redactor)
+	}
 
-			if err := enc.Encode(line); err != nil {
-				return pkgerrors.Wrap(err, "encode")
-			}
+	d := dump.New(dump.Options{
+		Block:          opts.Block,
+		AWSProfile:     opts.AWSProfile,
+		LabelKey:       opts.LabelKey,
+		LabelValues:    opts.LabelValues,
+		MetricName:     opts.MetricName,
+		Shard:          opts.Shard,
+		Shards:         opts.Shards,
+		Dedup:          opts.Dedup,
+		SkipHistograms: opts.SkipHistograms,
+		MinTime:        opts.MinTime,
+		MaxTime:        opts.MaxTime,
+		TimeShift:      opts.TimeShift,
+		ExternalLabels: externalLabels,
+		Writer:         wr,
+		Hooks: dump.Hooks{
+			SkipSeries: func(ref uint64) bool {
+				if cp.skip(ref) {
+					prog.addResumed(1)
+					return true
+				}
+				prog.addSeries(1)
+				return false
+			},
+			SeriesDone: func(ref uint64) error {
+				return pkgerrors.Wrap(cp.update(ref), "save checkpoint")
+			},
+			ChunkDone:    prog.addChunk,
+			ChunkSkipped: prog.skipChunk,
+			OnError:      opts.OnError.handle,
+		},
+	})
+
+	if prog != nil {
+		// Count the selected series up front so that progress can be
+		// reported as a fraction of the total.
+		total, err := d.CountSeries(ctx)
+		if err != nil {
+			return err
 		}
+		prog.setTotal(total)
+		prog.startReporting(opts.ProgressInterval)
+		defer prog.stop()
+	}
 
-		if postings.Err() != nil {
-			return pkgerrors.Wrap(postings.Err(), "postings.Err")
+	stats, err := d.Run(ctx)
+	if errors.Is(err, context.Canceled) {
+		// The output ends with a complete series, which the checkpoint
+		// must point to for the dump to be resumed.
+		if err := cp.flush(); err != nil {
+			return pkgerrors.Wrap(err, "save checkpoint")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if stats.HistogramChunksSkipped > 0 {
+		log.Printf("skipped %d native histogram chunks; use -format json, openmetrics or remote-write to dump them", stats.HistogramChunksSkipped)
+	}
+	if stats.OutOfOrderSamples > 0 {
+		if opts.Dedup == "" {
+			log.Printf("%d samples are out of order or duplicated, e.g. in overlapping chunks; use -dedup to sort and deduplicate them", stats.OutOfOrderSamples)
+		} else {
+			log.Printf("dropped %d duplicate and %d conflicting samples", stats.DuplicateSamples, stats.ConflictingSamples)
 		}
 	}
 
+	if redactor != nil && redactor.MergedSeries() > 0 {
+		log.Printf("warning: %d series have the same labels as another series after redaction and are merged with it in the output, with their samples interleaved", redactor.MergedSeries())
+	}
+
+	if err := cp.save(stats.LastSeriesRef, true); err != nil {
+		return pkgerrors.Wrap(err, "save checkpoint")
+	}
+
 	return nil
 }
 
 func openBlock(blockPath string, awsProfile string, logger gokitlog.Logger) (*tsdb.Block, func(), error) {
 	if strings.HasPrefix(blockPath, "s3://") {
-		bucket, key, err := parseS3Path(blockPath)
+		bucket, key, err := dump.ParseS3Path(blockPath)
 		if err != nil {
 			return nil, nil, err
 		}
-		cfg, err := newAWSConfig(context.Background(), bucket, awsProfile)
+		cfg, err := dump.NewAWSConfig(context.Background(), bucket, awsProfile)
 		if err != nil {
 			return nil, nil, pkgerrors.Wrap(err, "new aws config")
 		}
@@ -317,7 +775,7 @@ func openBlock(blockPath string, awsProfile string, logger gokitlog.Logger) (*ts
 func downloadS3Block(cli *s3.Client, bucket, key, dest string) error {
 	downloader := manager.NewDownloader(cli)
 
-	ctx, cancel := context.WithTimeout(context.Background(), s3DownloadTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), dump.S3DownloadTimeout)
 	defer cancel()
 
 	prefix := path.Clean(key) + "/"
@@ -367,47 +825,11 @@ func downloadS3Block(cli *s3.Client, bucket, key, dest string) error {
 	return nil
 }
 
-func openIndexReader(blockPath string, awsProfile string) (*index.Reader, error) {
-	if strings.HasPrefix(blockPath, "s3://") {
-		bucket, key, err := parseS3Path(blockPath)
-		if err != nil {
-			return nil, err
-		}
-		cfg, err := newAWSConfig(context.Background(), bucket, awsProfile)
-		if err != nil {
-			return nil, pkgerrors.Wrap(err, "new aws config")
-		}
-		cli := s3.NewFromConfig(cfg)
-		bs, err := chunkreader.NewS3ByteSlice(cli, bucket, path.Join(key, "index"))
-		if err != nil {
-			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-				return nil, err
-			}
-			return nil, pkgerrors.Wrap(err, "prepare index slice")
-		}
-		return index.NewReader(bs)
-	}
-	return index.NewFileReader(path.Join(blockPath, "index"))
-}
-
 type byteSlice []byte
 
 func (b byteSlice) Len() int                    { return len(b) }
 func (b byteSlice) Range(start, end int) []byte { return b[start:end] }
 
-func parseS3Path(p string) (bucket, key string, err error) {
-	u, err := url.Parse(p)
-	if err != nil {
-		return "", "", err
-	}
-	if u.Scheme != "s3" {
-		return "", "", fmt.Errorf("invalid s3 url: %s", p)
-	}
-	bucket = u.Host
-	key = strings.TrimPrefix(u.Path, "/")
-	return bucket, key, nil
-}
-
 func parseLabelValues(v string) []string {
 	if v == "" {
 		return nil
@@ -421,24 +843,3 @@ func parseLabelValues(v string) []string {
 	}
 	return res
 }
-
-func newAWSConfig(ctx context.Context, bucket, profile string) (aws.Config, error) {
-	opts := []func(*config.LoadOptions) error{}
-	if profile != "" {
-		opts = append(opts, config.WithSharedConfigProfile(profile))
-	}
-	cfg, err := config.LoadDefaultConfig(ctx, opts...)
-	if err != nil {
-		return aws.Config{}, err
-	}
-	if cfg.Region == "" {
-		cfgHint := cfg
-		cfgHint.Region = "us-east-1"
-		region, err := manager.GetBucketRegion(ctx, s3.NewFromConfig(cfgHint), bucket)
-		if err != nil {
-			return aws.Config{}, err
-		}
-		cfg.Region = region
-	}
-	return cfg, nil
-}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// loadMetadata reads the metric metadata of -metadata-file and, with infer,
+// adds the types guessed from the metric names in the block for metrics the
+// file does not describe.
+func loadMetadata(ctx context.Context, blockPath string, awsProfile string, path string, infer bool) (*metadata.Store, error) {
+	md := metadata.NewStore()
+	if path != "" {
+		var err error
+		md, err = metadata.Load(path)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "load metadata")
+		}
+	}
+	if !infer {
+		return md, nil
+	}
+
+	indexr, err := dump.OpenIndexReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "open index")
+	}
+	defer indexr.Close()
+	names, err := indexLabels(indexr, labels.MetricName)
+	if err != nil {
+		return nil, err
+	}
+	// The names point into the index, which is unmapped when it is closed.
+	for i, name := range names {
+		names[i] = strings.Clone(name)
+	}
+	md.Merge(metadata.Infer(names))
+	return md, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestLoadMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "http_requests_total", "job", "api"),
+		labels.FromStrings("__name__", "latency_seconds_bucket", "le", "1"),
+		labels.FromStrings("__name__", "latency_seconds_count"),
+		labels.FromStrings("__name__", "latency_seconds_sum"),
+		labels.FromStrings("__name__", "up"),
+	)
+	path := filepath.Join(dir, "metadata.json")
+	if err := ioutil.WriteFile(path, []byte(`{"status":"success","data":{"http_requests":[{"type":"gauge","help":"Requests.","unit":""}]}}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := loadMetadata(context.Background(), block, "", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != 1 {
+		t.Fatalf("expected the metadata of the file only, got %d metrics", md.Len())
+	}
+
+	md, err = loadMetadata(context.Background(), block, "", path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		// The file takes precedence over inferred types.
+		"http_requests":          metadata.TypeGauge,
+		"latency_seconds_bucket": metadata.TypeHistogram,
+	} {
+		if _, got, ok := md.Lookup(name); !ok || got.Type != want {
+			t.Fatalf("expected %s to be a %s, got %+v", name, want, got)
+		}
+	}
+	if _, _, ok := md.Lookup("up"); ok {
+		t.Fatal("expected no metadata for up")
+	}
+
+	md, err = loadMetadata(context.Background(), block, "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if family, got, ok := md.Lookup("http_requests_total"); !ok || family != "http_requests" || got.Type != metadata.TypeCounter {
+		t.Fatalf("expected http_requests_total to be a counter, got %s %+v", family, got)
+	}
+}
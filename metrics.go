@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/chunkreader"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serveMetrics exposes the metrics of the dump at /metrics on addr.
+func serveMetrics(addr string) error {
+	dump.RegisterMetrics(prometheus.DefaultRegisterer)
+	chunkreader.RegisterMetrics(prometheus.DefaultRegisterer)
+	writer.RegisterMetrics(prometheus.DefaultRegisterer)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		// The dump goes on without metrics if serving them fails.
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("error: serve metrics: %s", err)
+		}
+	}()
+	return nil
+}
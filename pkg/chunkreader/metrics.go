@@ -0,0 +1,57 @@
+package chunkreader
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	s3RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_s3_requests_total",
+		Help: "Total number of requests sent to S3 by the block readers.",
+	}, []string{"operation"})
+	s3RequestFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_s3_request_failures_total",
+		Help: "Total number of failed requests sent to S3 by the block readers.",
+	}, []string{"operation"})
+	s3BytesFetchedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_s3_fetched_bytes_total",
+		Help: "Total number of bytes fetched from S3 by the block readers.",
+	})
+	chunkDecodeErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_chunk_decode_errors_total",
+		Help: "Total number of chunks that could not be decoded.",
+	})
+	chunkChecksumFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_chunk_checksum_failures_total",
+		Help: "Total number of chunks whose CRC32 checksum did not match.",
+	})
+)
+
+// RegisterMetrics registers the metrics of the readers in this package.
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(
+		s3RequestsTotal,
+		s3RequestFailuresTotal,
+		s3BytesFetchedTotal,
+		chunkDecodeErrorsTotal,
+		chunkChecksumFailuresTotal,
+	)
+}
+
+// s3BytesRead counts the bytes fetched from S3 by the readers in this package.
+var s3BytesRead int64
+
+// S3BytesRead returns the total number of bytes fetched from S3 so far.
+func S3BytesRead() int64 { return atomic.LoadInt64(&s3BytesRead) }
+
+// observeS3Request records a request to S3 that fetched n bytes.
+func observeS3Request(operation string, n int64, err error) {
+	s3RequestsTotal.WithLabelValues(operation).Inc()
+	if err != nil {
+		s3RequestFailuresTotal.WithLabelValues(operation).Inc()
+	}
+	atomic.AddInt64(&s3BytesRead, n)
+	s3BytesFetchedTotal.Add(float64(n))
+}
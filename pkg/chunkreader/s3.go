@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
 	"path"
 
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -16,15 +20,23 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunks"
 )
 
+// ErrChecksumMismatch is returned when the CRC32 checksum stored with a chunk
+// does not match its data.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 // s3ChunkReader implements tsdb.ChunkReader for blocks stored in S3.
 type S3ChunkReader struct {
+	// ctx is used for all requests, as tsdb.ChunkReader does not take
+	// one per call.
+	ctx        context.Context
 	downloader *manager.Downloader
 	bucket     string
 	prefix     string
 }
 
-func NewS3ChunkReader(cli *s3.Client, bucket, prefix string) *S3ChunkReader {
+func NewS3ChunkReader(ctx context.Context, cli *s3.Client, bucket, prefix string) *S3ChunkReader {
 	return &S3ChunkReader{
+		ctx:        ctx,
 		downloader: manager.NewDownloader(cli),
 		bucket:     bucket,
 		prefix:     prefix,
@@ -36,49 +48,119 @@ func (r *S3ChunkReader) Close() error { return nil }
 func (r *S3ChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 	segment := int(ref >> 32)
 	offset := int((ref << 32) >> 32)
-	objKey := path.Join(r.prefix, "chunks", fmt.Sprintf("%06d", segment))
+	objKey := path.Join(r.prefix, "chunks", segmentFile(segment))
 
 	// First fetch header to determine chunk length.
 	headerRange := fmt.Sprintf("bytes=%d-%d", offset, offset+chunks.MaxChunkLengthFieldSize+chunks.ChunkEncodingSize-1)
 	buf := manager.NewWriteAtBuffer([]byte{})
-	_, err := r.downloader.Download(context.Background(), buf, &s3.GetObjectInput{
+	n64, err := r.downloader.Download(r.ctx, buf, &s3.GetObjectInput{
 		Bucket: aws.String(r.bucket),
 		Key:    aws.String(objKey),
 		Range:  aws.String(headerRange),
 	})
+	observeS3Request("GetObject", n64, err)
 	if err != nil {
 		return nil, err
 	}
 	header := buf.Bytes()
 	if len(header) < chunks.MaxChunkLengthFieldSize {
+		chunkDecodeErrorsTotal.Inc()
 		return nil, fmt.Errorf("short header")
 	}
 	chkDataLen, n := binary.Uvarint(header)
 	if n <= 0 {
+		chunkDecodeErrorsTotal.Inc()
 		return nil, fmt.Errorf("invalid header")
 	}
 	total := n + chunks.ChunkEncodingSize + int(chkDataLen) + crc32.Size
 	// Fetch whole chunk
 	chunkRange := fmt.Sprintf("bytes=%d-%d", offset, offset+total-1)
 	buf = manager.NewWriteAtBuffer([]byte{})
-	_, err = r.downloader.Download(context.Background(), buf, &s3.GetObjectInput{
+	n64, err = r.downloader.Download(r.ctx, buf, &s3.GetObjectInput{
 		Bucket: aws.String(r.bucket),
 		Key:    aws.String(objKey),
 		Range:  aws.String(chunkRange),
 	})
+	observeS3Request("GetObject", n64, err)
 	if err != nil {
 		return nil, err
 	}
 	data := buf.Bytes()
 	if len(data) < total {
+		chunkDecodeErrorsTotal.Inc()
 		return nil, fmt.Errorf("short chunk data")
 	}
+	return decodeChunk(data, n, chkDataLen)
+}
+
+// ChunkInfo describes a chunk as recorded in its header.
+type ChunkInfo struct {
+	Encoding chunkenc.Encoding
+	Samples  int
+	// Bytes is the size of the chunk data, without its length, encoding
+	// and checksum.
+	Bytes int
+}
+
+// InfoReader is implemented by chunk readers that can describe a chunk by
+// reading only its header, without its data and checksum.
+type InfoReader interface {
+	ChunkInfo(ref uint64) (ChunkInfo, error)
+}
+
+// chunkInfoSize is the number of bytes read for a ChunkInfo: the length, the
+// encoding and the number of samples, which all chunk encodings store in the
+// first two bytes of their data.
+const chunkInfoSize = chunks.MaxChunkLengthFieldSize + chunks.ChunkEncodingSize + 2
+
+// parseChunkInfo parses the start of a chunk in a segment file, which may be
+// shorter than chunkInfoSize at the end of the file.
+func parseChunkInfo(header []byte) (ChunkInfo, error) {
+	chkDataLen, n := binary.Uvarint(header)
+	if n <= 0 {
+		chunkDecodeErrorsTotal.Inc()
+		return ChunkInfo{}, fmt.Errorf("invalid header")
+	}
+	if chkDataLen < 2 || len(header) < n+chunks.ChunkEncodingSize+2 {
+		chunkDecodeErrorsTotal.Inc()
+		return ChunkInfo{}, fmt.Errorf("short header")
+	}
+	return ChunkInfo{
+		Encoding: chunkenc.Encoding(header[n]),
+		Samples:  int(binary.BigEndian.Uint16(header[n+chunks.ChunkEncodingSize:])),
+		Bytes:    int(chkDataLen),
+	}, nil
+}
+
+// ChunkInfo reads the header of a chunk with a single ranged request.
+func (r *S3ChunkReader) ChunkInfo(ref uint64) (ChunkInfo, error) {
+	segment := int(ref >> 32)
+	offset := int((ref << 32) >> 32)
+	objKey := path.Join(r.prefix, "chunks", segmentFile(segment))
+
+	buf := manager.NewWriteAtBuffer([]byte{})
+	n64, err := r.downloader.Download(r.ctx, buf, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(objKey),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+chunkInfoSize-1)),
+	})
+	observeS3Request("GetObject", n64, err)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	return parseChunkInfo(buf.Bytes())
+}
+
+// decodeChunk verifies the checksum of a chunk read from a segment file and
+// decodes it. data starts at the chunk's length field, which is n bytes long.
+func decodeChunk(data []byte, n int, chkDataLen uint64) (chunkenc.Chunk, error) {
 	enc := data[n]
 	chkDataStart := n + chunks.ChunkEncodingSize
 	chkDataEnd := chkDataStart + int(chkDataLen)
 	crcStart := chkDataEnd
 	crcEnd := crcStart + crc32.Size
 	if crcEnd > len(data) {
+		chunkDecodeErrorsTotal.Inc()
 		return nil, fmt.Errorf("invalid chunk length")
 	}
 	sum := data[crcStart:crcEnd]
@@ -87,9 +169,29 @@ func (r *S3ChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 		return nil, err
 	}
 	if !bytes.Equal(crc.Sum(nil), sum) {
-		return nil, fmt.Errorf("checksum mismatch")
+		chunkChecksumFailuresTotal.Inc()
+		return nil, ErrChecksumMismatch
+	}
+	var chk chunkenc.Chunk
+	var err error
+	switch enc {
+	case histogram.EncHistogram, histogram.EncFloatHistogram:
+		chk, err = histogram.NewChunk(chunkenc.Encoding(enc), data[chkDataStart:chkDataEnd])
+	default:
+		chk, err = chunkenc.FromData(chunkenc.Encoding(enc), data[chkDataStart:chkDataEnd])
 	}
-	return chunkenc.FromData(chunkenc.Encoding(enc), data[chkDataStart:chkDataEnd])
+	if err != nil {
+		chunkDecodeErrorsTotal.Inc()
+		return nil, err
+	}
+	return chk, nil
+}
+
+// segmentFile returns the name of the chunk segment file with the given index.
+// Chunk refs hold the zero-based index of the segment while the files
+// themselves are numbered starting from 1.
+func segmentFile(segment int) string {
+	return fmt.Sprintf("%06d", segment+1)
 }
 
 // LocalChunkReader reads chunks from local directory.
@@ -106,7 +208,7 @@ func (r *LocalChunkReader) Close() error { return nil }
 func (r *LocalChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 	segment := int(ref >> 32)
 	offset := int((ref << 32) >> 32)
-	filePath := path.Join(r.dir, fmt.Sprintf("%06d", segment))
+	filePath := path.Join(r.dir, segmentFile(segment))
 
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -120,6 +222,7 @@ func (r *LocalChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 	}
 	chkDataLen, n := binary.Uvarint(header)
 	if n <= 0 {
+		chunkDecodeErrorsTotal.Inc()
 		return nil, fmt.Errorf("invalid header")
 	}
 
@@ -128,17 +231,24 @@ func (r *LocalChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 	if _, err := f.ReadAt(buf, int64(offset)); err != nil {
 		return nil, err
 	}
+	return decodeChunk(buf, n, chkDataLen)
+}
 
-	enc := buf[n]
-	chkDataStart := n + chunks.ChunkEncodingSize
-	chkDataEnd := chkDataStart + int(chkDataLen)
-	sum := buf[chkDataEnd : chkDataEnd+crc32.Size]
-	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
-	if _, err := crc.Write(buf[n:chkDataEnd]); err != nil {
-		return nil, err
+// ChunkInfo reads the header of a chunk.
+func (r *LocalChunkReader) ChunkInfo(ref uint64) (ChunkInfo, error) {
+	segment := int(ref >> 32)
+	offset := int((ref << 32) >> 32)
+
+	f, err := os.Open(path.Join(r.dir, segmentFile(segment)))
+	if err != nil {
+		return ChunkInfo{}, err
 	}
-	if !bytes.Equal(crc.Sum(nil), sum) {
-		return nil, fmt.Errorf("checksum mismatch")
+	defer f.Close()
+
+	header := make([]byte, chunkInfoSize)
+	n, err := f.ReadAt(header, int64(offset))
+	if err != nil && !(err == io.EOF && n > 0) {
+		return ChunkInfo{}, err
 	}
-	return chunkenc.FromData(chunkenc.Encoding(enc), buf[chkDataStart:chkDataEnd])
+	return parseChunkInfo(header[:n])
 }
@@ -0,0 +1,80 @@
+package chunkreader
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+func TestSegmentFile(t *testing.T) {
+	for segment, want := range map[int]string{0: "000001", 1: "000002", 41: "000042"} {
+		if got := segmentFile(segment); got != want {
+			t.Fatalf("segment %d: expected %s, got %s", segment, want, got)
+		}
+	}
+}
+
+func TestLocalChunkReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunkreader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A small segment size puts every chunk into a segment of its own, so
+	// that refs of several segments are read.
+	w, err := chunks.NewWriterWithSegSize(dir, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metas []chunks.Meta
+	for i := 0; i < 3; i++ {
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.Append(int64(i), float64(i))
+		// WriteChunks sets the refs of the metas passed to it.
+		batch := []chunks.Meta{{MinTime: int64(i), MaxTime: int64(i), Chunk: chk}}
+		if err := w.WriteChunks(batch...); err != nil {
+			t.Fatal(err)
+		}
+		metas = append(metas, batch...)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewLocalChunkReader(dir)
+	for i, m := range metas {
+		if segment := int(m.Ref >> 32); segment != i {
+			t.Fatalf("chunk %d: expected segment %d, got %d", i, i, segment)
+		}
+		chk, err := r.Chunk(m.Ref)
+		if err != nil {
+			t.Fatalf("chunk %d (segment %d): %s", i, m.Ref>>32, err)
+		}
+		it := chk.Iterator(nil)
+		if !it.Next() {
+			t.Fatalf("chunk %d is empty", i)
+		}
+		if ts, v := it.At(); ts != int64(i) || v != float64(i) {
+			t.Fatalf("chunk %d: unexpected sample %d %f", i, ts, v)
+		}
+
+		// The chunk is the last one of its segment, so its header is
+		// shorter than the bytes ChunkInfo tries to read.
+		info, err := r.ChunkInfo(m.Ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		want := ChunkInfo{Encoding: chunkenc.EncXOR, Samples: 1, Bytes: len(m.Chunk.Bytes())}
+		if info != want {
+			t.Fatalf("chunk %d: expected %+v, got %+v", i, want, info)
+		}
+	}
+}
@@ -19,6 +19,9 @@ type s3API interface {
 
 // s3ByteSlice allows lazy ranged reads of an index file stored in S3.
 type s3ByteSlice struct {
+	// ctx is used for all requests, as index.ByteSlice does not take one
+	// per call.
+	ctx    context.Context
 	cli    s3API
 	bucket string
 	key    string
@@ -27,14 +30,15 @@ type s3ByteSlice struct {
 
 // NewS3ByteSlice creates a byte slice backed by an S3 object.
 // It performs a HEAD request to determine the object's size.
-func NewS3ByteSlice(cli s3API, bucket, key string) (*s3ByteSlice, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), indexDownloadTimeout)
+func NewS3ByteSlice(ctx context.Context, cli s3API, bucket, key string) (*s3ByteSlice, error) {
+	headCtx, cancel := context.WithTimeout(ctx, indexDownloadTimeout)
 	defer cancel()
 
-	out, err := cli.HeadObject(ctx, &s3.HeadObjectInput{
+	out, err := cli.HeadObject(headCtx, &s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
+	observeS3Request("HeadObject", 0, err)
 	if err != nil {
 		return nil, err
 	}
@@ -42,6 +46,7 @@ func NewS3ByteSlice(cli s3API, bucket, key string) (*s3ByteSlice, error) {
 		return nil, fmt.Errorf("content length missing for %s/%s", bucket, key)
 	}
 	return &s3ByteSlice{
+		ctx:    ctx,
 		cli:    cli,
 		bucket: bucket,
 		key:    key,
@@ -49,10 +54,15 @@ func NewS3ByteSlice(cli s3API, bucket, key string) (*s3ByteSlice, error) {
 	}, nil
 }
 
+// SetContext replaces the context used by later requests.
+func (b *s3ByteSlice) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
 func (b *s3ByteSlice) Len() int { return b.size }
 
 func (b *s3ByteSlice) Range(start, end int) []byte {
-	ctx, cancel := context.WithTimeout(context.Background(), indexDownloadTimeout)
+	ctx, cancel := context.WithTimeout(b.ctx, indexDownloadTimeout)
 	defer cancel()
 
 	rng := fmt.Sprintf("bytes=%d-%d", start, end-1)
@@ -62,11 +72,13 @@ func (b *s3ByteSlice) Range(start, end int) []byte {
 		Range:  aws.String(rng),
 	})
 	if err != nil {
+		observeS3Request("GetObject", 0, err)
 		panic(err)
 	}
 	defer out.Body.Close()
 
 	data, err := ioutil.ReadAll(out.Body)
+	observeS3Request("GetObject", int64(len(data)), err)
 	if err != nil {
 		panic(err)
 	}
@@ -21,6 +21,9 @@ func (m *mockS3) HeadObject(ctx context.Context, in *s3.HeadObjectInput, optFns
 }
 
 func (m *mockS3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	m.lastRange = aws.ToString(in.Range)
 	start, end := 0, len(m.data)
 	if rng := aws.ToString(in.Range); rng != "" {
@@ -33,7 +36,7 @@ func (m *mockS3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ..
 func TestS3ByteSliceRange(t *testing.T) {
 	data := []byte("abcdefghijklmnopqrstuvwxyz")
 	mock := &mockS3{data: data}
-	bs := &s3ByteSlice{cli: mock, bucket: "b", key: "k", size: len(data)}
+	bs := &s3ByteSlice{ctx: context.Background(), cli: mock, bucket: "b", key: "k", size: len(data)}
 
 	got := bs.Range(3, 8)
 	if string(got) != string(data[3:8]) {
@@ -43,3 +46,24 @@ func TestS3ByteSliceRange(t *testing.T) {
 		t.Fatalf("unexpected range header %s", mock.lastRange)
 	}
 }
+
+func TestS3ByteSliceSetContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data := []byte("abcdefghijklmnopqrstuvwxyz")
+	bs := &s3ByteSlice{ctx: ctx, cli: &mockS3{data: data}, bucket: "b", key: "k", size: len(data)}
+
+	func() {
+		defer func() {
+			if r := recover(); r != context.Canceled {
+				t.Fatalf("expected a panic with %v, got %v", context.Canceled, r)
+			}
+		}()
+		bs.Range(0, 1)
+	}()
+
+	bs.SetContext(context.WithoutCancel(ctx))
+	if got := bs.Range(0, 1); string(got) != "a" {
+		t.Fatalf("expected a, got %s", got)
+	}
+}
@@ -0,0 +1,172 @@
+package dump
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/chunkreader"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// S3DownloadTimeout is the timeout of downloads of whole objects from S3.
+const S3DownloadTimeout = 5 * time.Minute
+
+// OpenIndexReader opens the index of a block in a local directory or at an
+// s3:// location. Indexes on S3 are read with ranged requests.
+//
+// Only opening the index is canceled with ctx. index.Reader can report failed
+// reads only by panicking, so later reads are not canceled and callers check
+// ctx between series instead.
+func OpenIndexReader(ctx context.Context, blockPath string, awsProfile string) (*index.Reader, error) {
+	if strings.HasPrefix(blockPath, "s3://") {
+		bucket, key, err := ParseS3Path(blockPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := NewAWSConfig(ctx, bucket, awsProfile)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "new aws config")
+		}
+		cli := s3.NewFromConfig(cfg)
+		bs, err := chunkreader.NewS3ByteSlice(ctx, cli, bucket, path.Join(key, "index"))
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				return nil, err
+			}
+			return nil, pkgerrors.Wrap(err, "prepare index slice")
+		}
+		indexr, err := newIndexReader(bs)
+		if err != nil {
+			return nil, err
+		}
+		bs.SetContext(context.WithoutCancel(ctx))
+		return indexr, nil
+	}
+	return index.NewFileReader(path.Join(blockPath, "index"))
+}
+
+// newIndexReader opens the index in bs, returning the errors of the reads of
+// bs, which index.ByteSlice can only report by panicking.
+func newIndexReader(bs index.ByteSlice) (indexr *index.Reader, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rerr, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = pkgerrors.Wrap(rerr, "read index")
+		}
+	}()
+	return index.NewReader(bs)
+}
+
+// OpenChunkReader opens the chunks of a block in a local directory or at an
+// s3:// location. Like with OpenIndexReader, only opening them is canceled
+// with ctx, so that the series being read when ctx is done can be completed.
+func OpenChunkReader(ctx context.Context, blockPath string, awsProfile string) (tsdb.ChunkReader, error) {
+	if strings.HasPrefix(blockPath, "s3://") {
+		bucket, key, err := ParseS3Path(blockPath)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "parse s3 path")
+		}
+		cfg, err := NewAWSConfig(ctx, bucket, awsProfile)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "new aws config")
+		}
+		cli := s3.NewFromConfig(cfg)
+		return chunkreader.NewS3ChunkReader(context.WithoutCancel(ctx), cli, bucket, key), nil
+	}
+	return chunkreader.NewLocalChunkReader(path.Join(blockPath, "chunks")), nil
+}
+
+// ReadMetaFile returns the raw contents of the meta.json of a block.
+func ReadMetaFile(ctx context.Context, blockPath string, awsProfile string) ([]byte, error) {
+	if strings.HasPrefix(blockPath, "s3://") {
+		bucket, key, err := ParseS3Path(blockPath)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "parse s3 path")
+		}
+		cfg, err := NewAWSConfig(ctx, bucket, awsProfile)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "new aws config")
+		}
+		cli := s3.NewFromConfig(cfg)
+
+		ctx, cancel := context.WithTimeout(ctx, S3DownloadTimeout)
+		defer cancel()
+		out, err := cli.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(path.Join(key, "meta.json")),
+		})
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "get meta.json")
+		}
+		defer out.Body.Close()
+		return ioutil.ReadAll(out.Body)
+	}
+	return ioutil.ReadFile(path.Join(blockPath, "meta.json"))
+}
+
+// ReadBlockMeta reads and decodes the meta.json of a block.
+func ReadBlockMeta(ctx context.Context, blockPath string, awsProfile string) (*tsdb.BlockMeta, error) {
+	b, err := ReadMetaFile(ctx, blockPath, awsProfile)
+	if err != nil {
+		return nil, err
+	}
+	var meta tsdb.BlockMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, pkgerrors.Wrap(err, "decode meta.json")
+	}
+	return &meta, nil
+}
+
+// ParseS3Path splits an s3://bucket/key URL into bucket and key.
+func ParseS3Path(p string) (bucket, key string, err error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" {
+		return "", "", fmt.Errorf("invalid s3 url: %s", p)
+	}
+	bucket = u.Host
+	key = strings.TrimPrefix(u.Path, "/")
+	return bucket, key, nil
+}
+
+// NewAWSConfig loads the AWS configuration for the given profile, looking up
+// the region of bucket if none is configured.
+func NewAWSConfig(ctx context.Context, bucket, profile string) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{}
+	if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if cfg.Region == "" {
+		cfgHint := cfg
+		cfgHint.Region = "us-east-1"
+		region, err := manager.GetBucketRegion(ctx, s3.NewFromConfig(cfgHint), bucket)
+		if err != nil {
+			return aws.Config{}, err
+		}
+		cfg.Region = region
+	}
+	return cfg, nil
+}
@@ -0,0 +1,19 @@
+package dump
+
+import (
+	"context"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+type failingByteSlice struct{}
+
+func (failingByteSlice) Len() int                    { return 1 << 20 }
+func (failingByteSlice) Range(start, end int) []byte { panic(context.Canceled) }
+
+func TestNewIndexReaderReadError(t *testing.T) {
+	if _, err := newIndexReader(failingByteSlice{}); pkgerrors.Cause(err) != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
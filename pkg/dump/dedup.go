@@ -0,0 +1,79 @@
+package dump
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Policies for resolving samples of a series with the same timestamp but
+// different values.
+const (
+	DedupFirst = "first"
+	DedupLast  = "last"
+	DedupMax   = "max"
+)
+
+// ValidateDedup returns an error if policy is not a known dedup policy. The
+// empty policy passes samples through verbatim.
+func ValidateDedup(policy string) error {
+	switch policy {
+	case "", DedupFirst, DedupLast, DedupMax:
+		return nil
+	}
+	return fmt.Errorf("invalid dedup policy: %s", policy)
+}
+
+// outOfOrder counts the samples that do not follow the latest timestamp seen
+// before them, updating it.
+func outOfOrder(latest *int64, timestamps []int64) int64 {
+	var n int64
+	for _, t := range timestamps {
+		if t <= *latest {
+			n++
+			continue
+		}
+		*latest = t
+	}
+	return n
+}
+
+// dedupSamples sorts the samples of a series by timestamp and keeps a single
+// sample per timestamp. Exact duplicates are dropped, while samples with
+// different values are resolved by policy, where "first" and "last" refer to
+// the order the samples were read in. It returns the number of exact
+// duplicates and of conflicting samples dropped.
+func dedupSamples(timestamps []int64, values []float64, policy string) ([]int64, []float64, int64, int64) {
+	idx := make([]int, len(timestamps))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return timestamps[idx[i]] < timestamps[idx[j]] })
+
+	ts := make([]int64, 0, len(timestamps))
+	vs := make([]float64, 0, len(values))
+	var duplicates, conflicts int64
+	for _, i := range idx {
+		t, v := timestamps[i], values[i]
+		last := len(ts) - 1
+		if last < 0 || ts[last] != t {
+			ts = append(ts, t)
+			vs = append(vs, v)
+			continue
+		}
+		if math.Float64bits(vs[last]) == math.Float64bits(v) {
+			duplicates++
+			continue
+		}
+		conflicts++
+		switch policy {
+		case DedupLast:
+			vs[last] = v
+		case DedupMax:
+			if v > vs[last] {
+				vs[last] = v
+			}
+		}
+	}
+	return ts, vs, duplicates, conflicts
+}
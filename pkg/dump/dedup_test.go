@@ -0,0 +1,87 @@
+package dump
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+type sampleWriter struct {
+	timestamps []int64
+	values     []float64
+}
+
+func (w *sampleWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	w.timestamps = append(w.timestamps, timestamps...)
+	w.values = append(w.values, values...)
+	return nil
+}
+
+func (w *sampleWriter) Close() error { return nil }
+
+func TestDumperDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The chunks [0, 9] and [5, 14] overlap, where 5 and 6 conflict and 7 to
+	// 9 are exact duplicates.
+	var first, second [][2]float64
+	for i := 0; i < 10; i++ {
+		first = append(first, [2]float64{float64(i) * 1000, float64(i)})
+	}
+	for i := 5; i < 15; i++ {
+		v := float64(i)
+		if i < 7 {
+			v = 100
+		}
+		second = append(second, [2]float64{float64(i) * 1000, v})
+	}
+	block := filepath.Join(dir, "block")
+	testblock.WriteChunks(t, block, labels.FromStrings("__name__", "a"), testblock.XORChunk(t, first...), testblock.XORChunk(t, second...))
+
+	for _, tc := range []struct {
+		policy string
+		want   Stats
+		value5 float64
+	}{
+		{policy: "", want: Stats{Samples: 20, OutOfOrderSamples: 5}, value5: 5},
+		{policy: DedupFirst, want: Stats{Samples: 15, OutOfOrderSamples: 5, DuplicateSamples: 3, ConflictingSamples: 2}, value5: 5},
+		{policy: DedupLast, want: Stats{Samples: 15, OutOfOrderSamples: 5, DuplicateSamples: 3, ConflictingSamples: 2}, value5: 100},
+		{policy: DedupMax, want: Stats{Samples: 15, OutOfOrderSamples: 5, DuplicateSamples: 3, ConflictingSamples: 2}, value5: 100},
+	} {
+		w := &sampleWriter{}
+		stats, err := New(Options{Block: block, Dedup: tc.policy, MinTime: math.MinInt64, MaxTime: math.MaxInt64, Writer: w}).Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.want.Series, tc.want.Chunks, tc.want.LastSeriesRef = 1, 2, stats.LastSeriesRef
+		if stats != tc.want {
+			t.Fatalf("%q: expected stats %+v, got %+v", tc.policy, tc.want, stats)
+		}
+		if w.timestamps[5] != 5000 || w.values[5] != tc.value5 {
+			t.Fatalf("%q: unexpected sample %d=%v", tc.policy, w.timestamps[5], w.values[5])
+		}
+		if tc.policy == "" {
+			continue
+		}
+		for i, ts := range w.timestamps {
+			if ts != int64(i)*1000 {
+				t.Fatalf("%q: unexpected timestamps %v", tc.policy, w.timestamps)
+			}
+		}
+	}
+
+	if _, err := New(Options{Block: block, Dedup: "min", MinTime: math.MinInt64, MaxTime: math.MaxInt64, Writer: &sampleWriter{}}).Run(context.Background()); err == nil {
+		t.Fatal("expected an error for an invalid policy")
+	}
+}
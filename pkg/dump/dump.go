@@ -0,0 +1,466 @@
+package dump
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// Options configures a Dumper.
+type Options struct {
+	// Block is the path of the block to dump, a local directory or an
+	// s3:// location.
+	Block      string
+	AWSProfile string
+
+	// LabelKey and LabelValues select the series that have any of the
+	// values for the label. All series are selected if LabelKey is empty.
+	LabelKey    string
+	LabelValues []string
+	// MetricName selects only series of the metric if not empty.
+	MetricName string
+	// Matchers further restrict the selected series.
+	Matchers []*labels.Matcher
+	// Shard and Shards select the disjoint subset of the series that one of
+	// Shards independent workers dumps, by a hash of the labels of every
+	// series. All series are selected if Shards is zero.
+	Shard  int
+	Shards int
+
+	// MinTime and MaxTime bound the dumped samples, both inclusive. Use
+	// math.MinInt64 and math.MaxInt64 to dump all samples.
+	MinTime int64
+	MaxTime int64
+	// TimeShift is added to the timestamp of every sample written, after
+	// MinTime and MaxTime are applied.
+	TimeShift int64
+
+	// Dedup is the policy resolving samples of a series with the same
+	// timestamp, see DedupFirst, DedupLast and DedupMax. If set, the samples
+	// of every series are sorted and deduplicated across all of its chunks
+	// before they are written, which requires holding a whole series in
+	// memory. If empty, samples are written verbatim.
+	Dedup string
+
+	// ExternalLabels are appended to the labels of every series.
+	ExternalLabels labels.Labels
+
+	// Writer receives the samples of every series. It is not closed by
+	// the Dumper.
+	Writer writer.Writer
+	// SkipHistograms skips native histogram chunks if Writer is not a
+	// writer.HistogramWriter. Otherwise the dump fails on the first one.
+	SkipHistograms bool
+
+	// Hooks are notified as the dump proceeds.
+	Hooks Hooks
+}
+
+// Hooks are called while a block is dumped. All of them are optional.
+type Hooks struct {
+	// SkipSeries is called for every selected series before its chunks are
+	// read and reports whether it should not be dumped, e.g. because it was written
+	// before an interrupted dump.
+	SkipSeries func(ref uint64) bool
+	// SeriesDone is called after all chunks of a series were written.
+	SeriesDone func(ref uint64) error
+	// ChunkDone is called for every chunk read, with the number of samples
+	// written from it.
+	ChunkDone func(samples int)
+	// ChunkSkipped is called for every chunk that is not read because it
+	// lies outside of the time range.
+	ChunkSkipped func()
+	// OnError is called when a series or chunk (chunkRef 0 for series)
+	// cannot be read. The series or chunk is skipped if it returns nil,
+	// otherwise the dump fails with the returned error. Without OnError
+	// every such error fails the dump.
+	OnError func(ref uint64, lset labels.Labels, chunkRef uint64, err error) error
+}
+
+// Stats summarizes a dump.
+type Stats struct {
+	Series        int64
+	SeriesSkipped int64
+	Chunks        int64
+	ChunksSkipped int64
+	Samples       int64
+	// OutOfOrderSamples is the number of samples read that do not follow
+	// the latest earlier sample of their series, such as samples of
+	// overlapping chunks. DuplicateSamples and ConflictingSamples are the
+	// number of them dropped by Options.Dedup because an earlier sample had
+	// the same timestamp and the same or a different value.
+	OutOfOrderSamples  int64
+	DuplicateSamples   int64
+	ConflictingSamples int64
+	// Histograms is the number of native histograms written.
+	// HistogramChunksSkipped is the number of histogram chunks skipped with
+	// Options.SkipHistograms.
+	Histograms             int64
+	HistogramChunksSkipped int64
+	// Errors is the number of series and chunks skipped by Hooks.OnError.
+	Errors int64
+	// LastSeriesRef is the ref of the last series that was dumped.
+	LastSeriesRef uint64
+}
+
+// Dumper dumps the series of a Prometheus TSDB block.
+type Dumper struct {
+	opts Options
+}
+
+// New creates a Dumper.
+func New(opts Options) *Dumper {
+	return &Dumper{opts: opts}
+}
+
+// CountSeries returns the number of series selected by the options.
+func (d *Dumper) CountSeries(ctx context.Context) (int64, error) {
+	indexr, err := OpenIndexReader(ctx, d.opts.Block, d.opts.AWSProfile)
+	if err != nil {
+		return 0, pkgerrors.Wrap(err, "open index")
+	}
+	defer indexr.Close()
+
+	postings, err := d.postings(indexr)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	lset := labels.Labels{}
+	chks := []chunks.Meta{}
+	for postings.Next() {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if d.opts.Shards > 0 {
+			// The labels of every series are needed to tell its shard.
+			ref := postings.At()
+			lset, chks = lset[:0], chks[:0]
+			if err := indexr.Series(ref, &lset, &chks); err != nil {
+				lset = nil
+			}
+			if !d.inShard(ref, lset) {
+				continue
+			}
+		}
+		n++
+	}
+	return n, pkgerrors.Wrap(postings.Err(), "postings.Err")
+}
+
+// Run writes the samples of all selected series within the time range to the
+// writer, skipping NaN and infinite values.
+//
+// Once ctx is done, Run finishes the series it is writing and returns
+// ctx.Err(), so that the output always ends with a complete series and
+// Stats.LastSeriesRef can be used to resume the dump. Requests for the
+// current series are therefore not canceled with ctx.
+func (d *Dumper) Run(ctx context.Context) (Stats, error) {
+	var stats Stats
+	if d.opts.Writer == nil {
+		return stats, fmt.Errorf("no writer configured")
+	}
+	if err := ValidateDedup(d.opts.Dedup); err != nil {
+		return stats, err
+	}
+
+	indexr, err := OpenIndexReader(ctx, d.opts.Block, d.opts.AWSProfile)
+	if err != nil {
+		return stats, pkgerrors.Wrap(err, "open index")
+	}
+	defer indexr.Close()
+
+	chunkr, err := OpenChunkReader(ctx, d.opts.Block, d.opts.AWSProfile)
+	if err != nil {
+		return stats, pkgerrors.Wrap(err, "open chunks")
+	}
+	defer chunkr.Close()
+
+	postings, err := d.postings(indexr)
+	if err != nil {
+		return stats, err
+	}
+
+	h := d.opts.Hooks
+	for postings.Next() {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		ref := postings.At()
+		skip := func() bool {
+			if h.SkipSeries != nil && h.SkipSeries(ref) {
+				stats.SeriesSkipped++
+				return true
+			}
+			return false
+		}
+		// Without shards, skipped series are not read at all, which saves
+		// index reads when a dump from S3 is resumed. With shards, the
+		// labels are needed first to tell whether the series is selected.
+		if d.opts.Shards == 0 && skip() {
+			continue
+		}
+		lset := labels.Labels{}
+		chks := []chunks.Meta{}
+		if err := indexr.Series(ref, &lset, &chks); err != nil {
+			if !d.inShard(ref, nil) {
+				continue
+			}
+			if err := d.handleError(&stats, ref, nil, 0, err); err != nil {
+				return stats, pkgerrors.Wrap(err, "indexr.Series")
+			}
+			continue
+		}
+		if !d.inShard(ref, lset) {
+			continue
+		}
+		if d.opts.Shards > 0 && skip() {
+			continue
+		}
+		if len(d.opts.ExternalLabels) > 0 {
+			lset = append(lset, d.opts.ExternalLabels...)
+		}
+
+		latest := int64(math.MinInt64)
+		var timestamps []int64
+		var values []float64
+		for _, meta := range chks {
+			// Chunks outside of the time range are not fetched at all,
+			// which saves most requests for narrow ranges on S3.
+			if !meta.OverlapsClosedInterval(d.opts.MinTime, d.opts.MaxTime) {
+				stats.ChunksSkipped++
+				chunksSkippedTotal.Inc()
+				if h.ChunkSkipped != nil {
+					h.ChunkSkipped()
+				}
+				continue
+			}
+			ts, vs, err := d.readChunk(&stats, chunkr, ref, lset, meta)
+			if err != nil {
+				return stats, err
+			}
+			if n := outOfOrder(&latest, ts); n > 0 {
+				stats.OutOfOrderSamples += n
+				outOfOrderSamplesTotal.Add(float64(n))
+			}
+			if d.opts.Dedup != "" {
+				timestamps = append(timestamps, ts...)
+				values = append(values, vs...)
+				continue
+			}
+			if err := d.write(&stats, lset, ts, vs); err != nil {
+				return stats, err
+			}
+		}
+		if d.opts.Dedup != "" {
+			ts, vs, duplicates, conflicts := dedupSamples(timestamps, values, d.opts.Dedup)
+			stats.DuplicateSamples += duplicates
+			stats.ConflictingSamples += conflicts
+			if err := d.write(&stats, lset, ts, vs); err != nil {
+				return stats, err
+			}
+		}
+
+		stats.Series++
+		stats.LastSeriesRef = ref
+		seriesProcessedTotal.Inc()
+		lastSeriesProcessed.SetToCurrentTime()
+		if h.SeriesDone != nil {
+			if err := h.SeriesDone(ref); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	if postings.Err() != nil {
+		return stats, pkgerrors.Wrap(postings.Err(), "postings.Err")
+	}
+	return stats, nil
+}
+
+// readChunk returns the samples of a chunk within the time range. It returns
+// no samples if the chunk cannot be read and the error is handled by
+// Hooks.OnError, and for histogram chunks, which it writes itself.
+func (d *Dumper) readChunk(stats *Stats, chunkr tsdb.ChunkReader, ref uint64, lset labels.Labels, meta chunks.Meta) ([]int64, []float64, error) {
+	chunk, err := chunkr.Chunk(meta.Ref)
+	if err != nil {
+		if err := d.handleError(stats, ref, lset, meta.Ref, err); err != nil {
+			return nil, nil, pkgerrors.Wrap(err, "chunkr.Chunk")
+		}
+		return nil, nil, nil
+	}
+	if hc, ok := chunk.(*histogram.Chunk); ok {
+		return nil, nil, d.dumpHistogramChunk(stats, hc, ref, lset, meta)
+	}
+
+	var timestamps []int64
+	var values []float64
+
+	it := chunk.Iterator(nil)
+	for it.Next() {
+		t, v := it.At()
+		if math.IsNaN(v) {
+			continue
+		}
+		if math.IsInf(v, -1) || math.IsInf(v, 1) {
+			continue
+		}
+		if t < d.opts.MinTime || d.opts.MaxTime < t {
+			continue
+		}
+		timestamps = append(timestamps, t)
+		values = append(values, v)
+	}
+	if it.Err() != nil {
+		if err := d.handleError(stats, ref, lset, meta.Ref, it.Err()); err != nil {
+			return nil, nil, pkgerrors.Wrap(err, "iterator.Err")
+		}
+		return nil, nil, nil
+	}
+
+	stats.Chunks++
+	chunksProcessedTotal.Inc()
+	if d.opts.Hooks.ChunkDone != nil {
+		d.opts.Hooks.ChunkDone(len(timestamps))
+	}
+	return timestamps, values, nil
+}
+
+// dumpHistogramChunk writes the histograms of a chunk within the time range,
+// skipping staleness markers. It fails if the writer does not support
+// histograms, unless Options.SkipHistograms is set.
+func (d *Dumper) dumpHistogramChunk(stats *Stats, chunk *histogram.Chunk, ref uint64, lset labels.Labels, meta chunks.Meta) error {
+	hw, ok := d.opts.Writer.(writer.HistogramWriter)
+	if !ok {
+		if !d.opts.SkipHistograms {
+			return fmt.Errorf("series %s has native histograms, which the output format does not support", lset)
+		}
+		stats.HistogramChunksSkipped++
+		return nil
+	}
+	ts, hs, err := chunk.Histograms()
+	if err != nil {
+		if err := d.handleError(stats, ref, lset, meta.Ref, err); err != nil {
+			return pkgerrors.Wrap(err, "decode histograms")
+		}
+		return nil
+	}
+
+	var timestamps []int64
+	var histograms []*histogram.FloatHistogram
+	for i, h := range hs {
+		if h.IsStale() || ts[i] < d.opts.MinTime || d.opts.MaxTime < ts[i] {
+			continue
+		}
+		timestamps = append(timestamps, ts[i])
+		histograms = append(histograms, h)
+	}
+
+	stats.Chunks++
+	chunksProcessedTotal.Inc()
+	if d.opts.Hooks.ChunkDone != nil {
+		d.opts.Hooks.ChunkDone(len(timestamps))
+	}
+	if len(timestamps) == 0 {
+		return nil
+	}
+	stats.Histograms += int64(len(timestamps))
+	d.shift(timestamps)
+	if err := hw.WriteHistograms(&lset, timestamps, histograms); err != nil {
+		return pkgerrors.Wrap(err, fmt.Sprintf("Writer.WriteHistograms(%v, %v)", lset, timestamps))
+	}
+	return nil
+}
+
+func (d *Dumper) write(stats *Stats, lset labels.Labels, timestamps []int64, values []float64) error {
+	if len(timestamps) == 0 {
+		return nil
+	}
+	stats.Samples += int64(len(timestamps))
+	d.shift(timestamps)
+	if err := d.opts.Writer.Write(&lset, timestamps, values); err != nil {
+		return pkgerrors.Wrap(err, fmt.Sprintf("Writer.Write(%v, %v, %v)", lset, timestamps, values))
+	}
+	return nil
+}
+
+// shift applies TimeShift to timestamps in place.
+func (d *Dumper) shift(timestamps []int64) {
+	if d.opts.TimeShift == 0 {
+		return
+	}
+	for i := range timestamps {
+		timestamps[i] += d.opts.TimeShift
+	}
+}
+
+func (d *Dumper) handleError(stats *Stats, ref uint64, lset labels.Labels, chunkRef uint64, err error) error {
+	if d.opts.Hooks.OnError == nil {
+		return err
+	}
+	if err := d.opts.Hooks.OnError(ref, lset, chunkRef, err); err != nil {
+		return err
+	}
+	stats.Errors++
+	return nil
+}
+
+func (d *Dumper) postings(indexr *index.Reader) (index.Postings, error) {
+	postings, err := SelectPostings(indexr, d.opts.LabelKey, d.opts.LabelValues, d.opts.MetricName)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.opts.Matchers) > 0 {
+		matched, err := tsdb.PostingsForMatchers(indexr, d.opts.Matchers...)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "postings for matchers")
+		}
+		postings = index.Intersect(postings, matched)
+	}
+	// Series are filtered by shard with inShard once their labels are read.
+	if d.opts.Shards > 0 && (d.opts.Shard < 0 || d.opts.Shard >= d.opts.Shards) {
+		return nil, fmt.Errorf("invalid shard %d/%d", d.opts.Shard, d.opts.Shards)
+	}
+	return postings, nil
+}
+
+// SelectPostings returns the postings of all series matching the label values
+// and metric name, or of all series if labelKey is empty, merged into a single
+// stream ordered by series ref so that a checkpoint can be expressed as a
+// single ref.
+func SelectPostings(indexr *index.Reader, labelKey string, labelValues []string, metricName string) (index.Postings, error) {
+	// default to all postings if no label key provided
+	if labelKey == "" {
+		allKey, allValue := index.AllPostingsKey()
+		labelKey = allKey
+		labelValues = []string{allValue}
+	}
+
+	valuePostings := make([]index.Postings, 0, len(labelValues))
+	for _, val := range labelValues {
+		p, err := indexr.Postings(labelKey, val)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "indexr.Postings")
+		}
+		valuePostings = append(valuePostings, p)
+	}
+	postings := index.Merge(valuePostings...)
+
+	if metricName != "" {
+		metricPostings, err := indexr.Postings(labels.MetricName, metricName)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "indexr.Postings metric")
+		}
+		postings = index.Intersect(postings, metricPostings)
+	}
+	return postings, nil
+}
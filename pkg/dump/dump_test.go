@@ -0,0 +1,146 @@
+package dump
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+type collectingWriter struct {
+	series  []string
+	samples int
+}
+
+func (w *collectingWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	w.series = append(w.series, lset.String())
+	w.samples += len(timestamps)
+	return nil
+}
+
+func (w *collectingWriter) Close() error { return nil }
+
+func TestDumperRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 480,
+		labels.FromStrings("__name__", "a", "tenant", "x"),
+		labels.FromStrings("__name__", "a", "tenant", "y"),
+		labels.FromStrings("__name__", "b", "tenant", "x"),
+	)
+
+	w := &collectingWriter{}
+	var skipped int
+	opts := Options{
+		Block:          block,
+		MetricName:     "a",
+		Matchers:       []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "tenant", "x|z")},
+		MinTime:        130000,
+		MaxTime:        250000,
+		ExternalLabels: labels.FromStrings("cluster", "c"),
+		Writer:         w,
+		Hooks:          Hooks{ChunkSkipped: func() { skipped++ }},
+	}
+	skippedBefore, processedBefore := testutil.ToFloat64(chunksSkippedTotal), testutil.ToFloat64(chunksProcessedTotal)
+	stats, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Of the 4 chunks of 120 samples, only [120, 240) and [240, 360)
+	// overlap with the time range.
+	want := Stats{Series: 1, Chunks: 2, ChunksSkipped: 2, Samples: 121, LastSeriesRef: stats.LastSeriesRef}
+	if stats != want {
+		t.Fatalf("expected stats %+v, got %+v", want, stats)
+	}
+	if skipped != 2 {
+		t.Fatalf("expected 2 skipped chunks, got %d", skipped)
+	}
+	if n := testutil.ToFloat64(chunksSkippedTotal) - skippedBefore; n != 2 {
+		t.Fatalf("expected chunks_skipped_total to grow by 2, got %v", n)
+	}
+	if n := testutil.ToFloat64(chunksProcessedTotal) - processedBefore; n != 2 {
+		t.Fatalf("expected chunks_processed_total to grow by 2, got %v", n)
+	}
+	for _, s := range w.series {
+		if s != `{__name__="a", tenant="x", cluster="c"}` {
+			t.Fatalf("unexpected series %s", s)
+		}
+	}
+	if w.samples != 121 {
+		t.Fatalf("expected 121 samples, got %d", w.samples)
+	}
+
+	// The time range applies to the timestamps before they are shifted.
+	sw := &sampleWriter{}
+	opts.Writer, opts.TimeShift = sw, -130000
+	if _, err := New(opts).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sw.timestamps) != 121 || sw.timestamps[0] != 0 || sw.timestamps[120] != 120000 || sw.values[0] != 130 {
+		t.Fatalf("unexpected shifted samples %v", sw.timestamps)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New(opts).Run(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+type histogramCollectingWriter struct {
+	collectingWriter
+	histograms int
+}
+
+func (w *histogramCollectingWriter) WriteHistograms(lset *labels.Labels, timestamps []int64, histograms []*histogram.FloatHistogram) error {
+	w.histograms += len(histograms)
+	return nil
+}
+
+func TestDumperHistograms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump-histograms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testblock.WriteChunks(t, dir, labels.FromStrings("__name__", "h"), testblock.HistogramChunk(t))
+
+	opts := Options{Block: dir, MinTime: math.MinInt64, MaxTime: math.MaxInt64}
+
+	hw := &histogramCollectingWriter{}
+	opts.Writer = hw
+	stats, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Histograms != 4 || hw.histograms != 4 {
+		t.Fatalf("expected 4 histograms, got %d and %d written", stats.Histograms, hw.histograms)
+	}
+
+	opts.Writer = &collectingWriter{}
+	if _, err := New(opts).Run(context.Background()); err == nil {
+		t.Fatal("expected an error for a writer without histogram support")
+	}
+
+	opts.SkipHistograms = true
+	stats, err = New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.HistogramChunksSkipped != 1 || stats.Histograms != 0 {
+		t.Fatalf("expected 1 skipped chunk, got stats %+v", stats)
+	}
+}
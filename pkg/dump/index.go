@@ -0,0 +1,72 @@
+package dump
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+// DumpIndex writes the labels and chunk metas of every selected series as
+// JSON lines to out, without reading any chunks.
+func (d *Dumper) DumpIndex(ctx context.Context, out io.Writer) error {
+	indexr, err := OpenIndexReader(ctx, d.opts.Block, d.opts.AWSProfile)
+	if err != nil {
+		return err
+	}
+	defer indexr.Close()
+
+	postings, err := d.postings(indexr)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	for postings.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ref := postings.At()
+		lset := labels.Labels{}
+		chks := []chunks.Meta{}
+		if err := indexr.Series(ref, &lset, &chks); err != nil {
+			if !d.inShard(ref, nil) {
+				continue
+			}
+			return pkgerrors.Wrap(err, "indexr.Series")
+		}
+		if !d.inShard(ref, lset) {
+			continue
+		}
+
+		metric := map[string]string{}
+		for _, l := range lset {
+			metric[l.Name] = l.Value
+		}
+
+		type meta struct {
+			Ref     uint64 `json:"ref"`
+			MinTime int64  `json:"minTime"`
+			MaxTime int64  `json:"maxTime"`
+		}
+
+		metas := make([]meta, 0, len(chks))
+		for _, m := range chks {
+			metas = append(metas, meta{Ref: m.Ref, MinTime: m.MinTime, MaxTime: m.MaxTime})
+		}
+
+		line := struct {
+			Labels map[string]string `json:"labels"`
+			Chunks []meta            `json:"chunks"`
+		}{Labels: metric, Chunks: metas}
+
+		if err := enc.Encode(line); err != nil {
+			return pkgerrors.Wrap(err, "encode")
+		}
+	}
+
+	return pkgerrors.Wrap(postings.Err(), "postings.Err")
+}
@@ -0,0 +1,33 @@
+package dump
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	seriesProcessedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_series_processed_total",
+		Help: "Total number of series processed by the dump.",
+	})
+	chunksProcessedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_chunks_processed_total",
+		Help: "Total number of chunks processed by the dump.",
+	})
+	chunksSkippedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_chunks_skipped_total",
+		Help: "Total number of chunks not read because they lie outside of the requested time range.",
+	})
+	outOfOrderSamplesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_out_of_order_samples_total",
+		Help: "Total number of samples read that do not follow the latest earlier sample of their series.",
+	})
+	lastSeriesProcessed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_dump_last_series_processed_timestamp_seconds",
+		Help: "Unix time at which the last series was processed completely.",
+	})
+)
+
+// RegisterMetrics registers the metrics of the Dumper.
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(seriesProcessedTotal, chunksProcessedTotal, chunksSkippedTotal, outOfOrderSamplesTotal, lastSeriesProcessed)
+}
@@ -0,0 +1,45 @@
+package dump
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ParseShard parses a shard in the form i/n, where i is the zero-based index
+// of the shard and n the number of shards.
+func ParseShard(s string) (int, int, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid shard %q: expected i/n", s)
+	}
+	i, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q: %s", s, err)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q: %s", s, err)
+	}
+	if n < 1 || i < 0 || i >= n {
+		return 0, 0, fmt.Errorf("invalid shard %q: expected 0 <= i < n", s)
+	}
+	return i, n, nil
+}
+
+// inShard reports whether the series ref with the labels lset belongs to the
+// shard of the options, by a hash of the labels of the series in the block.
+// Series that cannot be read, passed with nil labels, are left to exactly one
+// shard to report.
+func (d *Dumper) inShard(ref uint64, lset labels.Labels) bool {
+	if d.opts.Shards == 0 {
+		return true
+	}
+	shard, shards := uint64(d.opts.Shard), uint64(d.opts.Shards)
+	if lset == nil {
+		return ref%shards == shard
+	}
+	return lset.Hash()%shards == shard
+}
@@ -0,0 +1,90 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestDumperShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump-shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var series []labels.Labels
+	for i := 0; i < 100; i++ {
+		series = append(series, labels.FromStrings("__name__", "a", "instance", fmt.Sprint(i)))
+	}
+	block := testblock.Write(t, dir, 1, series...)
+
+	seen := map[string]int{}
+	for shard := 0; shard < 3; shard++ {
+		w := &collectingWriter{}
+		var hooked int64
+		d := New(Options{
+			Block:   block,
+			Shard:   shard,
+			Shards:  3,
+			MinTime: math.MinInt64,
+			MaxTime: math.MaxInt64,
+			Writer:  w,
+			Hooks: Hooks{SkipSeries: func(ref uint64) bool {
+				hooked++
+				return false
+			}},
+		})
+		n, err := d.CountSeries(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var index bytes.Buffer
+		if err := d.DumpIndex(context.Background(), &index); err != nil {
+			t.Fatal(err)
+		}
+		if lines := int64(bytes.Count(index.Bytes(), []byte("\n"))); lines != n {
+			t.Fatalf("shard %d: counted %d series, dumped the index of %d", shard, n, lines)
+		}
+		stats, err := d.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Series != n || n == 0 || n == 100 {
+			t.Fatalf("shard %d: counted %d series, dumped %d", shard, n, stats.Series)
+		}
+		if hooked != n {
+			t.Fatalf("shard %d: SkipSeries called for %d series, expected %d", shard, hooked, n)
+		}
+		for _, s := range w.series {
+			seen[s]++
+		}
+	}
+	if len(seen) != 100 {
+		t.Fatalf("expected 100 series in all shards, got %d", len(seen))
+	}
+	for s, n := range seen {
+		if n != 1 {
+			t.Fatalf("series %s dumped by %d shards", s, n)
+		}
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	if i, n, err := ParseShard("2/8"); err != nil || i != 2 || n != 8 {
+		t.Fatalf("unexpected shard %d/%d: %v", i, n, err)
+	}
+	for _, s := range []string{"", "1", "8/8", "-1/2", "a/2", "0/0"} {
+		if _, _, err := ParseShard(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
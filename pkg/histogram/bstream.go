@@ -0,0 +1,217 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The bit stream reader and the varbit and XOR decoding below are ported
+// from tsdb/chunkenc of Prometheus v2.54, as the vendored version predates
+// histogram chunks and does not export them.
+
+package histogram
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+type bstreamReader struct {
+	stream       []byte
+	streamOffset int
+
+	buffer uint64
+	valid  uint8
+}
+
+func newBReader(b []byte) bstreamReader {
+	return bstreamReader{stream: b}
+}
+
+func (b *bstreamReader) readBit() (bool, error) {
+	if b.valid == 0 {
+		if !b.loadNextBuffer(1) {
+			return false, io.EOF
+		}
+	}
+	b.valid--
+	return (b.buffer & (uint64(1) << b.valid)) != 0, nil
+}
+
+func (b *bstreamReader) readBits(nbits uint8) (uint64, error) {
+	if b.valid == 0 {
+		if !b.loadNextBuffer(nbits) {
+			return 0, io.EOF
+		}
+	}
+
+	if nbits <= b.valid {
+		bitmask := (uint64(1) << nbits) - 1
+		b.valid -= nbits
+		return (b.buffer >> b.valid) & bitmask, nil
+	}
+
+	// Read all remaining bits of the current buffer and the rest from the
+	// next one.
+	bitmask := (uint64(1) << b.valid) - 1
+	nbits -= b.valid
+	v := (b.buffer & bitmask) << nbits
+	b.valid = 0
+
+	if !b.loadNextBuffer(nbits) {
+		return 0, io.EOF
+	}
+
+	bitmask = (uint64(1) << nbits) - 1
+	v |= (b.buffer >> (b.valid - nbits)) & bitmask
+	b.valid -= nbits
+
+	return v, nil
+}
+
+func (b *bstreamReader) readByte() (byte, error) {
+	v, err := b.readBits(8)
+	return byte(v), err
+}
+
+func (b *bstreamReader) loadNextBuffer(nbits uint8) bool {
+	if b.streamOffset >= len(b.stream) {
+		return false
+	}
+
+	if b.streamOffset+8 < len(b.stream) {
+		b.buffer = binary.BigEndian.Uint64(b.stream[b.streamOffset:])
+		b.streamOffset += 8
+		b.valid = 64
+		return true
+	}
+
+	nbytes := int((nbits / 8) + 1)
+	if b.streamOffset+nbytes > len(b.stream) {
+		nbytes = len(b.stream) - b.streamOffset
+	}
+	buffer := uint64(0)
+	for i := 0; i < nbytes; i++ {
+		buffer |= uint64(b.stream[b.streamOffset+i]) << uint(8*(nbytes-i-1))
+	}
+	b.buffer = buffer
+	b.streamOffset += nbytes
+	b.valid = uint8(nbytes * 8)
+	return true
+}
+
+// readVarbitPrefix reads the unary prefix of a varbit number and returns the
+// number of bits that follow it, or 64 for the 9 byte encoding.
+func readVarbitPrefix(b *bstreamReader) (uint8, error) {
+	var d byte
+	for i := 0; i < 8; i++ {
+		d <<= 1
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		d |= 1
+	}
+	switch d {
+	case 0b0:
+		return 0, nil
+	case 0b10:
+		return 3, nil
+	case 0b110:
+		return 6, nil
+	case 0b1110:
+		return 9, nil
+	case 0b11110:
+		return 12, nil
+	case 0b111110:
+		return 18, nil
+	case 0b1111110:
+		return 25, nil
+	case 0b11111110:
+		return 56, nil
+	case 0b11111111:
+		return 64, nil
+	}
+	return 0, fmt.Errorf("invalid bit pattern %b", d)
+}
+
+func readVarbitInt(b *bstreamReader) (int64, error) {
+	sz, err := readVarbitPrefix(b)
+	if err != nil || sz == 0 {
+		return 0, err
+	}
+	bits, err := b.readBits(sz)
+	if err != nil {
+		return 0, err
+	}
+	if sz != 64 && bits > (1<<(sz-1)) {
+		bits -= 1 << sz
+	}
+	return int64(bits), nil
+}
+
+func readVarbitUint(b *bstreamReader) (uint64, error) {
+	sz, err := readVarbitPrefix(b)
+	if err != nil || sz == 0 {
+		return 0, err
+	}
+	return b.readBits(sz)
+}
+
+// xorRead reads a Gorilla XOR encoded float following value.
+func xorRead(br *bstreamReader, value *float64, leading, trailing *uint8) error {
+	bit, err := br.readBit()
+	if err != nil {
+		return err
+	}
+	if !bit {
+		return nil
+	}
+	bit, err = br.readBit()
+	if err != nil {
+		return err
+	}
+
+	var newLeading, newTrailing, mbits uint8
+	if !bit {
+		// Reuse leading/trailing zero bits.
+		newLeading, newTrailing = *leading, *trailing
+		mbits = 64 - newLeading - newTrailing
+	} else {
+		bits, err := br.readBits(5)
+		if err != nil {
+			return err
+		}
+		newLeading = uint8(bits)
+		bits, err = br.readBits(6)
+		if err != nil {
+			return err
+		}
+		mbits = uint8(bits)
+		// 0 significant bits means 64, which does not fit into 6 bits.
+		if mbits == 0 {
+			mbits = 64
+		}
+		newTrailing = 64 - newLeading - mbits
+		*leading, *trailing = newLeading, newTrailing
+	}
+	bits, err := br.readBits(mbits)
+	if err != nil {
+		return err
+	}
+	vbits := math.Float64bits(*value)
+	vbits ^= bits << newTrailing
+	*value = math.Float64frombits(vbits)
+	return nil
+}
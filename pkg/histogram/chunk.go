@@ -0,0 +1,437 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The decoding of histogram and float histogram chunks below is ported from
+// the iterators in tsdb/chunkenc of Prometheus v2.54.
+
+package histogram
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// Chunk is a histogram or float histogram chunk. It implements
+// chunkenc.Chunk so that it can be returned by chunk readers, but holds no
+// float samples: its iterator fails with ErrNotFloatChunk. Use Histograms to
+// decode it.
+type Chunk struct {
+	enc chunkenc.Encoding
+	b   []byte
+}
+
+// ErrNotFloatChunk is returned by the iterator of a Chunk.
+var ErrNotFloatChunk = errors.New("histogram chunks hold no float samples")
+
+// NewChunk returns a chunk of the histogram encoding enc holding b.
+func NewChunk(enc chunkenc.Encoding, b []byte) (*Chunk, error) {
+	if enc != EncHistogram && enc != EncFloatHistogram {
+		return nil, fmt.Errorf("invalid histogram chunk encoding %d", enc)
+	}
+	if len(b) < 3 {
+		return nil, fmt.Errorf("histogram chunk too short: %d bytes", len(b))
+	}
+	return &Chunk{enc: enc, b: b}, nil
+}
+
+func (c *Chunk) Bytes() []byte { return c.b }
+
+func (c *Chunk) Encoding() chunkenc.Encoding { return c.enc }
+
+func (c *Chunk) NumSamples() int { return int(binary.BigEndian.Uint16(c.b)) }
+
+func (c *Chunk) Appender() (chunkenc.Appender, error) {
+	return nil, fmt.Errorf("histogram chunks are read-only")
+}
+
+func (c *Chunk) Iterator(chunkenc.Iterator) chunkenc.Iterator {
+	return errIterator{}
+}
+
+// Histograms decodes all histograms of the chunk.
+func (c *Chunk) Histograms() ([]int64, []*FloatHistogram, error) {
+	d := &decoder{
+		br:       newBReader(c.b[3:]),
+		total:    c.NumSamples(),
+		resetHdr: c.b[2] & 0b11000000,
+	}
+	if err := d.readLayout(); err != nil && d.total > 0 {
+		return nil, nil, err
+	}
+	timestamps := make([]int64, 0, d.total)
+	histograms := make([]*FloatHistogram, 0, d.total)
+	for i := 0; i < d.total; i++ {
+		var h *FloatHistogram
+		var err error
+		if c.enc == EncHistogram {
+			h, err = d.next()
+		} else {
+			h, err = d.nextFloat()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		timestamps = append(timestamps, d.t)
+		histograms = append(histograms, h)
+	}
+	return timestamps, histograms, nil
+}
+
+type decoder struct {
+	br       bstreamReader
+	total    int
+	read     int
+	resetHdr byte
+
+	schema         int32
+	zThreshold     float64
+	pSpans, nSpans []Span
+	customValues   []float64
+
+	t, tDelta int64
+
+	// Integer histograms store counts and buckets as double deltas, where
+	// buckets are deltas to the previous bucket.
+	cnt, zCnt                    uint64
+	cntDelta, zCntDelta          int64
+	pBuckets, nBuckets           []int64
+	pBucketsDelta, nBucketsDelta []int64
+
+	// Float histograms store all values XOR encoded.
+	fCnt, fZCnt                        xorValue
+	pFloat, nFloat                     []float64
+	pBucketsLeading, nBucketsLeading   []uint8
+	pBucketsTrailing, nBucketsTrailing []uint8
+
+	sum xorValue
+}
+
+type xorValue struct {
+	value    float64
+	leading  uint8
+	trailing uint8
+}
+
+func (d *decoder) readLayout() error {
+	var err error
+	if d.zThreshold, err = readZeroThreshold(&d.br); err != nil {
+		return err
+	}
+	schema, err := readVarbitInt(&d.br)
+	if err != nil {
+		return err
+	}
+	d.schema = int32(schema)
+	if d.pSpans, err = readSpans(&d.br); err != nil {
+		return err
+	}
+	if d.nSpans, err = readSpans(&d.br); err != nil {
+		return err
+	}
+	if d.schema == CustomBucketsSchema {
+		n, err := readVarbitUint(&d.br)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			bound, err := readCustomBound(&d.br)
+			if err != nil {
+				return err
+			}
+			d.customValues = append(d.customValues, bound)
+		}
+	}
+	np, nn := countSpans(d.pSpans), countSpans(d.nSpans)
+	d.pBuckets, d.pBucketsDelta, d.pFloat = make([]int64, np), make([]int64, np), make([]float64, np)
+	d.nBuckets, d.nBucketsDelta, d.nFloat = make([]int64, nn), make([]int64, nn), make([]float64, nn)
+	d.pBucketsLeading, d.pBucketsTrailing = make([]uint8, np), make([]uint8, np)
+	d.nBucketsLeading, d.nBucketsTrailing = make([]uint8, nn), make([]uint8, nn)
+	return nil
+}
+
+// next decodes the next sample of an integer histogram chunk.
+func (d *decoder) next() (*FloatHistogram, error) {
+	if d.read == 0 {
+		t, err := readVarbitInt(&d.br)
+		if err != nil {
+			return nil, err
+		}
+		d.t = t
+		if d.cnt, err = readVarbitUint(&d.br); err != nil {
+			return nil, err
+		}
+		if d.zCnt, err = readVarbitUint(&d.br); err != nil {
+			return nil, err
+		}
+		sum, err := d.br.readBits(64)
+		if err != nil {
+			return nil, err
+		}
+		d.sum.value = math.Float64frombits(sum)
+		for _, buckets := range [][]int64{d.pBuckets, d.nBuckets} {
+			for i := range buckets {
+				if buckets[i], err = readVarbitInt(&d.br); err != nil {
+					return nil, err
+				}
+			}
+		}
+		d.read++
+		return d.intHistogram(), nil
+	}
+
+	// The second sample is encoded as a delta, which the double delta
+	// decoding below handles as well, as all deltas start at zero.
+	tDod, err := readVarbitInt(&d.br)
+	if err != nil {
+		return nil, err
+	}
+	d.tDelta += tDod
+	d.t += d.tDelta
+
+	cntDod, err := readVarbitInt(&d.br)
+	if err != nil {
+		return nil, err
+	}
+	d.cntDelta += cntDod
+	d.cnt = uint64(int64(d.cnt) + d.cntDelta)
+
+	zCntDod, err := readVarbitInt(&d.br)
+	if err != nil {
+		return nil, err
+	}
+	d.zCntDelta += zCntDod
+	d.zCnt = uint64(int64(d.zCnt) + d.zCntDelta)
+
+	if err := xorRead(&d.br, &d.sum.value, &d.sum.leading, &d.sum.trailing); err != nil {
+		return nil, err
+	}
+	d.read++
+	if math.Float64bits(d.sum.value) == staleNaN {
+		return &FloatHistogram{Sum: d.sum.value}, nil
+	}
+
+	for i := range d.pBuckets {
+		dod, err := readVarbitInt(&d.br)
+		if err != nil {
+			return nil, err
+		}
+		d.pBucketsDelta[i] += dod
+		d.pBuckets[i] += d.pBucketsDelta[i]
+	}
+	for i := range d.nBuckets {
+		dod, err := readVarbitInt(&d.br)
+		if err != nil {
+			return nil, err
+		}
+		d.nBucketsDelta[i] += dod
+		d.nBuckets[i] += d.nBucketsDelta[i]
+	}
+	return d.intHistogram(), nil
+}
+
+func (d *decoder) intHistogram() *FloatHistogram {
+	h := d.histogram()
+	h.Count = float64(d.cnt)
+	h.ZeroCount = float64(d.zCnt)
+	h.PositiveBuckets = absoluteBuckets(d.pBuckets)
+	h.NegativeBuckets = absoluteBuckets(d.nBuckets)
+	return h
+}
+
+// nextFloat decodes the next sample of a float histogram chunk.
+func (d *decoder) nextFloat() (*FloatHistogram, error) {
+	if d.read == 0 {
+		t, err := readVarbitInt(&d.br)
+		if err != nil {
+			return nil, err
+		}
+		d.t = t
+		for _, v := range []*float64{&d.fCnt.value, &d.fZCnt.value, &d.sum.value} {
+			bits, err := d.br.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			*v = math.Float64frombits(bits)
+		}
+		for _, buckets := range [][]float64{d.pFloat, d.nFloat} {
+			for i := range buckets {
+				bits, err := d.br.readBits(64)
+				if err != nil {
+					return nil, err
+				}
+				buckets[i] = math.Float64frombits(bits)
+			}
+		}
+		d.read++
+		return d.floatHistogram(), nil
+	}
+
+	tDod, err := readVarbitInt(&d.br)
+	if err != nil {
+		return nil, err
+	}
+	d.tDelta += tDod
+	d.t += d.tDelta
+
+	for _, v := range []*xorValue{&d.fCnt, &d.fZCnt, &d.sum} {
+		if err := xorRead(&d.br, &v.value, &v.leading, &v.trailing); err != nil {
+			return nil, err
+		}
+	}
+	d.read++
+	if math.Float64bits(d.sum.value) == staleNaN {
+		return &FloatHistogram{Sum: d.sum.value}, nil
+	}
+
+	for i := range d.pFloat {
+		if err := xorRead(&d.br, &d.pFloat[i], &d.pBucketsLeading[i], &d.pBucketsTrailing[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range d.nFloat {
+		if err := xorRead(&d.br, &d.nFloat[i], &d.nBucketsLeading[i], &d.nBucketsTrailing[i]); err != nil {
+			return nil, err
+		}
+	}
+	return d.floatHistogram(), nil
+}
+
+func (d *decoder) floatHistogram() *FloatHistogram {
+	h := d.histogram()
+	h.Count = d.fCnt.value
+	h.ZeroCount = d.fZCnt.value
+	h.PositiveBuckets = make([]float64, len(d.pFloat))
+	copy(h.PositiveBuckets, d.pFloat)
+	h.NegativeBuckets = make([]float64, len(d.nFloat))
+	copy(h.NegativeBuckets, d.nFloat)
+	return h
+}
+
+// histogram returns a histogram with the layout and sum of the current
+// sample.
+func (d *decoder) histogram() *FloatHistogram {
+	return &FloatHistogram{
+		CounterResetHint: d.counterResetHint(),
+		Schema:           d.schema,
+		ZeroThreshold:    d.zThreshold,
+		Sum:              d.sum.value,
+		PositiveSpans:    d.pSpans,
+		NegativeSpans:    d.nSpans,
+		CustomValues:     d.customValues,
+	}
+}
+
+// counterResetHint returns the hint of the current sample from the counter
+// reset header of the chunk. Only the first sample of a chunk can be a
+// counter reset.
+func (d *decoder) counterResetHint() string {
+	switch {
+	case d.resetHdr == 0b11000000:
+		return "gauge"
+	case d.read > 1:
+		return "not_reset"
+	case d.resetHdr == 0b10000000:
+		return "reset"
+	}
+	return "unknown"
+}
+
+func absoluteBuckets(deltas []int64) []float64 {
+	buckets := make([]float64, len(deltas))
+	var current int64
+	for i, delta := range deltas {
+		current += delta
+		buckets[i] = float64(current)
+	}
+	return buckets
+}
+
+func countSpans(spans []Span) int {
+	var n int
+	for _, s := range spans {
+		n += int(s.Length)
+	}
+	return n
+}
+
+func readSpans(b *bstreamReader) ([]Span, error) {
+	n, err := readVarbitUint(b)
+	if err != nil {
+		return nil, err
+	}
+	var spans []Span
+	for i := uint64(0); i < n; i++ {
+		length, err := readVarbitUint(b)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := readVarbitInt(b)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, Span{Offset: int32(offset), Length: uint32(length)})
+	}
+	return spans, nil
+}
+
+// readZeroThreshold reads a zero threshold, which is stored as a single byte
+// for powers of two and as a full float64 otherwise.
+func readZeroThreshold(br *bstreamReader) (float64, error) {
+	b, err := br.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch b {
+	case 0:
+		return 0, nil
+	case 255:
+		v, err := br.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		return math.Float64frombits(v), nil
+	}
+	return math.Ldexp(0.5, int(b)-243), nil
+}
+
+// readCustomBound reads a custom bucket bound, which is stored as a varbit of
+// 1000 times the bound plus one for small multiples of 0.001, and as a zero
+// followed by a full float64 otherwise.
+func readCustomBound(br *bstreamReader) (float64, error) {
+	b, err := readVarbitUint(br)
+	if err != nil {
+		return 0, err
+	}
+	if b == 0 {
+		v, err := br.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		return math.Float64frombits(v), nil
+	}
+	return float64(b-1) / 1000, nil
+}
+
+// errIterator is the iterator of histogram chunks, which must not be read as
+// float samples.
+type errIterator struct{}
+
+func (errIterator) Next() bool { return false }
+
+func (errIterator) At() (int64, float64) { return 0, 0 }
+
+func (errIterator) Err() error { return ErrNotFloatChunk }
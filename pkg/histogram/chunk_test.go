@@ -0,0 +1,104 @@
+package histogram
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// The chunks below were written by the appenders of Prometheus v2.54.
+const (
+	histogramChunk      = "000400ff3f50624dd2f1a9fc8ca48c631bf8fa31400000000000000008c6ef1f44e388bfff1243097ffc06b13400"
+	floatHistogramChunk = "0003c000ee5c644b8cbe5ddf813884004000000000000000000000000000000000000000000003fe00000000000004000000000000000f0fa6c06c284024eb0b3589e8008309bfff00"
+)
+
+func decodeChunk(t *testing.T, enc int, s string) ([]int64, []*FloatHistogram) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChunk(chunkEncoding(enc), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps, histograms, err := c.Histograms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != c.NumSamples() {
+		t.Fatalf("expected %d samples, got %d", c.NumSamples(), len(timestamps))
+	}
+	return timestamps, histograms
+}
+
+func TestHistogramChunk(t *testing.T) {
+	timestamps, histograms := decodeChunk(t, EncHistogram, histogramChunk)
+	if !reflect.DeepEqual(timestamps, []int64{1000, 2000, 3000, 4000}) {
+		t.Fatalf("unexpected timestamps %v", timestamps)
+	}
+	for i, h := range histograms {
+		hint := "not_reset"
+		if i == 0 {
+			hint = "unknown"
+		}
+		want := &FloatHistogram{
+			CounterResetHint: hint,
+			Schema:           1,
+			ZeroThreshold:    0.001,
+			ZeroCount:        float64(i),
+			Count:            float64(10 + 3*i),
+			Sum:              1.5 * float64(i),
+			PositiveSpans:    []Span{{Offset: 0, Length: 2}, {Offset: 1, Length: 1}},
+			NegativeSpans:    []Span{{Offset: -1, Length: 1}},
+			PositiveBuckets:  []float64{float64(1 + i), float64(2 + i), float64(1 + i)},
+			NegativeBuckets:  []float64{float64(2 * i)},
+		}
+		if !reflect.DeepEqual(h, want) {
+			t.Fatalf("sample %d: expected %+v, got %+v", i, want, h)
+		}
+	}
+}
+
+func TestFloatHistogramChunk(t *testing.T) {
+	timestamps, histograms := decodeChunk(t, EncFloatHistogram, floatHistogramChunk)
+	if !reflect.DeepEqual(timestamps, []int64{5000, 5500, 6000}) {
+		t.Fatalf("unexpected timestamps %v", timestamps)
+	}
+	for i, h := range histograms {
+		want := &FloatHistogram{
+			CounterResetHint: "gauge",
+			Schema:           CustomBucketsSchema,
+			Count:            2.5 + float64(i),
+			Sum:              10.25 * float64(i),
+			PositiveSpans:    []Span{{Offset: 0, Length: 2}},
+			PositiveBuckets:  []float64{0.5 + float64(i), 2},
+			NegativeBuckets:  []float64{},
+			CustomValues:     []float64{0.1, 1.5},
+		}
+		if !reflect.DeepEqual(h, want) {
+			t.Fatalf("sample %d: expected %+v, got %+v", i, want, h)
+		}
+	}
+}
+
+func chunkEncoding(enc int) chunkenc.Encoding { return chunkenc.Encoding(enc) }
+
+func TestChunkIterator(t *testing.T) {
+	b, err := hex.DecodeString(histogramChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChunk(EncHistogram, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := c.Iterator(nil)
+	if it.Next() {
+		t.Fatal("expected no float samples")
+	}
+	if it.Err() != ErrNotFloatChunk {
+		t.Fatalf("expected ErrNotFloatChunk, got %v", it.Err())
+	}
+}
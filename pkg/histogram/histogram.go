@@ -0,0 +1,55 @@
+// Package histogram decodes the native histogram chunks written by
+// Prometheus v2.40 and later, which the vendored TSDB does not know about.
+package histogram
+
+import (
+	"math"
+)
+
+// Chunk encodings of histograms, following chunkenc.EncXOR.
+const (
+	EncHistogram      = 2
+	EncFloatHistogram = 3
+)
+
+// staleNaN is the value of the sum of a histogram that marks a series as
+// stale.
+const staleNaN uint64 = 0x7ff0000000000002
+
+// CustomBucketsSchema is the schema of histograms with custom bucket
+// boundaries, which are stored in CustomValues.
+const CustomBucketsSchema = -53
+
+// Span is a run of consecutive buckets, starting Offset buckets after the end
+// of the previous span.
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+// FloatHistogram is a sparse native histogram. The counts of integer
+// histograms are converted to floats, and bucket counts are absolute rather
+// than deltas to the previous bucket.
+type FloatHistogram struct {
+	// CounterResetHint is one of "unknown", "reset", "not_reset" or
+	// "gauge".
+	CounterResetHint string
+	Schema           int32
+	ZeroThreshold    float64
+	ZeroCount        float64
+	Count            float64
+	Sum              float64
+	PositiveSpans    []Span
+	NegativeSpans    []Span
+	PositiveBuckets  []float64
+	NegativeBuckets  []float64
+	// CustomValues are the upper bounds of the buckets of histograms with
+	// custom buckets.
+	CustomValues []float64
+}
+
+// IsStale reports whether the histogram is a staleness marker rather than an
+// observed value.
+func (h *FloatHistogram) IsStale() bool {
+	return math.Float64bits(h.Sum) == staleNaN
+}
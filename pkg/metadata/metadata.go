@@ -0,0 +1,214 @@
+// Package metadata provides the type, help and unit of metrics, which TSDB
+// blocks do not store, to writers of formats that carry them.
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// Metric types, as named by OpenMetrics and the Prometheus metadata API.
+const (
+	TypeCounter        = "counter"
+	TypeGauge          = "gauge"
+	TypeHistogram      = "histogram"
+	TypeGaugeHistogram = "gaugehistogram"
+	TypeSummary        = "summary"
+	TypeInfo           = "info"
+	TypeStateset       = "stateset"
+	TypeUnknown        = "unknown"
+)
+
+// typeSuffixes are the suffixes the series of a metric family of each type
+// add to the family name, where "" is a series named after the family.
+var typeSuffixes = map[string][]string{
+	TypeCounter:        {"_total", "_created"},
+	TypeGauge:          {""},
+	TypeHistogram:      {"_bucket", "_count", "_sum", "_created"},
+	TypeGaugeHistogram: {"_bucket", "_gcount", "_gsum"},
+	TypeSummary:        {"", "_count", "_sum", "_created"},
+	TypeInfo:           {"_info"},
+	TypeStateset:       {""},
+	TypeUnknown:        {""},
+}
+
+var seriesSuffixes = []string{"_total", "_created", "_bucket", "_count", "_sum", "_gcount", "_gsum", "_info"}
+
+// Metadata describes a metric family.
+type Metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// Store holds metadata by metric family name. A nil Store holds none.
+type Store struct {
+	m map[string]Metadata
+}
+
+func NewStore() *Store {
+	return &Store{m: map[string]Metadata{}}
+}
+
+// Set sets the metadata of the metric family name.
+func (s *Store) Set(name string, md Metadata) {
+	s.m[name] = md
+}
+
+// Len returns the number of metric families in the store.
+func (s *Store) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.m)
+}
+
+// Merge adds the metric families of other that s does not hold.
+func (s *Store) Merge(other *Store) {
+	if other == nil {
+		return
+	}
+	for name, md := range other.m {
+		if _, ok := s.m[name]; !ok {
+			s.m[name] = md
+		}
+	}
+}
+
+// Get returns the metadata of the metric family name.
+func (s *Store) Get(name string) (Metadata, bool) {
+	if s == nil {
+		return Metadata{}, false
+	}
+	md, ok := s.m[name]
+	return md, ok
+}
+
+// Lookup returns the metric family the series named name belongs to and its
+// metadata. Series of histograms, summaries and counters are found under the
+// family name without their suffix, and counters are also found under the
+// name of their _total series, as Prometheus names them in its text format.
+// A series that is not a valid series of the type of its family, such as a
+// counter without _total, is returned with type unknown.
+func (s *Store) Lookup(name string) (string, Metadata, bool) {
+	if s == nil {
+		return "", Metadata{}, false
+	}
+	if md, ok := s.m[name]; ok {
+		for _, suffix := range typeSuffixes[md.Type] {
+			if strings.HasSuffix(name, suffix) {
+				return strings.TrimSuffix(name, suffix), md, true
+			}
+		}
+		md.Type = TypeUnknown
+		return name, md, true
+	}
+	for _, suffix := range seriesSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		family := strings.TrimSuffix(name, suffix)
+		md, ok := s.m[family]
+		if !ok {
+			continue
+		}
+		for _, typeSuffix := range typeSuffixes[md.Type] {
+			if typeSuffix == suffix {
+				return family, md, true
+			}
+		}
+	}
+	return "", Metadata{}, false
+}
+
+// Load reads metadata from the file at path, which holds either a response of
+// the Prometheus /api/v1/metadata API or only its "data" object.
+func Load(path string) (*Store, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := Parse(f)
+	if err != nil {
+		return nil, pkgerrors.Wrapf(err, "parse %s", path)
+	}
+	return s, nil
+}
+
+// Parse reads metadata in the format of Load. The data object maps metric
+// names to a list of metadata, of which the first entry is used, or to a
+// single metadata object.
+func Parse(r io.Reader) (*Store, error) {
+	var top map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&top); err != nil {
+		return nil, err
+	}
+	if data, ok := top["data"]; ok {
+		if _, ok := top["status"]; ok {
+			top = nil
+			if err := json.Unmarshal(data, &top); err != nil {
+				return nil, pkgerrors.Wrap(err, "decode data")
+			}
+		}
+	}
+
+	s := NewStore()
+	for name, raw := range top {
+		var md Metadata
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			var mds []Metadata
+			if err := json.Unmarshal(raw, &mds); err != nil {
+				return nil, pkgerrors.Wrapf(err, "decode metadata of %s", name)
+			}
+			if len(mds) == 0 {
+				continue
+			}
+			md = mds[0]
+		} else if err := json.Unmarshal(raw, &md); err != nil {
+			return nil, pkgerrors.Wrapf(err, "decode metadata of %s", name)
+		}
+		if md.Type == "" {
+			md.Type = TypeUnknown
+		}
+		if _, ok := typeSuffixes[md.Type]; !ok {
+			return nil, fmt.Errorf("invalid type of %s: %s", name, md.Type)
+		}
+		s.Set(name, md)
+	}
+	return s, nil
+}
+
+// Infer guesses the types of metrics from the names of their series, names,
+// following the naming conventions of Prometheus client libraries: series
+// ending with _total are counters and series ending with _bucket, _count and
+// _sum are histograms. Series ending with _count and _sum but no _bucket are
+// summaries if there is also a series named after the family, and are left
+// alone otherwise.
+func Infer(names []string) *Store {
+	exists := map[string]bool{}
+	for _, name := range names {
+		exists[name] = true
+	}
+	s := NewStore()
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, "_total"):
+			s.Set(strings.TrimSuffix(name, "_total"), Metadata{Type: TypeCounter})
+		case strings.HasSuffix(name, "_bucket"):
+			s.Set(strings.TrimSuffix(name, "_bucket"), Metadata{Type: TypeHistogram})
+		case strings.HasSuffix(name, "_count"), strings.HasSuffix(name, "_sum"):
+			family := strings.TrimSuffix(strings.TrimSuffix(name, "_count"), "_sum")
+			if !exists[family+"_bucket"] && exists[family] {
+				s.Set(family, Metadata{Type: TypeSummary})
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package metadata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, in := range []string{
+		`{"status": "success", "data": {"a_total": [{"type": "counter", "help": "A.", "unit": ""}, {"type": "gauge", "help": "", "unit": ""}]}}`,
+		`{"a_total": [{"type": "counter", "help": "A.", "unit": ""}]}`,
+		`{"a_total": {"type": "counter", "help": "A."}}`,
+	} {
+		s, err := Parse(strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		family, md, ok := s.Lookup("a_total")
+		if !ok || family != "a" || md != (Metadata{Type: TypeCounter, Help: "A."}) {
+			t.Errorf("%s: got %q %+v %v", in, family, md, ok)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader(`{"a": {"type": "Counter"}}`)); err == nil {
+		t.Error("expected an error for an invalid type")
+	}
+}
+
+func TestInfer(t *testing.T) {
+	s := Infer([]string{
+		"requests_total",
+		"latency_bucket", "latency_count", "latency_sum",
+		"rpc", "rpc_count", "rpc_sum",
+		"items_count",
+		"up",
+	})
+	tests := []struct {
+		name   string
+		family string
+		typ    string
+	}{
+		{"requests_total", "requests", TypeCounter},
+		{"latency_bucket", "latency", TypeHistogram},
+		{"latency_sum", "latency", TypeHistogram},
+		{"rpc", "rpc", TypeSummary},
+		{"rpc_count", "rpc", TypeSummary},
+		{"items_count", "", ""},
+		{"up", "", ""},
+	}
+	for _, tt := range tests {
+		family, md, _ := s.Lookup(tt.name)
+		if family != tt.family || md.Type != tt.typ {
+			t.Errorf("%s: expected %q %q, got %q %q", tt.name, tt.family, tt.typ, family, md.Type)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Package redact anonymizes label values before series are written, so that
+// blocks can be shared without leaking hostnames, customer IDs or addresses.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// DefaultReplacement is the value labels selected by Options.Replace get if
+// Options.Replacement is empty.
+const DefaultReplacement = "redacted"
+
+// hashLength is the number of hex digits of a hashed value.
+const hashLength = 16
+
+// Options selects the labels to redact. Every entry of Hash, Replace and Drop
+// is a label name or, if it starts with ~, a regular expression matching
+// whole label names. Regular expressions never match __name__. A label
+// selected by several options is dropped rather than replaced, and replaced
+// rather than hashed.
+type Options struct {
+	// Hash replaces values with a truncated HMAC-SHA256 of them, keyed with
+	// Key, so the same value is hashed the same across labels and runs.
+	Hash []string
+	Key  []byte
+	// Replace replaces values with Replacement.
+	Replace     []string
+	Replacement string
+	// Drop removes labels.
+	Drop []string
+
+	// HashValues, ReplaceValues and DropValues are regular expressions
+	// matched against the values of all labels but __name__, to redact
+	// values such as IP addresses wherever they appear. HashValues and
+	// ReplaceValues replace every match within a value with its hash or
+	// Replacement, and DropValues removes labels whose value it matches.
+	// They apply to labels not selected by name.
+	HashValues    string
+	ReplaceValues string
+	DropValues    string
+
+	// AllowMerge lets series be written whose redacted labels equal those of
+	// another series, such that they are merged in the output. Otherwise
+	// the writers returned by NewWriter fail on such a series.
+	AllowMerge bool
+}
+
+// Redactor redacts the labels of series. It must not be used concurrently.
+type Redactor struct {
+	hash        []nameMatcher
+	replace     []nameMatcher
+	drop        []nameMatcher
+	hashRe      *regexp.Regexp
+	replaceRe   *regexp.Regexp
+	dropRe      *regexp.Regexp
+	mac         hash.Hash
+	replacement string
+	allowMerge  bool
+
+	// redacted maps the hash of every redacted label set to the hash of the
+	// first label set redacted to it, to find series that are merged.
+	redacted map[uint64]uint64
+	merged   map[uint64]bool
+}
+
+type nameMatcher struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func (m nameMatcher) matches(name string) bool {
+	if m.re == nil {
+		return m.name == name
+	}
+	return name != labels.MetricName && m.re.MatchString(name)
+}
+
+func newNameMatchers(entries []string) ([]nameMatcher, error) {
+	var ms []nameMatcher
+	for _, e := range entries {
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, "~") {
+			ms = append(ms, nameMatcher{name: e})
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + e[1:] + ")$")
+		if err != nil {
+			return nil, pkgerrors.Wrapf(err, "label regex %s", e[1:])
+		}
+		ms = append(ms, nameMatcher{re: re})
+	}
+	return ms, nil
+}
+
+func compileValueRegex(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, pkgerrors.Wrapf(err, "value regex %s", expr)
+	}
+	return re, nil
+}
+
+// New creates a Redactor.
+func New(opts Options) (*Redactor, error) {
+	r := &Redactor{
+		replacement: opts.Replacement,
+		allowMerge:  opts.AllowMerge,
+		redacted:    map[uint64]uint64{},
+		merged:      map[uint64]bool{},
+	}
+	if r.replacement == "" {
+		r.replacement = DefaultReplacement
+	}
+	var err error
+	if r.hash, err = newNameMatchers(opts.Hash); err != nil {
+		return nil, err
+	}
+	if r.replace, err = newNameMatchers(opts.Replace); err != nil {
+		return nil, err
+	}
+	if r.drop, err = newNameMatchers(opts.Drop); err != nil {
+		return nil, err
+	}
+	if r.hashRe, err = compileValueRegex(opts.HashValues); err != nil {
+		return nil, err
+	}
+	if r.replaceRe, err = compileValueRegex(opts.ReplaceValues); err != nil {
+		return nil, err
+	}
+	if r.dropRe, err = compileValueRegex(opts.DropValues); err != nil {
+		return nil, err
+	}
+	for _, m := range r.drop {
+		if m.name == labels.MetricName {
+			return nil, fmt.Errorf("%s cannot be dropped", labels.MetricName)
+		}
+	}
+	if len(r.hash) > 0 || r.hashRe != nil {
+		if len(opts.Key) == 0 {
+			return nil, fmt.Errorf("a key is required to hash labels")
+		}
+		r.mac = hmac.New(sha256.New, opts.Key)
+	}
+	return r, nil
+}
+
+// Labels returns a redacted copy of lset.
+func (r *Redactor) Labels(lset labels.Labels) labels.Labels {
+	res := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		switch {
+		case matchesAny(r.drop, l.Name):
+			continue
+		case matchesAny(r.replace, l.Name):
+			l.Value = r.replacement
+		case matchesAny(r.hash, l.Name):
+			l.Value = r.hashValue(l.Value)
+		case l.Name == labels.MetricName:
+			// Metric names are only redacted by name.
+		case r.dropRe != nil && r.dropRe.MatchString(l.Value):
+			continue
+		default:
+			if r.replaceRe != nil {
+				l.Value = r.replaceRe.ReplaceAllLiteralString(l.Value, r.replacement)
+			}
+			if r.hashRe != nil {
+				l.Value = r.hashRe.ReplaceAllStringFunc(l.Value, r.hashValue)
+			}
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// series returns the redacted labels of a series that is written, recording
+// whether it is merged with another series. It fails for merged series unless
+// Options.AllowMerge is set.
+func (r *Redactor) series(lset labels.Labels) (labels.Labels, error) {
+	res := r.Labels(lset)
+	h, rh := lset.Hash(), res.Hash()
+	first, ok := r.redacted[rh]
+	if !ok {
+		r.redacted[rh] = h
+		return res, nil
+	}
+	if first == h {
+		return res, nil
+	}
+	r.merged[h] = true
+	if !r.allowMerge {
+		return nil, fmt.Errorf("series %s has the same labels as another series after redaction", res)
+	}
+	return res, nil
+}
+
+// MergedSeries returns the number of series written whose redacted labels
+// equal those of another series written before, such that they cannot be told
+// apart in the output.
+func (r *Redactor) MergedSeries() int {
+	return len(r.merged)
+}
+
+func (r *Redactor) hashValue(v string) string {
+	r.mac.Reset()
+	r.mac.Write([]byte(v))
+	return hex.EncodeToString(r.mac.Sum(nil))[:hashLength]
+}
+
+func matchesAny(ms []nameMatcher, name string) bool {
+	for _, m := range ms {
+		if m.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWriter returns a Writer that redacts the labels of every series before
+// passing it on to w.
+func NewWriter(w writer.Writer, r *Redactor) writer.Writer {
+	rw := &redactingWriter{w: w, r: r}
+	if hw, ok := w.(writer.HistogramWriter); ok {
+		return &redactingHistogramWriter{redactingWriter: rw, hw: hw}
+	}
+	return rw
+}
+
+type redactingWriter struct {
+	w writer.Writer
+	r *Redactor
+}
+
+func (w *redactingWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	redacted, err := w.r.series(*lset)
+	if err != nil {
+		return err
+	}
+	return w.w.Write(&redacted, timestamps, values)
+}
+
+func (w *redactingWriter) Close() error {
+	return w.w.Close()
+}
+
+type redactingHistogramWriter struct {
+	*redactingWriter
+	hw writer.HistogramWriter
+}
+
+func (w *redactingHistogramWriter) WriteHistograms(lset *labels.Labels, timestamps []int64, histograms []*histogram.FloatHistogram) error {
+	redacted, err := w.r.series(*lset)
+	if err != nil {
+		return err
+	}
+	return w.hw.WriteHistograms(&redacted, timestamps, histograms)
+}
@@ -0,0 +1,107 @@
+package redact
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/writer"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestRedactor(t *testing.T) {
+	r, err := New(Options{
+		Hash:    []string{"instance", "~.*_ip"},
+		Key:     []byte("secret"),
+		Replace: []string{"customer", "~.*_ip"},
+		Drop:    []string{"~pod|node"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lset := labels.FromStrings("__name__", "up", "customer", "acme", "instance", "host-1:9100", "node", "n1", "pod", "p1", "src_ip", "10.0.0.1")
+	got := r.Labels(lset)
+	// The hash is the truncated hex HMAC-SHA256 of the value.
+	want := labels.FromStrings("__name__", "up", "customer", "redacted", "instance", "17e8638c34de7097", "src_ip", "redacted")
+	if !labels.Equal(got, want) {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if lset.Get("instance") != "host-1:9100" {
+		t.Fatal("labels were modified in place")
+	}
+
+	// Series that only differ in dropped labels are merged, however often
+	// they are written.
+	other := labels.FromStrings("__name__", "up", "customer", "acme", "instance", "host-1:9100", "node", "n2", "src_ip", "10.0.0.1")
+	for i := 0; i < 2; i++ {
+		if _, err := r.series(lset); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.series(other); err == nil {
+			t.Fatal("expected an error for a merged series")
+		}
+	}
+	if r.MergedSeries() != 1 {
+		t.Fatalf("expected 1 merged series, got %d", r.MergedSeries())
+	}
+	r.allowMerge = true
+	if _, err := r.series(other); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = New(Options{
+		Key:           []byte("secret"),
+		HashValues:    `\d+\.\d+\.\d+\.\d+`,
+		ReplaceValues: `cust-\d+`,
+		DropValues:    `^secret-`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lset = labels.FromStrings("__name__", "up_10.0.0.1", "instance", "10.0.0.1:9100", "path", "/customers/cust-42/orders", "token", "secret-abc", "job", "node")
+	got = r.Labels(lset)
+	want = labels.FromStrings("__name__", "up_10.0.0.1", "instance", "eb5a0e55d511c2fe:9100", "path", "/customers/redacted/orders", "job", "node")
+	if !labels.Equal(got, want) {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	if _, err := New(Options{Hash: []string{"instance"}}); err == nil {
+		t.Fatal("expected an error for hashing without a key")
+	}
+	if _, err := New(Options{Drop: []string{"__name__"}}); err == nil {
+		t.Fatal("expected an error for dropping __name__")
+	}
+	if _, err := New(Options{Drop: []string{"~("}}); err == nil {
+		t.Fatal("expected an error for an invalid regex")
+	}
+	if _, err := New(Options{HashValues: "."}); err == nil {
+		t.Fatal("expected an error for hashing values without a key")
+	}
+	if _, err := New(Options{DropValues: "("}); err == nil {
+		t.Fatal("expected an error for an invalid value regex")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	r, err := New(Options{Drop: []string{"~.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	jw, err := writer.NewWriter("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(jw, r)
+	if _, ok := w.(writer.HistogramWriter); !ok {
+		t.Fatal("histogram support of the json writer was lost")
+	}
+	lset := labels.FromStrings("__name__", "up", "instance", "a")
+	if err := w.Write(&lset, []int64{1}, []float64{1}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `{"metric":{"__name__":"up"},"values":[1],"timestamps":[1]}`+"\n"; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,51 @@
+package writer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// gzipBlockSize is the size of the blocks compressed in parallel by gzip.
+const gzipBlockSize = 1 << 20
+
+// NewCompressedWriter wraps out with a compressing writer for the given
+// compression: "gzip", "zstd" or "snappy" (the framed snappy format). All of
+// them compress blocks in parallel on all CPUs. Close must be called to flush
+// the compressed stream; it does not close out.
+func NewCompressedWriter(out io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "gzip":
+		w := pgzip.NewWriter(out)
+		if err := w.SetConcurrency(gzipBlockSize, runtime.GOMAXPROCS(0)); err != nil {
+			return nil, err
+		}
+		return w, nil
+	case "zstd":
+		return zstd.NewWriter(out, zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)))
+	case "snappy":
+		return s2.NewWriter(out, s2.WriterSnappyCompat()), nil
+	default:
+		return nil, fmt.Errorf("invalid compression: %s", compression)
+	}
+}
+
+// CompressionFromExtension returns the compression implied by the extension
+// of a file name, or "" if it does not imply one.
+func CompressionFromExtension(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz", ".gzip":
+		return "gzip"
+	case ".zst", ".zstd":
+		return "zstd"
+	case ".sz", ".snappy":
+		return "snappy"
+	}
+	return ""
+}
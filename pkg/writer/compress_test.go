@@ -0,0 +1,71 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNewCompressedWriter(t *testing.T) {
+	data := []byte(strings.Repeat(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1578636058619]}`+"\n", 100000))
+	for _, compression := range []string{"gzip", "zstd", "snappy"} {
+		var buf bytes.Buffer
+		w, err := NewCompressedWriter(&buf, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() >= len(data) {
+			t.Fatalf("%s: output of %d bytes is not compressed", compression, buf.Len())
+		}
+
+		var r io.Reader
+		switch compression {
+		case "gzip":
+			r, err = gzip.NewReader(&buf)
+		case "zstd":
+			r, err = zstd.NewReader(&buf)
+		case "snappy":
+			r = s2.NewReader(&buf)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %s", compression, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: decompressed output differs from input", compression)
+		}
+	}
+
+	if _, err := NewCompressedWriter(&bytes.Buffer{}, "lz4"); err == nil {
+		t.Fatal("expected an error for an unknown compression")
+	}
+}
+
+func TestCompressionFromExtension(t *testing.T) {
+	for name, want := range map[string]string{
+		"dump.json.gz":  "gzip",
+		"dump.json.ZST": "zstd",
+		"dump.sz":       "snappy",
+		"dump.json":     "",
+		"dump":          "",
+	} {
+		if got := CompressionFromExtension(name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
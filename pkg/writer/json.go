@@ -0,0 +1,114 @@
+package writer
+
+import (
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// JSONWriter writes float samples in the same lines as VictoriaMetricsWriter
+// and native histograms in lines with a "histograms" array instead of
+// "values".
+type JSONWriter struct {
+	*VictoriaMetricsWriter
+}
+
+func NewJSONWriter(out io.Writer) (*JSONWriter, error) {
+	vm, err := NewVictoriaMetricsWriter(out)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONWriter{VictoriaMetricsWriter: vm}, nil
+}
+
+type histogramLine struct {
+	Metric     map[string]string `json:"metric"`
+	Histograms []JSONHistogram   `json:"histograms"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// JSONHistogram is a native histogram as the json format writes it.
+type JSONHistogram struct {
+	CounterResetHint string      `json:"counterResetHint"`
+	Schema           int32       `json:"schema"`
+	ZeroThreshold    jsonFloat   `json:"zeroThreshold"`
+	ZeroCount        jsonFloat   `json:"zeroCount"`
+	Count            jsonFloat   `json:"count"`
+	Sum              jsonFloat   `json:"sum"`
+	PositiveSpans    []jsonSpan  `json:"positiveSpans,omitempty"`
+	PositiveBuckets  []jsonFloat `json:"positiveBuckets,omitempty"`
+	NegativeSpans    []jsonSpan  `json:"negativeSpans,omitempty"`
+	NegativeBuckets  []jsonFloat `json:"negativeBuckets,omitempty"`
+	CustomValues     []jsonFloat `json:"customValues,omitempty"`
+}
+
+type jsonSpan struct {
+	Offset int32  `json:"offset"`
+	Length uint32 `json:"length"`
+}
+
+// jsonFloat encodes NaN and infinite values, which JSON numbers cannot
+// represent, as the strings "NaN", "+Inf" and "-Inf".
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+}
+
+func jsonFloats(fs []float64) []jsonFloat {
+	out := make([]jsonFloat, len(fs))
+	for i, f := range fs {
+		out[i] = jsonFloat(f)
+	}
+	return out
+}
+
+func jsonSpans(spans []histogram.Span) []jsonSpan {
+	out := make([]jsonSpan, len(spans))
+	for i, s := range spans {
+		out[i] = jsonSpan{Offset: s.Offset, Length: s.Length}
+	}
+	return out
+}
+
+// NewJSONHistogram returns h as the json format writes it.
+func NewJSONHistogram(h *histogram.FloatHistogram) JSONHistogram {
+	return JSONHistogram{
+		CounterResetHint: h.CounterResetHint,
+		Schema:           h.Schema,
+		ZeroThreshold:    jsonFloat(h.ZeroThreshold),
+		ZeroCount:        jsonFloat(h.ZeroCount),
+		Count:            jsonFloat(h.Count),
+		Sum:              jsonFloat(h.Sum),
+		PositiveSpans:    jsonSpans(h.PositiveSpans),
+		PositiveBuckets:  jsonFloats(h.PositiveBuckets),
+		NegativeSpans:    jsonSpans(h.NegativeSpans),
+		NegativeBuckets:  jsonFloats(h.NegativeBuckets),
+		CustomValues:     jsonFloats(h.CustomValues),
+	}
+}
+
+func (w *JSONWriter) WriteHistograms(lset *labels.Labels, timestamps []int64, histograms []*histogram.FloatHistogram) error {
+	metric := map[string]string{}
+	for _, l := range *lset {
+		metric[l.Name] = l.Value
+	}
+	hs := make([]JSONHistogram, len(histograms))
+	for i, h := range histograms {
+		hs[i] = NewJSONHistogram(h)
+	}
+	return w.VictoriaMetricsWriter.enc.Encode(histogramLine{Metric: metric, Histograms: hs, Timestamps: timestamps})
+}
@@ -0,0 +1,53 @@
+package writer
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.(HistogramWriter); !ok {
+		t.Fatal("json writer does not support histograms")
+	}
+	lset := labels.FromStrings("__name__", "a")
+	if err := w.Write(&lset, []int64{1000}, []float64{1}); err != nil {
+		t.Fatal(err)
+	}
+	h := &histogram.FloatHistogram{
+		CounterResetHint: "unknown",
+		Count:            2,
+		Sum:              math.NaN(),
+		PositiveSpans:    []histogram.Span{{Offset: 1, Length: 2}},
+		PositiveBuckets:  []float64{1, 1},
+	}
+	if err := w.(HistogramWriter).WriteHistograms(&lset, []int64{2000}, []*histogram.FloatHistogram{h}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"metric":{"__name__":"a"},"values":[1],"timestamps":[1000]}
+{"metric":{"__name__":"a"},"histograms":[{"counterResetHint":"unknown","schema":0,"zeroThreshold":0,"zeroCount":0,"count":2,"sum":"NaN","positiveSpans":[{"offset":1,"length":2}],"positiveBuckets":[1,1]}],"timestamps":[2000]}
+`
+	if buf.String() != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+
+	vm, err := NewWriter("victoriametrics", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vm.(HistogramWriter); ok {
+		t.Fatal("victoriametrics writer must not support histograms")
+	}
+}
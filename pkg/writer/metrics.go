@@ -0,0 +1,101 @@
+package writer
+
+import (
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+var (
+	samplesWrittenTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_writer_samples_written_total",
+		Help: "Total number of samples written by each writer.",
+	}, []string{"format"})
+	writeErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_writer_write_errors_total",
+		Help: "Total number of failed writes by each writer.",
+	}, []string{"format"})
+	writeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometheus_tsdb_dump_writer_write_duration_seconds",
+		Help:    "Latency of writes by each writer.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"format"})
+	pushRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_writer_push_requests_total",
+		Help: "Total number of requests sent to the VictoriaMetrics import API.",
+	})
+	pushRequestFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_dump_writer_push_request_failures_total",
+		Help: "Total number of failed requests to the VictoriaMetrics import API, including retried ones.",
+	})
+)
+
+// RegisterMetrics registers the metrics of the writers in this package.
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(samplesWrittenTotal, writeErrorsTotal, writeDuration, pushRequestsTotal, pushRequestFailuresTotal)
+}
+
+// instrumentedWriter records metrics for every write to the wrapped writer.
+type instrumentedWriter struct {
+	w       Writer
+	samples prometheus.Counter
+	errors  prometheus.Counter
+	latency prometheus.Observer
+}
+
+func newInstrumentedWriter(w Writer, format string) Writer {
+	iw := &instrumentedWriter{
+		w:       w,
+		samples: samplesWrittenTotal.WithLabelValues(format),
+		errors:  writeErrorsTotal.WithLabelValues(format),
+		latency: writeDuration.WithLabelValues(format),
+	}
+	if hw, ok := w.(HistogramWriter); ok {
+		return &instrumentedHistogramWriter{instrumentedWriter: iw, hw: hw}
+	}
+	return iw
+}
+
+func (w *instrumentedWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	start := time.Now()
+	err := w.w.Write(lset, timestamps, values)
+	w.latency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		w.errors.Inc()
+		return err
+	}
+	w.samples.Add(float64(len(values)))
+	return nil
+}
+
+func (w *instrumentedWriter) Close() error { return w.w.Close() }
+
+// Abort aborts the wrapped writer if it implements Aborter.
+func (w *instrumentedWriter) Abort() error {
+	if a, ok := w.w.(Aborter); ok {
+		return a.Abort()
+	}
+	return nil
+}
+
+// instrumentedHistogramWriter additionally records metrics for histograms,
+// counting every histogram as a sample.
+type instrumentedHistogramWriter struct {
+	*instrumentedWriter
+	hw HistogramWriter
+}
+
+func (w *instrumentedHistogramWriter) WriteHistograms(lset *labels.Labels, timestamps []int64, histograms []*histogram.FloatHistogram) error {
+	start := time.Now()
+	err := w.hw.WriteHistograms(lset, timestamps, histograms)
+	w.latency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		w.errors.Inc()
+		return err
+	}
+	w.samples.Add(float64(len(histograms)))
+	return nil
+}
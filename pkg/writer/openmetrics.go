@@ -0,0 +1,262 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// OpenMetricsWriter writes samples in the OpenMetrics text format with a
+// timestamp each, as read by promtool tsdb create-blocks-from openmetrics.
+// The # TYPE, # HELP and # UNIT lines of a metric family are written before
+// its first series if the family is found in the metadata. Native histograms
+// are written as classic histograms.
+type OpenMetricsWriter struct {
+	out      io.Writer
+	md       *metadata.Store
+	families map[string]bool
+	buf      bytes.Buffer
+}
+
+// NewOpenMetricsWriter creates an OpenMetricsWriter. md may be nil, in which
+// case every metric is written without metadata.
+func NewOpenMetricsWriter(out io.Writer, md *metadata.Store) (*OpenMetricsWriter, error) {
+	return &OpenMetricsWriter{out: out, md: md, families: map[string]bool{}}, nil
+}
+
+func (w *OpenMetricsWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	name := lset.Get(labels.MetricName)
+	if name == "" {
+		return fmt.Errorf("series without %s: %s", labels.MetricName, lset.String())
+	}
+
+	w.buf.Reset()
+	if family, md, ok := w.md.Lookup(name); ok {
+		w.writeFamily(family, md)
+	}
+
+	series := openMetricsSeries(name, lset, "")
+	for i, t := range timestamps {
+		w.writeSample(series, values[i], t)
+	}
+	_, err := w.out.Write(w.buf.Bytes())
+	return err
+}
+
+// WriteHistograms writes native histograms as the _bucket, _count and _sum
+// series of a classic histogram, or the _bucket, _gcount and _gsum series of
+// a gauge histogram, with a cumulative bucket for the upper bound of every
+// populated bucket. Staleness markers are skipped.
+func (w *OpenMetricsWriter) WriteHistograms(lset *labels.Labels, timestamps []int64, histograms []*histogram.FloatHistogram) error {
+	name := lset.Get(labels.MetricName)
+	if name == "" {
+		return fmt.Errorf("series without %s: %s", labels.MetricName, lset.String())
+	}
+
+	w.buf.Reset()
+	typ := metadata.TypeHistogram
+	if len(histograms) > 0 && histograms[0].CounterResetHint == "gauge" {
+		typ = metadata.TypeGaugeHistogram
+	}
+	md, _ := w.md.Get(name)
+	md.Type = typ
+	w.writeFamily(name, md)
+
+	countSuffix, sumSuffix := "_count", "_sum"
+	if typ == metadata.TypeGaugeHistogram {
+		countSuffix, sumSuffix = "_gcount", "_gsum"
+	}
+	count := openMetricsSeries(name+countSuffix, lset, "")
+	sum := openMetricsSeries(name+sumSuffix, lset, "")
+	for i, h := range histograms {
+		if h.IsStale() {
+			continue
+		}
+		t := timestamps[i]
+		for _, b := range classicBuckets(h) {
+			w.writeSample(openMetricsSeries(name+"_bucket", lset, formatOpenMetricsValue(b.le)), b.count, t)
+		}
+		w.writeSample(count, h.Count, t)
+		w.writeSample(sum, h.Sum, t)
+	}
+	_, err := w.out.Write(w.buf.Bytes())
+	return err
+}
+
+// writeFamily writes the metadata lines of a metric family before its first
+// series.
+func (w *OpenMetricsWriter) writeFamily(family string, md metadata.Metadata) {
+	if w.families[family] {
+		return
+	}
+	w.families[family] = true
+	if md.Type != metadata.TypeUnknown && md.Type != "" {
+		fmt.Fprintf(&w.buf, "# TYPE %s %s\n", family, md.Type)
+	}
+	if md.Help != "" {
+		fmt.Fprintf(&w.buf, "# HELP %s %s\n", family, escapeOpenMetrics(md.Help))
+	}
+	// OpenMetrics requires the family name to end with the unit.
+	if md.Unit != "" && strings.HasSuffix(family, "_"+md.Unit) {
+		fmt.Fprintf(&w.buf, "# UNIT %s %s\n", family, md.Unit)
+	}
+}
+
+func (w *OpenMetricsWriter) writeSample(series string, v float64, t int64) {
+	w.buf.WriteString(series)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatOpenMetricsValue(v))
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(strconv.FormatFloat(float64(t)/1000, 'f', -1, 64))
+	w.buf.WriteByte('\n')
+}
+
+// openMetricsSeries returns the series name with the labels of lset other
+// than the metric name, followed by an le label if le is not empty.
+func openMetricsSeries(name string, lset *labels.Labels, le string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	first := true
+	for _, l := range *lset {
+		if l.Name == labels.MetricName || (le != "" && l.Name == "le") {
+			continue
+		}
+		if first {
+			b.WriteByte('{')
+			first = false
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(escapeOpenMetrics(l.Value))
+		b.WriteByte('"')
+	}
+	if le != "" {
+		if first {
+			b.WriteByte('{')
+			first = false
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(`le="`)
+		b.WriteString(le)
+		b.WriteByte('"')
+	}
+	if !first {
+		b.WriteByte('}')
+	}
+	return b.String()
+}
+
+type classicBucket struct {
+	le    float64
+	count float64
+}
+
+// classicBuckets returns the cumulative buckets of a native histogram in the
+// order of their upper bounds, ending with +Inf.
+func classicBuckets(h *histogram.FloatHistogram) []classicBucket {
+	var buckets []classicBucket
+	var cumulative float64
+	add := func(le, count float64) {
+		cumulative += count
+		buckets = append(buckets, classicBucket{le: le, count: cumulative})
+	}
+
+	if h.Schema == histogram.CustomBucketsSchema {
+		// Index i is the bucket up to CustomValues[i], the one past the
+		// last custom value is the +Inf bucket.
+		forEachBucket(h.PositiveSpans, h.PositiveBuckets, func(idx int32, count float64) {
+			if int(idx) < len(h.CustomValues) {
+				add(h.CustomValues[idx], count)
+			}
+		})
+		return append(buckets, classicBucket{le: math.Inf(1), count: h.Count})
+	}
+
+	// Negative buckets hold the observations in [-bound(idx), -bound(idx-1)),
+	// so the ones with the highest index come first.
+	var negative []classicBucket
+	forEachBucket(h.NegativeSpans, h.NegativeBuckets, func(idx int32, count float64) {
+		negative = append(negative, classicBucket{le: -exponentialBound(idx-1, h.Schema), count: count})
+	})
+	for i := len(negative) - 1; i >= 0; i-- {
+		add(negative[i].le, negative[i].count)
+	}
+	if h.ZeroCount > 0 || h.ZeroThreshold > 0 {
+		add(h.ZeroThreshold, h.ZeroCount)
+	}
+	forEachBucket(h.PositiveSpans, h.PositiveBuckets, func(idx int32, count float64) {
+		add(exponentialBound(idx, h.Schema), count)
+	})
+	if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].le, 1) {
+		buckets = append(buckets, classicBucket{le: math.Inf(1), count: h.Count})
+	}
+	return buckets
+}
+
+// forEachBucket calls f with the index and count of every bucket of spans.
+func forEachBucket(spans []histogram.Span, counts []float64, f func(idx int32, count float64)) {
+	var idx int32
+	i := 0
+	for n, s := range spans {
+		if n == 0 {
+			idx = s.Offset
+		} else {
+			idx += s.Offset
+		}
+		for j := uint32(0); j < s.Length && i < len(counts); j++ {
+			f(idx, counts[i])
+			idx++
+			i++
+		}
+	}
+}
+
+// exponentialBound returns the upper bound of the bucket with index idx of an
+// exponential schema, 2^(idx * 2^-schema), as Prometheus computes it.
+func exponentialBound(idx, schema int32) float64 {
+	if schema < 0 {
+		return math.Ldexp(1, int(idx)<<uint(-schema))
+	}
+	fracIdx := idx & (1<<uint(schema) - 1)
+	frac := math.Exp2(float64(fracIdx)/float64(int32(1)<<uint(schema))) / 2
+	exp := int(idx>>uint(schema)) + 1
+	if frac == 0.5 && exp == 1025 {
+		return math.MaxFloat64
+	}
+	return math.Ldexp(frac, exp)
+}
+
+// Close writes the # EOF line that terminates an OpenMetrics exposition.
+func (w *OpenMetricsWriter) Close() error {
+	_, err := io.WriteString(w.out, "# EOF\n")
+	return err
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeOpenMetrics(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
+
+func formatOpenMetricsValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
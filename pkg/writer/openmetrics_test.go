@@ -0,0 +1,148 @@
+package writer
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestOpenMetricsWriter(t *testing.T) {
+	md, err := metadata.Parse(strings.NewReader(`{
+		"http_requests_total": [{"type": "counter", "help": "Requests\nserved.", "unit": ""}],
+		"request_duration_seconds": [{"type": "histogram", "help": "", "unit": "seconds"}],
+		"legacy": [{"type": "counter", "help": "No _total.", "unit": ""}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriterWithMetadata("openmetrics", &buf, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := []struct {
+		lset   labels.Labels
+		ts     []int64
+		values []float64
+	}{
+		{labels.FromStrings("__name__", "http_requests_total", "path", `/"a"`), []int64{1000, 2500}, []float64{1, 2}},
+		{labels.FromStrings("__name__", "http_requests_total", "path", "/b"), []int64{1000}, []float64{math.NaN()}},
+		{labels.FromStrings("__name__", "legacy"), []int64{1}, []float64{3}},
+		{labels.FromStrings("__name__", "request_duration_seconds_bucket", "le", "+Inf"), []int64{1000}, []float64{4}},
+		{labels.FromStrings("__name__", "request_duration_seconds_count"), []int64{1000}, []float64{4}},
+		{labels.FromStrings("__name__", "up"), []int64{1000}, []float64{math.Inf(-1)}},
+	}
+	for _, s := range series {
+		if err := w.Write(&s.lset, s.ts, s.values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# TYPE http_requests counter
+# HELP http_requests Requests\nserved.
+http_requests_total{path="/\"a\""} 1 1
+http_requests_total{path="/\"a\""} 2 2.5
+http_requests_total{path="/b"} NaN 1
+# HELP legacy No _total.
+legacy 3 0.001
+# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="+Inf"} 4 1
+request_duration_seconds_count 4 1
+up -Inf 1
+# EOF
+`
+	if buf.String() != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestOpenMetricsWriterHistograms(t *testing.T) {
+	md, err := metadata.Parse(strings.NewReader(`{
+		"rpc_duration_seconds": [{"type": "histogram", "help": "RPC latency.", "unit": "seconds"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriterWithMetadata("openmetrics", &buf, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hw, ok := w.(HistogramWriter)
+	if !ok {
+		t.Fatal("expected openmetrics to write histograms")
+	}
+	// Buckets (-2,-1], [-0.5,0.5], (0.5,1], (1,2] and (4,8] of schema 0.
+	exponential := &histogram.FloatHistogram{
+		CounterResetHint: "unknown",
+		ZeroThreshold:    0.5,
+		ZeroCount:        1,
+		Count:            11,
+		Sum:              7.5,
+		PositiveSpans:    []histogram.Span{{Offset: 0, Length: 2}, {Offset: 1, Length: 1}},
+		PositiveBuckets:  []float64{2, 3, 4},
+		NegativeSpans:    []histogram.Span{{Offset: 1, Length: 1}},
+		NegativeBuckets:  []float64{1},
+	}
+	stale := &histogram.FloatHistogram{Sum: math.Float64frombits(0x7ff0000000000002)}
+	gauge := &histogram.FloatHistogram{
+		CounterResetHint: "gauge",
+		Schema:           histogram.CustomBucketsSchema,
+		Count:            6,
+		Sum:              3,
+		PositiveSpans:    []histogram.Span{{Offset: 0, Length: 3}},
+		PositiveBuckets:  []float64{1, 2, 3},
+		CustomValues:     []float64{0.1, 1},
+	}
+	series := []struct {
+		lset       labels.Labels
+		ts         []int64
+		histograms []*histogram.FloatHistogram
+	}{
+		{labels.FromStrings("__name__", "rpc_duration_seconds", "job", "api"), []int64{1000, 2000}, []*histogram.FloatHistogram{exponential, stale}},
+		{labels.FromStrings("__name__", "queue_size"), []int64{1000}, []*histogram.FloatHistogram{gauge}},
+	}
+	for _, s := range series {
+		if err := hw.WriteHistograms(&s.lset, s.ts, s.histograms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# TYPE rpc_duration_seconds histogram
+# HELP rpc_duration_seconds RPC latency.
+# UNIT rpc_duration_seconds seconds
+rpc_duration_seconds_bucket{job="api",le="-1"} 1 1
+rpc_duration_seconds_bucket{job="api",le="0.5"} 2 1
+rpc_duration_seconds_bucket{job="api",le="1"} 4 1
+rpc_duration_seconds_bucket{job="api",le="2"} 7 1
+rpc_duration_seconds_bucket{job="api",le="8"} 11 1
+rpc_duration_seconds_bucket{job="api",le="+Inf"} 11 1
+rpc_duration_seconds_count{job="api"} 11 1
+rpc_duration_seconds_sum{job="api"} 7.5 1
+# TYPE queue_size gaugehistogram
+queue_size_bucket{le="0.1"} 1 1
+queue_size_bucket{le="1"} 3 1
+queue_size_bucket{le="+Inf"} 6 1
+queue_size_gcount 6 1
+queue_size_gsum 3 1
+# EOF
+`
+	if buf.String() != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,311 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// PushOptions configures a VictoriaMetricsPushWriter or a
+// RemoteWritePushWriter.
+type PushOptions struct {
+	// URL is the base URL of VictoriaMetrics, e.g. http://vm:8428, or of
+	// vminsert for the cluster version, e.g. http://vminsert:8480. A URL
+	// that already ends with /api/v1/import, or /api/v1/import/native for
+	// the native format, is used as is. For remote
+	// write, it is the URL of the remote write endpoint, e.g.
+	// http://prometheus:9090/api/v1/write.
+	URL string
+	// Tenant is the accountID or accountID:projectID to push to with the
+	// cluster version. It must be empty for single-node VictoriaMetrics
+	// and for remote write.
+	Tenant string
+	// ExtraLabels are name=value pairs that VictoriaMetrics adds to every
+	// imported series. They are not supported with remote write.
+	ExtraLabels []string
+
+	// Metadata holds the metric metadata sent with remote write. It may be
+	// nil.
+	Metadata *metadata.Store
+
+	// BatchBytes is the size of the JSON lines, native blocks or remote
+	// write series sent in one request before compression.
+	BatchBytes int
+	// Concurrency is the number of requests sent at the same time. Writes
+	// block while all of them are busy and one more batch is full.
+	Concurrency int
+	// MaxRetries is the number of times a failed request is retried with
+	// exponential backoff. Requests rejected with a 4xx status other than
+	// 429 are not retried.
+	MaxRetries int
+
+	// Context cancels requests and the backoff between retries. It
+	// defaults to context.Background().
+	Context context.Context
+	Client  *http.Client
+}
+
+// VictoriaMetricsPushWriter sends series to the /api/v1/import API of
+// VictoriaMetrics in batches of gzipped JSON lines.
+type VictoriaMetricsPushWriter struct {
+	*pusher
+	buf bytes.Buffer
+	enc *VictoriaMetricsWriter
+}
+
+// NewPushWriter creates a writer pushing series in format to a remote API:
+// the JSON line format of VictoriaMetrics with victoriametrics, its native
+// format with victoriametrics-native, or the Prometheus remote write
+// protocol with remote-write.
+func NewPushWriter(format string, opts PushOptions) (Writer, error) {
+	var w Writer
+	var err error
+	switch format {
+	case "victoriametrics":
+		w, err = NewVictoriaMetricsPushWriter(opts)
+	case "victoriametrics-native":
+		w, err = NewVictoriaMetricsNativePushWriter(opts)
+	case "remote-write":
+		w, err = NewRemoteWritePushWriter(opts)
+	default:
+		return nil, fmt.Errorf("pushing is not supported for format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newInstrumentedWriter(w, format), nil
+}
+
+// NewVictoriaMetricsPushWriter creates a VictoriaMetricsPushWriter and starts
+// its senders.
+func NewVictoriaMetricsPushWriter(opts PushOptions) (*VictoriaMetricsPushWriter, error) {
+	u, err := importURL(opts.URL, "/api/v1/import", opts.Tenant, opts.ExtraLabels)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Encoding", "gzip")
+	header.Set("Content-Type", "application/json")
+	w := &VictoriaMetricsPushWriter{pusher: newPusher(opts, u, header, gzipBatch)}
+	w.enc, _ = NewVictoriaMetricsWriter(&w.buf)
+	return w, nil
+}
+
+// importURL returns the URL of the import API at path, such as
+// /api/v1/import, for a base URL, tenant and extra labels.
+func importURL(base string, path string, tenant string, extraLabels []string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid push url: %s", base)
+	}
+	if !strings.HasSuffix(u.Path, path) {
+		p := strings.TrimSuffix(u.Path, "/")
+		if tenant != "" {
+			p += "/insert/" + tenant + "/prometheus"
+		}
+		u.Path = p + path
+	}
+	q := u.Query()
+	for _, l := range extraLabels {
+		if !strings.Contains(l, "=") {
+			return "", fmt.Errorf("invalid extra label %q: expected name=value", l)
+		}
+		q.Add("extra_label", l)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (w *VictoriaMetricsPushWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	if err := w.firstErr(); err != nil {
+		return err
+	}
+	if err := w.enc.Write(lset, timestamps, values); err != nil {
+		return err
+	}
+	if w.buf.Len() >= w.opts.BatchBytes {
+		w.flush()
+	}
+	return nil
+}
+
+func (w *VictoriaMetricsPushWriter) flush() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	batch := make([]byte, w.buf.Len())
+	copy(batch, w.buf.Bytes())
+	w.buf.Reset()
+	w.push(batch)
+}
+
+// Close sends the remaining lines and waits for all requests to finish.
+func (w *VictoriaMetricsPushWriter) Close() error {
+	if w.firstErr() == nil {
+		w.flush()
+	}
+	return w.close()
+}
+
+func gzipBatch(batch []byte) ([]byte, error) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write(batch); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// pusher sends batches to a push API with a number of concurrent senders,
+// retrying failed requests.
+type pusher struct {
+	opts         PushOptions
+	url          string
+	header       http.Header
+	encode       func(batch []byte) ([]byte, error)
+	retryBackoff time.Duration
+
+	batches chan []byte
+	wg      sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// newPusher creates a pusher sending batches to u with the given headers,
+// after encoding them with encode, and starts its senders.
+func newPusher(opts PushOptions, u string, header http.Header, encode func([]byte) ([]byte, error)) *pusher {
+	if opts.BatchBytes <= 0 {
+		opts.BatchBytes = 4 << 20
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	p := &pusher{
+		opts:         opts,
+		url:          u,
+		header:       header,
+		encode:       encode,
+		retryBackoff: time.Second,
+		batches:      make(chan []byte, opts.Concurrency),
+	}
+	for i := 0; i < opts.Concurrency; i++ {
+		p.wg.Add(1)
+		go p.sender()
+	}
+	return p
+}
+
+// push queues a batch, blocking while all senders are busy and the queue is
+// full.
+func (p *pusher) push(batch []byte) {
+	p.batches <- batch
+}
+
+// close waits for the queued batches to be sent.
+func (p *pusher) close() error {
+	close(p.batches)
+	p.wg.Wait()
+	return p.firstErr()
+}
+
+func (p *pusher) firstErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *pusher) sender() {
+	defer p.wg.Done()
+	for batch := range p.batches {
+		if p.firstErr() != nil {
+			// Drain the remaining batches after a failure.
+			continue
+		}
+		if err := p.send(batch); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// send pushes a batch, retrying failed requests.
+func (p *pusher) send(batch []byte) error {
+	body, err := p.encode(batch)
+	if err != nil {
+		return err
+	}
+
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		pushRequestsTotal.Inc()
+		retry, err := p.post(body)
+		if err == nil {
+			return nil
+		}
+		pushRequestFailuresTotal.Inc()
+		if !retry || attempt >= p.opts.MaxRetries {
+			return fmt.Errorf("push to %s: %s", p.url, err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-p.opts.Context.Done():
+			timer.Stop()
+			return fmt.Errorf("push to %s: %s", p.url, p.opts.Context.Err())
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// post sends a single request and reports whether it may be retried if it
+// failed.
+func (p *pusher) post(body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(p.opts.Context, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range p.header {
+		req.Header[name] = values
+	}
+	resp, err := p.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,138 @@
+package writer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestVictoriaMetricsPushWriter(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	series := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// The first request fails and has to be retried.
+		if requests == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/insert/1:2/prometheus/api/v1/import" || r.URL.Query().Get("extra_label") != "source=dump" {
+			http.Error(w, "unexpected url "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "not compressed", http.StatusBadRequest)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sc := bufio.NewScanner(gz)
+		for sc.Scan() {
+			var line victoriaMetricsLine
+			if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			series[line.Metric["instance"]] += len(line.Values)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := NewVictoriaMetricsPushWriter(PushOptions{
+		URL:         srv.URL,
+		Tenant:      "1:2",
+		ExtraLabels: []string{"source=dump"},
+		BatchBytes:  100,
+		Concurrency: 2,
+		MaxRetries:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.retryBackoff = 0
+	for _, instance := range []string{"1", "2", "3", "4", "5"} {
+		lset := labels.FromStrings("__name__", "a", "instance", instance)
+		if err := w.Write(&lset, []int64{1000, 2000}, []float64{1, 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 5 {
+		t.Fatalf("unexpected series %v", series)
+	}
+	for instance, n := range series {
+		if n != 2 {
+			t.Fatalf("expected 2 samples of %s, got %d", instance, n)
+		}
+	}
+}
+
+func TestVictoriaMetricsPushWriterRejected(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w, err := NewVictoriaMetricsPushWriter(PushOptions{URL: srv.URL, MaxRetries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.retryBackoff = 0
+	lset := labels.FromStrings("__name__", "a")
+	if err := w.Write(&lset, []int64{1000}, []float64{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("expected an error")
+	}
+	// Client errors are not retried.
+	if requests != 1 {
+		t.Fatalf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestVictoriaMetricsPushWriterCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := NewVictoriaMetricsPushWriter(PushOptions{URL: srv.URL, MaxRetries: 3, Context: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.retryBackoff = time.Hour
+	lset := labels.FromStrings("__name__", "a")
+	if err := w.Write(&lset, []int64{1000}, []float64{1}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	// Close would block for an hour if the backoff ignored the context.
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected the push to be canceled, got %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package writer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// RemoteWritePushWriter sends series to a Prometheus remote write endpoint in
+// batches of snappy-compressed WriteRequest messages, with native histograms
+// as histograms of the remote write protocol. The metadata of a metric family
+// in PushOptions.Metadata is sent as MetricMetadata with its first series.
+//
+// The WriteRequest messages are encoded here rather than with the prompb
+// package of the vendored Prometheus, which predates native histograms.
+type RemoteWritePushWriter struct {
+	*pusher
+	// buf holds the encoded TimeSeries fields of the pending WriteRequest
+	// and meta its MetricMetadata fields.
+	buf      []byte
+	meta     []byte
+	families map[string]bool
+}
+
+// NewRemoteWritePushWriter creates a RemoteWritePushWriter and starts its
+// senders.
+func NewRemoteWritePushWriter(opts PushOptions) (*RemoteWritePushWriter, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid push url: %s", opts.URL)
+	}
+	if opts.Tenant != "" || len(opts.ExtraLabels) > 0 {
+		return nil, fmt.Errorf("tenants and extra labels are not supported with remote write")
+	}
+	header := http.Header{}
+	header.Set("Content-Encoding", "snappy")
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return &RemoteWritePushWriter{
+		pusher:   newPusher(opts, u.String(), header, snappyBatch),
+		families: map[string]bool{},
+	}, nil
+}
+
+func snappyBatch(batch []byte) ([]byte, error) {
+	return snappy.Encode(nil, batch), nil
+}
+
+// Field numbers of the remote write protocol, from prompb/remote.proto and
+// prompb/types.proto of Prometheus.
+const (
+	writeRequestTimeseries = 1
+	writeRequestMetadata   = 3
+
+	timeSeriesLabels     = 1
+	timeSeriesSamples    = 2
+	timeSeriesHistograms = 4
+
+	labelName  = 1
+	labelValue = 2
+
+	sampleValue     = 1
+	sampleTimestamp = 2
+
+	histogramCountFloat     = 2
+	histogramSum            = 3
+	histogramSchema         = 4
+	histogramZeroThreshold  = 5
+	histogramZeroCountFloat = 7
+	histogramNegativeSpans  = 8
+	histogramNegativeCounts = 10
+	histogramPositiveSpans  = 11
+	histogramPositiveCounts = 13
+	histogramResetHint      = 14
+	histogramTimestamp      = 15
+
+	bucketSpanOffset = 1
+	bucketSpanLength = 2
+
+	metricMetadataType             = 1
+	metricMetadataMetricFamilyName = 2
+	metricMetadataHelp             = 4
+	metricMetadataUnit             = 5
+)
+
+// MetricMetadata.MetricType values of the remote write protocol by metric
+// type.
+var remoteWriteMetricTypes = map[string]uint64{
+	metadata.TypeUnknown:        0,
+	metadata.TypeCounter:        1,
+	metadata.TypeGauge:          2,
+	metadata.TypeHistogram:      3,
+	metadata.TypeGaugeHistogram: 4,
+	metadata.TypeSummary:        5,
+	metadata.TypeInfo:           6,
+	metadata.TypeStateset:       7,
+}
+
+// Histogram.ResetHint values of the remote write protocol by
+// FloatHistogram.CounterResetHint.
+var remoteWriteResetHints = map[string]uint64{
+	"unknown":   0,
+	"reset":     1,
+	"not_reset": 2,
+	"gauge":     3,
+}
+
+func (w *RemoteWritePushWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	if err := w.firstErr(); err != nil {
+		return err
+	}
+	w.addMetadata(lset.Get(labels.MetricName), "")
+	var series []byte
+	series = appendRemoteWriteLabels(series, lset)
+	for i, t := range timestamps {
+		var sample []byte
+		sample = appendFixed64Field(sample, sampleValue, math.Float64bits(values[i]))
+		sample = appendVarintField(sample, sampleTimestamp, uint64(t))
+		series = appendBytesField(series, timeSeriesSamples, sample)
+	}
+	w.add(series)
+	return nil
+}
+
+func (w *RemoteWritePushWriter) WriteHistograms(lset *labels.Labels, timestamps []int64, histograms []*histogram.FloatHistogram) error {
+	if err := w.firstErr(); err != nil {
+		return err
+	}
+	// Native histograms are named after their family and always of a
+	// histogram type.
+	typ := metadata.TypeHistogram
+	if len(histograms) > 0 && histograms[0].CounterResetHint == "gauge" {
+		typ = metadata.TypeGaugeHistogram
+	}
+	w.addMetadata(lset.Get(labels.MetricName), typ)
+	var series []byte
+	series = appendRemoteWriteLabels(series, lset)
+	for i, h := range histograms {
+		// Remote write 1.0 has no field for the bounds of custom buckets.
+		if h.Schema == histogram.CustomBucketsSchema {
+			return fmt.Errorf("histograms with custom buckets are not supported by remote write: %s", lset.String())
+		}
+		series = appendBytesField(series, timeSeriesHistograms, appendRemoteWriteHistogram(nil, timestamps[i], h))
+	}
+	w.add(series)
+	return nil
+}
+
+// add adds an encoded TimeSeries to the pending WriteRequest and sends it if
+// it is full.
+func (w *RemoteWritePushWriter) add(series []byte) {
+	w.buf = appendBytesField(w.buf, writeRequestTimeseries, series)
+	if len(w.buf)+len(w.meta) >= w.opts.BatchBytes {
+		w.flush()
+	}
+}
+
+// addMetadata adds the metadata of the family of the series named name to the
+// pending WriteRequest if it was not sent yet. typ overrides the type of the
+// metadata unless it is empty.
+func (w *RemoteWritePushWriter) addMetadata(name string, typ string) {
+	// The family is the series name itself, as in the Prometheus metadata
+	// API, or the name without the suffix of its series.
+	family := name
+	md, ok := w.opts.Metadata.Get(name)
+	if typ != "" {
+		md.Type, ok = typ, true
+	} else if !ok {
+		if family, _, ok = w.opts.Metadata.Lookup(name); ok {
+			md, ok = w.opts.Metadata.Get(family)
+		}
+		// Prometheus names counter families after their _total series.
+		if ok && md.Type == metadata.TypeCounter && name == family+"_total" {
+			family = name
+		}
+	}
+	if !ok || w.families[family] {
+		return
+	}
+	w.families[family] = true
+
+	var m []byte
+	m = appendVarintField(m, metricMetadataType, remoteWriteMetricTypes[md.Type])
+	m = appendStringField(m, metricMetadataMetricFamilyName, family)
+	if md.Help != "" {
+		m = appendStringField(m, metricMetadataHelp, md.Help)
+	}
+	if md.Unit != "" {
+		m = appendStringField(m, metricMetadataUnit, md.Unit)
+	}
+	w.meta = appendBytesField(w.meta, writeRequestMetadata, m)
+}
+
+func (w *RemoteWritePushWriter) flush() {
+	if len(w.buf)+len(w.meta) == 0 {
+		return
+	}
+	w.push(append(w.buf, w.meta...))
+	w.buf, w.meta = nil, nil
+}
+
+// Close sends the remaining series and waits for all requests to finish.
+func (w *RemoteWritePushWriter) Close() error {
+	if w.firstErr() == nil {
+		w.flush()
+	}
+	return w.close()
+}
+
+func appendRemoteWriteLabels(b []byte, lset *labels.Labels) []byte {
+	for _, l := range *lset {
+		var label []byte
+		label = appendStringField(label, labelName, l.Name)
+		label = appendStringField(label, labelValue, l.Value)
+		b = appendBytesField(b, timeSeriesLabels, label)
+	}
+	return b
+}
+
+// appendRemoteWriteHistogram appends h as a Histogram message with float
+// counts, which receivers accept for integer histograms as well.
+func appendRemoteWriteHistogram(b []byte, t int64, h *histogram.FloatHistogram) []byte {
+	b = appendFixed64Field(b, histogramCountFloat, math.Float64bits(h.Count))
+	b = appendFixed64Field(b, histogramSum, math.Float64bits(h.Sum))
+	b = appendVarintField(b, histogramSchema, zigzag(int64(h.Schema)))
+	b = appendFixed64Field(b, histogramZeroThreshold, math.Float64bits(h.ZeroThreshold))
+	b = appendFixed64Field(b, histogramZeroCountFloat, math.Float64bits(h.ZeroCount))
+	b = appendRemoteWriteSpans(b, histogramNegativeSpans, h.NegativeSpans)
+	b = appendPackedDoubles(b, histogramNegativeCounts, h.NegativeBuckets)
+	b = appendRemoteWriteSpans(b, histogramPositiveSpans, h.PositiveSpans)
+	b = appendPackedDoubles(b, histogramPositiveCounts, h.PositiveBuckets)
+	b = appendVarintField(b, histogramResetHint, remoteWriteResetHints[h.CounterResetHint])
+	b = appendVarintField(b, histogramTimestamp, uint64(t))
+	return b
+}
+
+func appendRemoteWriteSpans(b []byte, field int, spans []histogram.Span) []byte {
+	for _, s := range spans {
+		var span []byte
+		span = appendVarintField(span, bucketSpanOffset, zigzag(int64(s.Offset)))
+		span = appendVarintField(span, bucketSpanLength, uint64(s.Length))
+		b = appendBytesField(b, field, span)
+	}
+	return b
+}
+
+// Wire types of the protobuf encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendFixed64Field(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendStringField(b []byte, field int, v string) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendPackedDoubles appends a packed repeated double field, or nothing if
+// vs is empty.
+func appendPackedDoubles(b []byte, field int, vs []float64) []byte {
+	if len(vs) == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(8*len(vs)))
+	for _, v := range vs {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+// zigzag encodes v for sint32 and sint64 fields.
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
@@ -0,0 +1,282 @@
+package writer
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// protoField is a field of an encoded protobuf message.
+type protoField struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+// decodeProto splits an encoded protobuf message into its fields.
+func decodeProto(t *testing.T, b []byte) []protoField {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag in %x", b)
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid varint in %x", b)
+			}
+			b = b[n:]
+		case wireFixed64:
+			f.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("invalid length in %x", b)
+			}
+			f.bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestRemoteWritePushWriter(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	samples := map[string][][2]float64{}
+	var histograms [][]protoField
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/write" || r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		for _, ts := range decodeProto(t, b) {
+			if ts.num != writeRequestTimeseries {
+				continue
+			}
+			var lset labels.Labels
+			var series [][2]float64
+			for _, f := range decodeProto(t, ts.bytes) {
+				switch f.num {
+				case timeSeriesLabels:
+					l := decodeProto(t, f.bytes)
+					lset = append(lset, labels.Label{Name: string(l[0].bytes), Value: string(l[1].bytes)})
+				case timeSeriesSamples:
+					s := decodeProto(t, f.bytes)
+					series = append(series, [2]float64{float64(int64(s[1].value)), math.Float64frombits(s[0].value)})
+				case timeSeriesHistograms:
+					histograms = append(histograms, decodeProto(t, f.bytes))
+				}
+			}
+			samples[lset.String()] = append(samples[lset.String()], series...)
+		}
+	}))
+	defer srv.Close()
+
+	w, err := NewPushWriter("remote-write", PushOptions{URL: srv.URL + "/api/v1/write", BatchBytes: 100, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instance := range []string{"1", "2", "3"} {
+		lset := labels.FromStrings("__name__", "a", "instance", instance)
+		if err := w.Write(&lset, []int64{1000, -2000}, []float64{1, math.Inf(-1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hw, ok := w.(HistogramWriter)
+	if !ok {
+		t.Fatal("expected remote-write to write histograms")
+	}
+	h := &histogram.FloatHistogram{
+		CounterResetHint: "not_reset",
+		Schema:           -1,
+		ZeroThreshold:    0.001,
+		ZeroCount:        1,
+		Count:            6,
+		Sum:              4.5,
+		PositiveSpans:    []histogram.Span{{Offset: -2, Length: 2}},
+		PositiveBuckets:  []float64{2, 3},
+	}
+	lset := labels.FromStrings("__name__", "h")
+	if err := hw.WriteHistograms(&lset, []int64{3000}, []*histogram.FloatHistogram{h}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests < 2 {
+		t.Fatalf("expected several batches, got %d", requests)
+	}
+	for _, instance := range []string{"1", "2", "3"} {
+		s := samples[`{__name__="a", instance="`+instance+`"}`]
+		if len(s) != 2 || s[0] != [2]float64{1000, 1} || s[1][0] != -2000 || !math.IsInf(s[1][1], -1) {
+			t.Fatalf("unexpected samples of instance %s: %v", instance, s)
+		}
+	}
+	if s, ok := samples[`{__name__="h"}`]; !ok || len(s) != 0 {
+		t.Fatalf("expected series h without samples, got %v", samples)
+	}
+
+	if len(histograms) != 1 {
+		t.Fatalf("expected 1 histogram, got %d", len(histograms))
+	}
+	got := map[int]protoField{}
+	var spans [][]protoField
+	for _, f := range histograms[0] {
+		if f.num == histogramPositiveSpans {
+			spans = append(spans, decodeProto(t, f.bytes))
+		}
+		got[f.num] = f
+	}
+	floats := map[int]float64{histogramCountFloat: 6, histogramSum: 4.5, histogramZeroThreshold: 0.001, histogramZeroCountFloat: 1}
+	for num, want := range floats {
+		if v := math.Float64frombits(got[num].value); v != want {
+			t.Fatalf("expected %v in field %d, got %v", want, num, v)
+		}
+	}
+	if got[histogramSchema].value != zigzag(-1) || got[histogramResetHint].value != 2 || got[histogramTimestamp].value != 3000 {
+		t.Fatalf("unexpected histogram %+v", got)
+	}
+	if len(spans) != 1 || spans[0][0].value != zigzag(-2) || spans[0][1].value != 2 {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+	counts := got[histogramPositiveCounts].bytes
+	if len(counts) != 16 || math.Float64frombits(binary.LittleEndian.Uint64(counts)) != 2 || math.Float64frombits(binary.LittleEndian.Uint64(counts[8:])) != 3 {
+		t.Fatalf("unexpected positive counts %x", counts)
+	}
+	if _, ok := got[histogramNegativeSpans]; ok {
+		t.Fatal("expected no negative spans")
+	}
+
+	custom := &histogram.FloatHistogram{Schema: histogram.CustomBucketsSchema, CustomValues: []float64{1}}
+	w, err = NewPushWriter("remote-write", PushOptions{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(HistogramWriter).WriteHistograms(&lset, []int64{3000}, []*histogram.FloatHistogram{custom}); err == nil {
+		t.Fatal("expected an error for custom buckets")
+	}
+	w.Close()
+
+	if _, err := NewPushWriter("remote-write", PushOptions{URL: srv.URL, Tenant: "1"}); err == nil {
+		t.Fatal("expected an error for a tenant")
+	}
+}
+
+func TestRemoteWritePushWriterMetadata(t *testing.T) {
+	md, err := metadata.Parse(strings.NewReader(`{
+		"http_requests_total": [{"type": "counter", "help": "Requests served.", "unit": ""}],
+		"latency_seconds": [{"type": "histogram", "help": "", "unit": "seconds"}],
+		"jobs": [{"type": "counter", "help": "", "unit": ""}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var got []map[int]protoField
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range decodeProto(t, b) {
+			if f.num != writeRequestMetadata {
+				continue
+			}
+			m := map[int]protoField{}
+			for _, mf := range decodeProto(t, f.bytes) {
+				m[mf.num] = mf
+			}
+			got = append(got, m)
+		}
+	}))
+	defer srv.Close()
+
+	w, err := NewPushWriter("remote-write", PushOptions{URL: srv.URL, Metadata: md})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lset := range []labels.Labels{
+		labels.FromStrings("__name__", "http_requests_total", "path", "/a"),
+		labels.FromStrings("__name__", "http_requests_total", "path", "/b"),
+		labels.FromStrings("__name__", "latency_seconds_bucket", "le", "1"),
+		labels.FromStrings("__name__", "latency_seconds_count"),
+		labels.FromStrings("__name__", "up"),
+		labels.FromStrings("__name__", "jobs_total"),
+	} {
+		if err := w.Write(&lset, []int64{1000}, []float64{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lset := labels.FromStrings("__name__", "queue_size")
+	gauge := &histogram.FloatHistogram{CounterResetHint: "gauge", Count: 1}
+	if err := w.(HistogramWriter).WriteHistograms(&lset, []int64{1000}, []*histogram.FloatHistogram{gauge}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every family is sent once, and up without metadata not at all.
+	want := []struct {
+		typ        uint64
+		name, help string
+		unit       string
+	}{
+		{1, "http_requests_total", "Requests served.", ""},
+		{3, "latency_seconds", "", "seconds"},
+		{1, "jobs_total", "", ""},
+		{4, "queue_size", "", ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d metadata, got %d", len(want), len(got))
+	}
+	for i, m := range got {
+		if m[metricMetadataType].value != want[i].typ || string(m[metricMetadataMetricFamilyName].bytes) != want[i].name ||
+			string(m[metricMetadataHelp].bytes) != want[i].help || string(m[metricMetadataUnit].bytes) != want[i].unit {
+			t.Fatalf("unexpected metadata %d: %+v", i, m)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package writer
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ManifestName is the name of the manifest written by RotatingWriter.
+const ManifestName = "manifest.json"
+
+// RotateOptions configures a RotatingWriter.
+type RotateOptions struct {
+	// Format is the stream format written to every file.
+	Format string
+	// Compression is the compression of every file, "" for none.
+	Compression string
+	// Metadata is the metric metadata of formats that carry it.
+	Metadata *metadata.Store
+
+	// A file is closed and the next one started once it holds at least
+	// MaxBytes bytes (before compression), MaxSamples samples or MaxSeries
+	// series. Zero disables the limit. Series are never split by
+	// MaxSeries, while MaxBytes and MaxSamples may split a series into
+	// several files.
+	MaxBytes   int64
+	MaxSamples int64
+	MaxSeries  int64
+
+	// Shards is the number of files written at the same time, each holding a
+	// disjoint set of series. ShardBy is "hash" to shard by a hash of all
+	// labels or "metric" to keep all series of a metric in the same shard.
+	Shards  int
+	ShardBy string
+
+	// Create creates a file in the output, e.g. with NewDirCreator.
+	Create func(name string) (io.WriteCloser, error)
+}
+
+// NewDirCreator returns a function creating files in the local directory dir.
+func NewDirCreator(dir string) func(name string) (io.WriteCloser, error) {
+	return func(name string) (io.WriteCloser, error) {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		return os.Create(filepath.Join(dir, name))
+	}
+}
+
+// Manifest lists the files written by a RotatingWriter.
+type Manifest struct {
+	Format      string         `json:"format"`
+	Compression string         `json:"compression,omitempty"`
+	Files       []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes the contents of a single file. Bytes is the size of
+// the file before compression.
+type ManifestFile struct {
+	Name    string `json:"name"`
+	Shard   int    `json:"shard"`
+	Bytes   int64  `json:"bytes"`
+	Series  int64  `json:"series"`
+	Samples int64  `json:"samples"`
+	MinTime int64  `json:"minTime"`
+	MaxTime int64  `json:"maxTime"`
+}
+
+// RotatingWriter writes a stream format into several files, rotating them by
+// size, samples or series and optionally sharding series across them. A
+// manifest of all files is written when it is closed.
+type RotatingWriter struct {
+	opts     RotateOptions
+	shards   []*rotatingShard
+	manifest Manifest
+}
+
+type rotatingShard struct {
+	index int
+	part  int
+	file  io.WriteCloser
+	comp  io.WriteCloser
+	out   *byteCounter
+	w     Writer
+	info  ManifestFile
+	// last is the series written last, to count series across writes.
+	last string
+}
+
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewRotatingWriter creates a RotatingWriter.
+func NewRotatingWriter(opts RotateOptions) (Writer, error) {
+	if opts.Shards <= 0 {
+		opts.Shards = 1
+	}
+	switch opts.ShardBy {
+	case "", "hash", "metric":
+	default:
+		return nil, fmt.Errorf("invalid shard mode: %s", opts.ShardBy)
+	}
+	sw, err := newStreamWriter(opts.Format, ioutil.Discard, opts.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Compression != "" && compressionExtension(opts.Compression) == "" {
+		return nil, fmt.Errorf("invalid compression: %s", opts.Compression)
+	}
+	if opts.Create == nil {
+		return nil, fmt.Errorf("no output configured")
+	}
+	w := &RotatingWriter{
+		opts:     opts,
+		shards:   make([]*rotatingShard, opts.Shards),
+		manifest: Manifest{Format: opts.Format, Compression: opts.Compression, Files: []ManifestFile{}},
+	}
+	for i := range w.shards {
+		w.shards[i] = &rotatingShard{index: i}
+	}
+	if _, ok := sw.(HistogramWriter); ok {
+		return newInstrumentedWriter(&rotatingHistogramWriter{w}, opts.Format), nil
+	}
+	return newInstrumentedWriter(w, opts.Format), nil
+}
+
+func (w *RotatingWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	return w.write(lset, timestamps, func(sw Writer) error {
+		return sw.Write(lset, timestamps, values)
+	})
+}
+
+// rotatingHistogramWriter is a RotatingWriter for formats that support
+// histograms.
+type rotatingHistogramWriter struct {
+	*RotatingWriter
+}
+
+func (w *rotatingHistogramWriter) WriteHistograms(lset *labels.Labels, timestamps []int64, histograms []*histogram.FloatHistogram) error {
+	return w.write(lset, timestamps, func(sw Writer) error {
+		return sw.(HistogramWriter).WriteHistograms(lset, timestamps, histograms)
+	})
+}
+
+// write writes samples of a series with the given timestamps to the file of
+// its shard with fn, rotating the file first if it is full.
+func (w *RotatingWriter) write(lset *labels.Labels, timestamps []int64, fn func(Writer) error) error {
+	s := w.shards[w.shard(*lset)]
+	key := lset.String()
+	newSeries := s.file == nil || key != s.last
+
+	if s.file != nil && w.full(s, newSeries) {
+		if err := w.closeFile(s); err != nil {
+			return err
+		}
+		newSeries = true
+	}
+	if s.file == nil {
+		if err := w.openFile(s); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(s.w); err != nil {
+		return err
+	}
+	if newSeries {
+		s.info.Series++
+	}
+	s.last = key
+	s.info.Samples += int64(len(timestamps))
+	if len(timestamps) > 0 {
+		if timestamps[0] < s.info.MinTime {
+			s.info.MinTime = timestamps[0]
+		}
+		if timestamps[len(timestamps)-1] > s.info.MaxTime {
+			s.info.MaxTime = timestamps[len(timestamps)-1]
+		}
+	}
+	return nil
+}
+
+// full reports whether the current file of s reached one of the limits.
+func (w *RotatingWriter) full(s *rotatingShard, newSeries bool) bool {
+	o := w.opts
+	return (o.MaxBytes > 0 && s.out.n >= o.MaxBytes) ||
+		(o.MaxSamples > 0 && s.info.Samples >= o.MaxSamples) ||
+		(o.MaxSeries > 0 && newSeries && s.info.Series >= o.MaxSeries)
+}
+
+func (w *RotatingWriter) shard(lset labels.Labels) int {
+	if len(w.shards) == 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	if w.opts.ShardBy == "metric" {
+		h.Write([]byte(lset.Get(labels.MetricName)))
+	} else {
+		// Labels may have been extended with unsorted external labels.
+		b := labels.NewBuilder(nil)
+		for _, l := range lset {
+			b.Set(l.Name, l.Value)
+		}
+		h.Write([]byte(b.Labels().String()))
+	}
+	return int(h.Sum64() % uint64(len(w.shards)))
+}
+
+func (w *RotatingWriter) fileName(s *rotatingShard) string {
+	var b strings.Builder
+	if len(w.shards) > 1 {
+		fmt.Fprintf(&b, "shard-%03d-", s.index)
+	}
+	fmt.Fprintf(&b, "part-%06d%s", s.part, formatExtension(w.opts.Format))
+	b.WriteString(compressionExtension(w.opts.Compression))
+	return b.String()
+}
+
+func (w *RotatingWriter) openFile(s *rotatingShard) error {
+	name := w.fileName(s)
+	f, err := w.opts.Create(name)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = f
+	var comp io.WriteCloser
+	if w.opts.Compression != "" {
+		comp, err = NewCompressedWriter(f, w.opts.Compression)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		out = comp
+	}
+	s.out = &byteCounter{w: out}
+	s.w, err = newStreamWriter(w.opts.Format, s.out, w.opts.Metadata)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.comp = f, comp
+	s.info = ManifestFile{Name: name, Shard: s.index, MinTime: math.MaxInt64, MaxTime: math.MinInt64}
+	s.last = ""
+	return nil
+}
+
+func (w *RotatingWriter) closeFile(s *rotatingShard) error {
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+	if s.comp != nil {
+		if err := s.comp.Close(); err != nil {
+			return err
+		}
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.info.Bytes = s.out.n
+	if s.info.Samples == 0 {
+		s.info.MinTime, s.info.MaxTime = 0, 0
+	}
+	w.manifest.Files = append(w.manifest.Files, s.info)
+	s.file, s.comp, s.out, s.w = nil, nil, nil, nil
+	s.part++
+	return nil
+}
+
+// Close closes all files and writes the manifest.
+func (w *RotatingWriter) Close() error {
+	for _, s := range w.shards {
+		if s.file == nil {
+			continue
+		}
+		if err := w.closeFile(s); err != nil {
+			return err
+		}
+	}
+	sort.Slice(w.manifest.Files, func(i, j int) bool { return w.manifest.Files[i].Name < w.manifest.Files[j].Name })
+	f, err := w.opts.Create(ManifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&w.manifest); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Abort discards the open files that implement Aborter, such as those on
+// S3, and closes the others. No manifest is written.
+func (w *RotatingWriter) Abort() error {
+	var firstErr error
+	for _, s := range w.shards {
+		if s.file == nil {
+			continue
+		}
+		var err error
+		if a, ok := s.file.(Aborter); ok {
+			err = a.Abort()
+		} else {
+			err = s.file.Close()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.file, s.comp, s.out, s.w = nil, nil, nil, nil
+	}
+	return firstErr
+}
+
+func formatExtension(format string) string {
+	switch format {
+	case "victoriametrics", "json":
+		return ".json"
+	case "victoriametrics-native":
+		return ".bin"
+	case "openmetrics":
+		return ".om"
+	}
+	return ""
+}
+
+func compressionExtension(compression string) string {
+	switch compression {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	case "snappy":
+		return ".sz"
+	}
+	return ""
+}
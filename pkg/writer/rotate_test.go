@@ -0,0 +1,100 @@
+package writer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestRotatingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating-writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewRotatingWriter(RotateOptions{
+		Format:    "victoriametrics",
+		MaxSeries: 2,
+		Shards:    2,
+		ShardBy:   "metric",
+		Create:    NewDirCreator(dir),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps := []int64{1000, 2000, 3000}
+	values := []float64{1, 2, 3}
+	for _, name := range []string{"a", "b"} {
+		for _, instance := range []string{"1", "2", "3", "4", "5"} {
+			lset := labels.FromStrings("__name__", name, "instance", instance)
+			// Every series is written in two parts, which must be
+			// counted once and never be split across files.
+			if err := w.Write(&lset, timestamps[:2], values[:2]); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Write(&lset, timestamps[2:], values[2:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var m Manifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	// Metrics a and b hash to different shards, where their 5 series each
+	// end up in 3 files of at most 2 series.
+	if len(m.Files) != 6 {
+		t.Fatalf("expected 6 files, got %+v", m.Files)
+	}
+	var series, samples int64
+	for _, mf := range m.Files {
+		if mf.Series > 2 || mf.MinTime != 1000 || mf.MaxTime != 3000 {
+			t.Fatalf("unexpected file %+v", mf)
+		}
+		series += mf.Series
+		samples += mf.Samples
+
+		metrics := map[string]bool{}
+		lines := map[string]int{}
+		f, err := os.Open(filepath.Join(dir, mf.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var line victoriaMetricsLine
+			if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+				t.Fatal(err)
+			}
+			metrics[line.Metric["__name__"]] = true
+			lines[line.Metric["instance"]]++
+		}
+		f.Close()
+		if len(metrics) != 1 {
+			t.Fatalf("%s: expected a single metric, got %v", mf.Name, metrics)
+		}
+		for instance, n := range lines {
+			if n != 2 {
+				t.Fatalf("%s: series %s is split across files", mf.Name, instance)
+			}
+		}
+	}
+	if series != 10 || samples != 30 {
+		t.Fatalf("expected 10 series with 30 samples, got %d with %d", series, samples)
+	}
+}
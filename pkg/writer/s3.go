@@ -0,0 +1,84 @@
+package writer
+
+import (
+	"context"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+// s3File streams everything written to it into an S3 object with a multipart
+// upload, without buffering the whole object.
+type s3File struct {
+	pw     *io.PipeWriter
+	done   chan error
+	closed bool
+	err    error
+}
+
+// errS3FileAborted fails the upload of an aborted s3File.
+var errS3FileAborted = errors.New("upload aborted")
+
+// NewS3File creates the S3 object bucket/key from everything written to the
+// returned writer. The object only appears once Close succeeds; the returned
+// writer implements Aborter to discard it instead.
+func NewS3File(ctx context.Context, cli *s3.Client, bucket, key string) io.WriteCloser {
+	pr, pw := io.Pipe()
+	f := &s3File{pw: pw, done: make(chan error, 1)}
+	uploader := manager.NewUploader(cli)
+	go func() {
+		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   pr,
+		})
+		// Unblock writers if the upload failed.
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	n, err := f.pw.Write(p)
+	if err != nil {
+		return n, errors.Wrap(err, "upload to s3")
+	}
+	return n, nil
+}
+
+// Close completes the upload and waits for it to finish.
+func (f *s3File) Close() error {
+	if !f.closed {
+		f.pw.Close()
+		f.err = errors.Wrap(<-f.done, "upload to s3")
+		f.closed = true
+	}
+	return f.err
+}
+
+// Abort fails the upload, so that no object is created and the parts of a
+// multipart upload are deleted, and waits for it to finish. The context of
+// the upload is not canceled for this, as the uploader aborts multipart
+// uploads with it.
+func (f *s3File) Abort() error {
+	if !f.closed {
+		f.pw.CloseWithError(errS3FileAborted)
+		<-f.done
+		f.err = errors.Wrap(errS3FileAborted, "upload to s3")
+		f.closed = true
+	}
+	return nil
+}
+
+// NewS3Creator returns a function creating objects below prefix in bucket,
+// for use as RotateOptions.Create.
+func NewS3Creator(ctx context.Context, cli *s3.Client, bucket, prefix string) func(name string) (io.WriteCloser, error) {
+	return func(name string) (io.WriteCloser, error) {
+		return NewS3File(ctx, cli, bucket, path.Join(prefix, name)), nil
+	}
+}
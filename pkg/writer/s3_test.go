@@ -0,0 +1,238 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestS3File(t *testing.T) {
+	objects := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		objects[r.URL.Path] = string(b)
+	}))
+	defer srv.Close()
+
+	cli := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	create := NewS3Creator(context.Background(), cli, "bucket", "dumps/a")
+	f, err := create("part-000000.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("line\n", 1000)
+	for i := 0; i < 1000; i++ {
+		if _, err := f.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := objects["/bucket/dumps/a/part-000000.json"]; got != want {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+}
+
+// fakeS3 serves the PutObject and multipart upload API of S3 for a single
+// object, failing the upload of part failPart if it is not 0.
+type fakeS3 struct {
+	failPart int
+
+	mu        sync.Mutex
+	parts     map[int][]byte
+	object    []byte
+	completed bool
+	aborted   bool
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		s.parts = map[int][]byte{}
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && q.Get("uploadId") == "upload":
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n == s.failPart {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.parts[n] = b
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+	case r.Method == http.MethodPut && !q.Has("uploadId"):
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.object = b
+		s.completed = true
+	case r.Method == http.MethodPost && q.Get("uploadId") == "upload":
+		for n := 1; n <= len(s.parts); n++ {
+			s.object = append(s.object, s.parts[n]...)
+		}
+		s.completed = true
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><ETag>"object"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete && q.Get("uploadId") == "upload":
+		s.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+func newFakeS3Client(url string) *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(url),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+// writeLines writes numbered lines of n bytes in total to f and returns them.
+func writeLines(f io.Writer, n int64) ([]byte, error) {
+	var written bytes.Buffer
+	for i := 0; int64(written.Len()) < n; i++ {
+		line := []byte(fmt.Sprintf("line %09d\n", i))
+		written.Write(line)
+		if _, err := f.Write(line); err != nil {
+			return written.Bytes(), err
+		}
+	}
+	return written.Bytes(), nil
+}
+
+func TestS3FileMultipart(t *testing.T) {
+	s := &fakeS3{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// More than two parts of manager.DefaultUploadPartSize.
+	f := NewS3File(context.Background(), newFakeS3Client(srv.URL), "bucket", "key")
+	want, err := writeLines(f, 2*manager.DefaultUploadPartSize+1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.completed || len(s.parts) != 3 {
+		t.Fatalf("expected an upload of 3 parts, got %d parts, completed %v", len(s.parts), s.completed)
+	}
+	if !bytes.Equal(s.object, want) {
+		t.Fatalf("expected an object of %d bytes, got %d", len(want), len(s.object))
+	}
+}
+
+func TestS3FileUploadFailure(t *testing.T) {
+	s := &fakeS3{failPart: 2}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	f := NewS3File(context.Background(), newFakeS3Client(srv.URL), "bucket", "key")
+	// Writes fail once the upload failed, before everything was written.
+	if _, err := writeLines(f, 10*manager.DefaultUploadPartSize); err == nil {
+		t.Fatal("expected writes to fail")
+	}
+	if err := f.Close(); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("expected the upload to fail with AccessDenied, got %v", err)
+	}
+	if err := f.Close(); err == nil {
+		t.Fatal("expected Close to keep returning the error")
+	}
+	if !s.aborted || s.completed {
+		t.Fatalf("expected the multipart upload to be aborted, aborted %v, completed %v", s.aborted, s.completed)
+	}
+}
+
+func TestS3FileAbort(t *testing.T) {
+	for _, size := range []int64{1000, 2*manager.DefaultUploadPartSize + 1000} {
+		s := &fakeS3{}
+		srv := httptest.NewServer(s)
+
+		f := NewS3File(context.Background(), newFakeS3Client(srv.URL), "bucket", "key")
+		if _, err := writeLines(f, size); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.(Aborter).Abort(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err == nil {
+			t.Fatalf("%d bytes: expected Close to fail after Abort", size)
+		}
+		srv.Close()
+		if s.completed || s.object != nil {
+			t.Fatalf("%d bytes: expected no object, got %d bytes", size, len(s.object))
+		}
+		// Parts that were already uploaded are deleted.
+		if size > manager.DefaultUploadPartSize && !s.aborted {
+			t.Fatalf("%d bytes: expected the multipart upload to be aborted", size)
+		}
+	}
+}
+
+func TestRotatingWriterAbortS3(t *testing.T) {
+	s := &fakeS3{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	w, err := NewRotatingWriter(RotateOptions{
+		Format: "victoriametrics",
+		Create: NewS3Creator(context.Background(), newFakeS3Client(srv.URL), "bucket", "dumps"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lset := labels.FromStrings("__name__", "a")
+	if err := w.Write(&lset, []int64{1000, 2000}, []float64{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	// A failed dump aborts the writer instead of closing it, which leaves
+	// neither the file nor a manifest behind.
+	if err := w.(Aborter).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if s.completed {
+		t.Fatalf("expected no object, got %q", s.object)
+	}
+}
@@ -0,0 +1,137 @@
+package writer
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// splitNoneDir is the directory that series without the split label are
+// written into when splitting by label. escapePathElement always escapes %,
+// so no label value is written into it.
+const splitNoneDir = "%none"
+
+// SplitTSDBWriter partitions series and samples into several Prometheus TSDB
+// blocks, writing each partition with its own TSDBWriter.
+type SplitTSDBWriter struct {
+	// partition returns the partition of a sample, the directory its block
+	// is written into and the first timestamp after t that belongs to
+	// another partition.
+	partition func(lset labels.Labels, t int64) (key string, dir string, end int64)
+	writers   map[string]*TSDBWriter
+	keys      []string
+}
+
+// NewSplitTSDBWriter creates a Writer that partitions the written data into
+// several blocks under dir. splitBy "time" writes a block for every time range
+// of the given window, aligned to multiples of it. splitBy "label" writes a
+// block for every value of label into a subdirectory named after the value.
+func NewSplitTSDBWriter(dir string, splitBy string, window time.Duration, label string) (Writer, error) {
+	w := &SplitTSDBWriter{writers: map[string]*TSDBWriter{}}
+	switch splitBy {
+	case "time":
+		step := window.Milliseconds()
+		if step <= 0 {
+			return nil, fmt.Errorf("invalid split window: %s", window)
+		}
+		w.partition = func(_ labels.Labels, t int64) (string, string, int64) {
+			start := t - t%step
+			if t < 0 && t%step != 0 {
+				start -= step
+			}
+			return strconv.FormatInt(start, 10), dir, start + step
+		}
+	case "label":
+		if label == "" {
+			return nil, fmt.Errorf("a label to split by is required")
+		}
+		w.partition = func(lset labels.Labels, _ int64) (string, string, int64) {
+			v := lset.Get(label)
+			if v == "" {
+				return splitNoneDir, filepath.Join(dir, splitNoneDir), math.MaxInt64
+			}
+			return v, filepath.Join(dir, escapePathElement(v)), math.MaxInt64
+		}
+	default:
+		return nil, fmt.Errorf("invalid split mode: %s", splitBy)
+	}
+	return newInstrumentedWriter(w, "tsdb"), nil
+}
+
+func (w *SplitTSDBWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	// Partition by the labels TSDBWriter writes, where an external label
+	// overrides a label of the series with the same name.
+	ls := normalizeLabels(*lset)
+	lset = &ls
+	for start := 0; start < len(timestamps); {
+		key, dir, end := w.partition(ls, timestamps[start])
+		i := start + 1
+		for i < len(timestamps) && timestamps[i] < end {
+			i++
+		}
+		tw, err := w.partitionWriter(key, dir)
+		if err != nil {
+			return err
+		}
+		if err := tw.Write(lset, timestamps[start:i], values[start:i]); err != nil {
+			return err
+		}
+		start = i
+	}
+	return nil
+}
+
+func (w *SplitTSDBWriter) partitionWriter(key, dir string) (*TSDBWriter, error) {
+	if tw, ok := w.writers[key]; ok {
+		return tw, nil
+	}
+	tw, err := NewTSDBWriter(dir)
+	if err != nil {
+		return nil, err
+	}
+	w.writers[key] = tw
+	w.keys = append(w.keys, key)
+	return tw, nil
+}
+
+// Close writes all partitioned blocks.
+func (w *SplitTSDBWriter) Close() error {
+	var errs []string
+	for _, k := range w.keys {
+		if err := w.writers[k].Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("partition %s: %s", k, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("close blocks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Abort discards all partitioned blocks.
+func (w *SplitTSDBWriter) Abort() error {
+	var errs []string
+	for _, k := range w.keys {
+		if err := w.writers[k].Abort(); err != nil {
+			errs = append(errs, fmt.Sprintf("partition %s: %s", k, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("abort blocks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// escapePathElement makes a label value safe to use as a directory name.
+func escapePathElement(v string) string {
+	if v == "." || v == ".." {
+		return strings.Replace(v, ".", "%2E", -1)
+	}
+	return url.PathEscape(v)
+}
@@ -0,0 +1,102 @@
+package writer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+func TestSplitTSDBWriter(t *testing.T) {
+	var timestamps []int64
+	var values []float64
+	for i := 0; i < 300; i++ {
+		timestamps = append(timestamps, int64(i)*1000)
+		values = append(values, float64(i))
+	}
+	series := []struct {
+		lset labels.Labels
+		n    int
+	}{
+		{labels.FromStrings("__name__", "a", "tenant", "x"), 300},
+		{labels.FromStrings("__name__", "b", "tenant", "../y"), 300},
+		{labels.FromStrings("__name__", "c"), 210},
+		{labels.FromStrings("__name__", "d", "tenant", "__none__"), 120},
+		// An external label overrides the label of the series, as the
+		// last label of a name wins.
+		{labels.Labels{{Name: "__name__", Value: "e"}, {Name: "tenant", Value: "x"}, {Name: "tenant", Value: "z"}}, 90},
+	}
+
+	for _, tc := range []struct {
+		splitBy string
+		// want maps the directories of the written blocks to their
+		// number of samples.
+		want map[string][]uint64
+	}{
+		{
+			// 100s windows hold samples [0, 100), [100, 200) and
+			// [200, 300) of each series.
+			splitBy: "time",
+			want:    map[string][]uint64{".": {210, 320, 490}},
+		},
+		{
+			splitBy: "label",
+			want:    map[string][]uint64{"x": {300}, "..%2Fy": {300}, "__none__": {120}, "%none": {210}, "z": {90}},
+		},
+	} {
+		dir, err := ioutil.TempDir("", "split-writer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		w, err := NewSplitTSDBWriter(dir, tc.splitBy, 100*time.Second, "tenant")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range series {
+			if err := w.Write(&s.lset, timestamps[:s.n], values[:s.n]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[string][]uint64{}
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.Name() != "meta.json" {
+				return err
+			}
+			blockDir := filepath.Dir(path)
+			block, err := tsdb.OpenBlock(gokitlog.NewNopLogger(), blockDir, chunkenc.NewPool())
+			if err != nil {
+				return err
+			}
+			defer block.Close()
+			rel, err := filepath.Rel(dir, filepath.Dir(blockDir))
+			if err != nil {
+				return err
+			}
+			got[rel] = append(got[rel], block.Meta().Stats.NumSamples)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range got {
+			sort.Slice(n, func(i, j int) bool { return n[i] < n[j] })
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("split by %s: expected blocks %v, got %v", tc.splitBy, tc.want, got)
+		}
+	}
+}
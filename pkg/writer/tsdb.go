@@ -0,0 +1,266 @@
+package writer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+)
+
+// samplesPerChunk is the maximum number of samples in a chunk written by
+// TSDBWriter, matching what Prometheus itself writes.
+const samplesPerChunk = 120
+
+// TSDBWriter writes series into a new Prometheus TSDB block.
+//
+// Chunks are written to disk as they arrive, while labels and chunk metas of
+// all series are kept in memory until Close writes the index and meta.json.
+type TSDBWriter struct {
+	dir    string
+	tmpDir string
+	id     ulid.ULID
+	chunkw *chunks.Writer
+	series map[string]*tsdbSeries
+	stats  tsdb.BlockStats
+	mint   int64
+	maxt   int64
+}
+
+type tsdbSeries struct {
+	lset labels.Labels
+	chks []chunks.Meta
+	// maxt is the timestamp of the latest sample written.
+	maxt int64
+}
+
+// NewTSDBWriter creates a TSDBWriter that writes a block with a new ULID into
+// dir. The block is written to a temporary directory first and only appears
+// in dir once Close succeeds.
+func NewTSDBWriter(dir string) (*TSDBWriter, error) {
+	id := ulid.MustNew(ulid.Now(), rand.Reader)
+	tmpDir := filepath.Join(dir, id.String()+".tmp")
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
+		return nil, err
+	}
+	chunkw, err := chunks.NewWriter(filepath.Join(tmpDir, "chunks"))
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "open chunk writer")
+	}
+	return &TSDBWriter{
+		dir:    dir,
+		tmpDir: tmpDir,
+		id:     id,
+		chunkw: chunkw,
+		series: map[string]*tsdbSeries{},
+		mint:   math.MaxInt64,
+		maxt:   math.MinInt64,
+	}, nil
+}
+
+// ULID returns the ULID of the block being written.
+func (w *TSDBWriter) ULID() ulid.ULID { return w.id }
+
+func (w *TSDBWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	ls := normalizeLabels(*lset)
+
+	key := ls.String()
+	s, ok := w.series[key]
+	if !ok {
+		s = &tsdbSeries{lset: ls, maxt: math.MinInt64}
+		w.series[key] = s
+	}
+	// Chunks of a series must not overlap, so samples are only accepted in
+	// order. Writes of different series whose labels end up the same, e.g.
+	// after external labels override a label, fail here.
+	for _, t := range timestamps {
+		if t <= s.maxt {
+			return fmt.Errorf("series %s: sample at %d does not follow the sample at %d written before; a block cannot hold several series with the same labels or overlapping samples", ls, t, s.maxt)
+		}
+		s.maxt = t
+	}
+
+	var metas []chunks.Meta
+	for start := 0; start < len(timestamps); start += samplesPerChunk {
+		end := start + samplesPerChunk
+		if end > len(timestamps) {
+			end = len(timestamps)
+		}
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		if err != nil {
+			return err
+		}
+		for i := start; i < end; i++ {
+			app.Append(timestamps[i], values[i])
+		}
+		metas = append(metas, chunks.Meta{
+			MinTime: timestamps[start],
+			MaxTime: timestamps[end-1],
+			Chunk:   chk,
+		})
+	}
+	if err := w.chunkw.WriteChunks(metas...); err != nil {
+		return errors.Wrap(err, "write chunks")
+	}
+
+	for _, m := range metas {
+		if m.MinTime < w.mint {
+			w.mint = m.MinTime
+		}
+		if m.MaxTime > w.maxt {
+			w.maxt = m.MaxTime
+		}
+		w.stats.NumChunks++
+		w.stats.NumSamples += uint64(m.Chunk.NumSamples())
+		m.Chunk = nil
+		s.chks = append(s.chks, m)
+	}
+	return nil
+}
+
+// Abort discards the block, removing the temporary directory it is written
+// into.
+func (w *TSDBWriter) Abort() error {
+	w.chunkw.Close()
+	return os.RemoveAll(w.tmpDir)
+}
+
+// Close writes the index and meta.json and moves the block into place.
+func (w *TSDBWriter) Close() error {
+	if err := w.chunkw.Close(); err != nil {
+		os.RemoveAll(w.tmpDir)
+		return errors.Wrap(err, "close chunk writer")
+	}
+	if err := w.writeIndex(); err != nil {
+		os.RemoveAll(w.tmpDir)
+		return errors.Wrap(err, "write index")
+	}
+
+	if len(w.series) == 0 {
+		w.mint, w.maxt = 0, 0
+	}
+	meta := &tsdb.BlockMeta{
+		ULID:    w.id,
+		MinTime: w.mint,
+		// The maximum time of a block is exclusive.
+		MaxTime: w.maxt + 1,
+		Stats:   w.stats,
+		Compaction: tsdb.BlockMetaCompaction{
+			Level:   1,
+			Sources: []ulid.ULID{w.id},
+		},
+		Version: 1,
+	}
+	b, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		os.RemoveAll(w.tmpDir)
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.tmpDir, "meta.json"), b, 0666); err != nil {
+		os.RemoveAll(w.tmpDir)
+		return err
+	}
+	if _, err := tombstones.WriteFile(gokitlog.NewNopLogger(), w.tmpDir, tombstones.NewMemTombstones()); err != nil {
+		os.RemoveAll(w.tmpDir)
+		return errors.Wrap(err, "write tombstones")
+	}
+
+	return os.Rename(w.tmpDir, filepath.Join(w.dir, w.id.String()))
+}
+
+func (w *TSDBWriter) writeIndex() error {
+	series := make([]*tsdbSeries, 0, len(w.series))
+	symbols := map[string]struct{}{}
+	for _, s := range w.series {
+		series = append(series, s)
+		for _, l := range s.lset {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return labels.Compare(series[i].lset, series[j].lset) < 0
+	})
+	syms := make([]string, 0, len(symbols))
+	for s := range symbols {
+		syms = append(syms, s)
+	}
+	sort.Strings(syms)
+
+	iw, err := index.NewWriter(context.Background(), filepath.Join(w.tmpDir, "index"))
+	if err != nil {
+		return err
+	}
+	for _, s := range syms {
+		if err := iw.AddSymbol(s); err != nil {
+			iw.Close()
+			return err
+		}
+	}
+	for i, s := range series {
+		sort.Slice(s.chks, func(i, j int) bool { return s.chks[i].MinTime < s.chks[j].MinTime })
+		if err := iw.AddSeries(uint64(i), s.lset, s.chks...); err != nil {
+			iw.Close()
+			return err
+		}
+	}
+	w.stats.NumSeries = uint64(len(series))
+	return iw.Close()
+}
+
+// OverlappingBlocks returns the paths of the blocks in dir, or in a directory
+// below it as written by SplitTSDBWriter, whose time range overlaps mint to
+// maxt, both inclusive.
+func OverlappingBlocks(dir string, mint, maxt int64) ([]string, error) {
+	var metas []string
+	for _, pattern := range []string{"*/meta.json", "*/*/meta.json"} {
+		m, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, m...)
+	}
+
+	var blocks []string
+	for _, path := range metas {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var meta tsdb.BlockMeta
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, errors.Wrapf(err, "decode %s", path)
+		}
+		// The maximum time of a block is exclusive.
+		if meta.MinTime <= maxt && mint < meta.MaxTime {
+			blocks = append(blocks, filepath.Dir(path))
+		}
+	}
+	return blocks, nil
+}
+
+// normalizeLabels sorts lset and lets later labels override earlier ones with
+// the same name, as labels may have been extended with external labels.
+func normalizeLabels(lset labels.Labels) labels.Labels {
+	b := labels.NewBuilder(nil)
+	for _, l := range lset {
+		b.Set(l.Name, l.Value)
+	}
+	return b.Labels()
+}
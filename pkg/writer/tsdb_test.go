@@ -0,0 +1,143 @@
+package writer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+func TestTSDBWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewTSDBWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var timestamps []int64
+	var values []float64
+	for i := 0; i < 300; i++ {
+		timestamps = append(timestamps, int64(i)*1000)
+		values = append(values, float64(i))
+	}
+	// External labels are appended unsorted and may override existing ones.
+	b := labels.Labels{{Name: "__name__", Value: "b"}, {Name: "job", Value: "x"}, {Name: "a", Value: "1"}, {Name: "job", Value: "y"}}
+	a := labels.FromStrings("__name__", "a")
+	if err := w.Write(&b, timestamps, values); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&a, timestamps[:10], values[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mint, maxt int64
+		overlaps   bool
+	}{
+		{-1000, -1, false},
+		{-1000, 0, true},
+		{299000, 400000, true},
+		{299001, 400000, false},
+	} {
+		blocks, err := OverlappingBlocks(dir, tc.mint, tc.maxt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(blocks) > 0) != tc.overlaps {
+			t.Fatalf("[%d, %d]: unexpected overlapping blocks %v", tc.mint, tc.maxt, blocks)
+		}
+	}
+
+	block, err := tsdb.OpenBlock(gokitlog.NewNopLogger(), filepath.Join(dir, w.ULID().String()), chunkenc.NewPool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer block.Close()
+
+	meta := block.Meta()
+	if meta.MinTime != 0 || meta.MaxTime != 299001 {
+		t.Fatalf("unexpected block range [%d, %d)", meta.MinTime, meta.MaxTime)
+	}
+	if meta.Stats.NumSeries != 2 || meta.Stats.NumChunks != 4 || meta.Stats.NumSamples != 310 {
+		t.Fatalf("unexpected stats %+v", meta.Stats)
+	}
+
+	q, err := tsdb.NewBlockQuerier(block, meta.MinTime, meta.MaxTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	ss, err := q.Select(labels.MustNewMatcher(labels.MatchEqual, "job", "y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ss.Next() {
+		t.Fatal("series not found")
+	}
+	want := labels.FromStrings("__name__", "b", "a", "1", "job", "y")
+	if !labels.Equal(ss.At().Labels(), want) {
+		t.Fatalf("expected %s, got %s", want, ss.At().Labels())
+	}
+	it := ss.At().Iterator()
+	n := 0
+	for it.Next() {
+		ts, v := it.At()
+		if ts != timestamps[n] || v != values[n] {
+			t.Fatalf("unexpected sample %d: %d %f", n, ts, v)
+		}
+		n++
+	}
+	if n != len(timestamps) {
+		t.Fatalf("expected %d samples, got %d", len(timestamps), n)
+	}
+}
+
+func TestTSDBWriterDuplicateSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewTSDBWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both series have the same labels once the external label overrides
+	// instance.
+	a := labels.Labels{{Name: "__name__", Value: "a"}, {Name: "instance", Value: "1"}, {Name: "instance", Value: "x"}}
+	b := labels.Labels{{Name: "__name__", Value: "a"}, {Name: "instance", Value: "2"}, {Name: "instance", Value: "x"}}
+	if err := w.Write(&a, []int64{1000, 2000}, []float64{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&a, []int64{3000}, []float64{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&b, []int64{1000, 2000}, []float64{1, 2}); err == nil {
+		t.Fatal("expected an error for overlapping samples of the same series")
+	}
+
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected an empty directory after Abort, found %s", entries[0].Name())
+	}
+}
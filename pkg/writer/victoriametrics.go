@@ -36,3 +36,5 @@ func (w *VictoriaMetricsWriter) Write(labels *labels.Labels, timestamps []int64,
 	}
 	return nil
 }
+
+func (w *VictoriaMetricsWriter) Close() error { return nil }
@@ -0,0 +1,349 @@
+package writer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+// VictoriaMetricsNativeWriter writes series in the native format of
+// VictoriaMetrics, which is imported with the /api/v1/import/native API.
+//
+// The format is the one of /api/v1/export/native: a time range followed by
+// the metric name and a block of up to 8192 samples for every part of a
+// series. Blocks are written with the lossless nearest delta encoding of
+// timestamps and values, and values are stored as decimals with a common
+// exponent per block, as VictoriaMetrics stores them. Like VictoriaMetrics,
+// NaN samples other than staleness markers are dropped.
+type VictoriaMetricsNativeWriter struct {
+	out         io.Writer
+	buf         []byte
+	wroteHeader bool
+}
+
+func NewVictoriaMetricsNativeWriter(out io.Writer) (*VictoriaMetricsNativeWriter, error) {
+	return &VictoriaMetricsNativeWriter{out: out}, nil
+}
+
+func (w *VictoriaMetricsNativeWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	b := w.buf[:0]
+	if !w.wroteHeader {
+		b = appendVMNativeHeader(b)
+	}
+	b, err := appendVMNativeSeries(b, lset, timestamps, values)
+	if err != nil {
+		return err
+	}
+	w.buf = b
+	if _, err := w.out.Write(b); err != nil {
+		return err
+	}
+	w.wroteHeader = true
+	return nil
+}
+
+// Close writes the time range if no series was written, so that the output
+// is still a valid import.
+func (w *VictoriaMetricsNativeWriter) Close() error {
+	if w.wroteHeader {
+		return nil
+	}
+	w.wroteHeader = true
+	_, err := w.out.Write(appendVMNativeHeader(nil))
+	return err
+}
+
+// VictoriaMetricsNativePushWriter sends series to the /api/v1/import/native
+// API of VictoriaMetrics in gzipped batches of the native format.
+type VictoriaMetricsNativePushWriter struct {
+	*pusher
+	// buf holds the encoded series of the pending batch, without the time
+	// range every request starts with.
+	buf []byte
+}
+
+// NewVictoriaMetricsNativePushWriter creates a
+// VictoriaMetricsNativePushWriter and starts its senders.
+func NewVictoriaMetricsNativePushWriter(opts PushOptions) (*VictoriaMetricsNativePushWriter, error) {
+	u, err := importURL(opts.URL, "/api/v1/import/native", opts.Tenant, opts.ExtraLabels)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Encoding", "gzip")
+	header.Set("Content-Type", "application/octet-stream")
+	return &VictoriaMetricsNativePushWriter{pusher: newPusher(opts, u, header, gzipBatch)}, nil
+}
+
+func (w *VictoriaMetricsNativePushWriter) Write(lset *labels.Labels, timestamps []int64, values []float64) error {
+	if err := w.firstErr(); err != nil {
+		return err
+	}
+	b, err := appendVMNativeSeries(w.buf, lset, timestamps, values)
+	if err != nil {
+		return err
+	}
+	w.buf = b
+	if len(w.buf) >= w.opts.BatchBytes {
+		w.flush()
+	}
+	return nil
+}
+
+func (w *VictoriaMetricsNativePushWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	w.push(append(appendVMNativeHeader(nil), w.buf...))
+	w.buf = nil
+}
+
+// Close sends the remaining series and waits for all requests to finish.
+func (w *VictoriaMetricsNativePushWriter) Close() error {
+	if w.firstErr() == nil {
+		w.flush()
+	}
+	return w.close()
+}
+
+const (
+	// vmNativeMaxRows is the maximum number of samples in a block, which
+	// is the size of the blocks of VictoriaMetrics.
+	vmNativeMaxRows = 8192
+	// vmNativeMaxPartSize is the maximum size of a metric name or block
+	// accepted by VictoriaMetrics.
+	vmNativeMaxPartSize = 1 << 20
+
+	// vmNativeNearestDelta is the MarshalType of the nearest delta
+	// encoding, which is lossless with a precision of 64 bits.
+	vmNativeNearestDelta = 6
+	vmNativePrecision    = 64
+
+	// Decimals with a special meaning in VictoriaMetrics and the range of
+	// regular decimals.
+	vmDecimalInfPos   = math.MaxInt64
+	vmDecimalInfNeg   = math.MinInt64
+	vmDecimalStaleNaN = math.MaxInt64 - 1
+	vmDecimalMax      = math.MaxInt64 - 2
+	vmDecimalMin      = math.MinInt64 + 1
+)
+
+// appendVMNativeHeader appends the time range of a native import, which
+// covers all timestamps so that VictoriaMetrics drops no samples.
+func appendVMNativeHeader(b []byte) []byte {
+	b = binary.BigEndian.AppendUint64(b, zigzag(math.MinInt64))
+	return binary.BigEndian.AppendUint64(b, zigzag(math.MaxInt64))
+}
+
+// appendVMNativeSeries appends the metric name and a block for every
+// vmNativeMaxRows samples of a series.
+func appendVMNativeSeries(b []byte, lset *labels.Labels, timestamps []int64, values []float64) ([]byte, error) {
+	name := appendVMNativeMetricName(nil, *lset)
+	if len(name) > vmNativeMaxPartSize {
+		return nil, fmt.Errorf("labels are too long for the native format: %s", lset.String())
+	}
+
+	ts := make([]int64, 0, len(timestamps))
+	vs := make([]float64, 0, len(values))
+	for i, t := range timestamps {
+		if i > 0 && t < timestamps[i-1] {
+			return nil, fmt.Errorf("timestamps of %s are not sorted", lset.String())
+		}
+		if math.IsNaN(values[i]) && !value.IsStaleNaN(values[i]) {
+			continue
+		}
+		ts = append(ts, t)
+		vs = append(vs, values[i])
+	}
+
+	for len(ts) > 0 {
+		n := len(ts)
+		if n > vmNativeMaxRows {
+			n = vmNativeMaxRows
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(len(name)))
+		b = append(b, name...)
+		block := appendVMNativeBlock(nil, ts[:n], vs[:n])
+		b = binary.BigEndian.AppendUint32(b, uint32(len(block)))
+		b = append(b, block...)
+		ts, vs = ts[n:], vs[n:]
+	}
+	return b, nil
+}
+
+// appendVMNativeMetricName appends the metric name of VictoriaMetrics for
+// lset: the value of __name__ followed by the names and values of the other
+// labels.
+func appendVMNativeMetricName(b []byte, lset labels.Labels) []byte {
+	b = appendVMNativeTagValue(b, lset.Get(labels.MetricName))
+	for _, l := range lset {
+		if l.Name == labels.MetricName {
+			continue
+		}
+		b = appendVMNativeTagValue(b, l.Name)
+		b = appendVMNativeTagValue(b, l.Value)
+	}
+	return b
+}
+
+// appendVMNativeTagValue appends s terminated by 1, escaping the bytes 0, 1
+// and 2 with 0.
+func appendVMNativeTagValue(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0, 1, 2:
+			b = append(b, 0, '0'+c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, 1)
+}
+
+// appendVMNativeBlock appends a block of samples in the portable encoding of
+// VictoriaMetrics: its header followed by the timestamps and values.
+func appendVMNativeBlock(b []byte, timestamps []int64, values []float64) []byte {
+	decimals, scale := toDecimals(values)
+	b = binary.AppendVarint(b, timestamps[0])
+	b = binary.AppendVarint(b, timestamps[len(timestamps)-1])
+	b = binary.AppendVarint(b, decimals[0])
+	b = binary.AppendUvarint(b, uint64(len(timestamps)))
+	b = binary.AppendVarint(b, int64(scale))
+	b = append(b, vmNativeNearestDelta, vmNativeNearestDelta, vmNativePrecision)
+	b = appendNearestDeltas(b, timestamps)
+	b = appendNearestDeltas(b, decimals)
+	return b
+}
+
+// appendNearestDeltas appends the differences between consecutive items of
+// vs, prefixed with their size. The first item is part of the block header.
+func appendNearestDeltas(b []byte, vs []int64) []byte {
+	var data []byte
+	for i := 1; i < len(vs); i++ {
+		// Differences with special decimals overflow, but they are
+		// reversed by the same overflow when they are added up.
+		data = binary.AppendVarint(data, vs[i]-vs[i-1])
+	}
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// toDecimals converts values to decimals d with a common exponent e, so that
+// each value is d*10^e. Values are only rounded if their magnitudes are too
+// far apart for int64 decimals with the same exponent.
+func toDecimals(values []float64) ([]int64, int16) {
+	decimals := make([]int64, len(values))
+	exps := make([]int16, len(values))
+	scale := int16(math.MaxInt16)
+	for i, f := range values {
+		decimals[i], exps[i] = toDecimal(f)
+		if !isSpecialDecimal(decimals[i]) && exps[i] < scale {
+			scale = exps[i]
+		}
+	}
+	if scale == math.MaxInt16 {
+		return decimals, 0
+	}
+
+	// Raise the exponent until all decimals fit.
+	var raise int16
+	for i, d := range decimals {
+		if isSpecialDecimal(d) {
+			continue
+		}
+		if r := exps[i] - scale - maxDecimalUpscale(d); r > raise {
+			raise = r
+		}
+	}
+	scale += raise
+
+	for i, d := range decimals {
+		if isSpecialDecimal(d) {
+			continue
+		}
+		for e := exps[i]; e > scale; e-- {
+			d *= 10
+		}
+		if exps[i] < scale {
+			d = roundDecimal(d, scale-exps[i])
+		}
+		decimals[i] = d
+	}
+	return decimals, scale
+}
+
+// roundDecimal divides d by 10^n, rounding half away from zero.
+func roundDecimal(d int64, n int16) int64 {
+	if n > 18 {
+		return 0
+	}
+	p := int64(1)
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	q, r := d/p, d%p
+	if r < 0 {
+		r = -r
+	}
+	if r >= p-r {
+		if d < 0 {
+			q--
+		} else {
+			q++
+		}
+	}
+	return q
+}
+
+// toDecimal converts f to the decimal d and exponent e of its shortest
+// representation, so that f is d*10^e.
+func toDecimal(f float64) (int64, int16) {
+	switch {
+	case f == 0:
+		return 0, 0
+	case value.IsStaleNaN(f):
+		return vmDecimalStaleNaN, 0
+	case math.IsInf(f, 1):
+		return vmDecimalInfPos, 0
+	case math.IsInf(f, -1):
+		return vmDecimalInfNeg, 0
+	}
+	// The shortest representation has at most 17 digits, which always fit.
+	s := strconv.FormatFloat(math.Abs(f), 'e', -1, 64)
+	i := strings.IndexByte(s, 'e')
+	digits := strings.Replace(s[:i], ".", "", 1)
+	d, _ := strconv.ParseInt(digits, 10, 64)
+	e, _ := strconv.Atoi(s[i+1:])
+	if f < 0 {
+		d = -d
+	}
+	return d, int16(e - (len(digits) - 1))
+}
+
+// maxDecimalUpscale returns how often d can be multiplied by 10 without
+// leaving the range of regular decimals.
+func maxDecimalUpscale(d int64) int16 {
+	if d == 0 {
+		return math.MaxInt16
+	}
+	if d < 0 {
+		d = -d
+	}
+	var n int16
+	for d <= vmDecimalMax/10 {
+		d *= 10
+		n++
+	}
+	return n
+}
+
+func isSpecialDecimal(d int64) bool {
+	return d > vmDecimalMax || d < vmDecimalMin
+}
@@ -0,0 +1,270 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+// decodeVMNative decodes a native import into the samples of every series,
+// the way VictoriaMetrics decodes the blocks that the writer produces.
+func decodeVMNative(t *testing.T, b []byte) map[string][][2]float64 {
+	if len(b) < 16 || !bytes.Equal(b[:16], appendVMNativeHeader(nil)) {
+		t.Fatalf("unexpected time range in %x", b)
+	}
+	b = b[16:]
+	next := func() []byte {
+		if len(b) < 4 || uint32(len(b)-4) < binary.BigEndian.Uint32(b) {
+			t.Fatalf("truncated native import")
+		}
+		n := binary.BigEndian.Uint32(b)
+		part := b[4 : 4+n]
+		b = b[4+n:]
+		return part
+	}
+	varint := func(p *[]byte) int64 {
+		v, n := binary.Varint(*p)
+		if n <= 0 {
+			t.Fatalf("invalid varint in %x", *p)
+		}
+		*p = (*p)[n:]
+		return v
+	}
+	deltas := func(p *[]byte, first int64, rows int) []int64 {
+		l, n := binary.Uvarint(*p)
+		data := (*p)[n : n+int(l)]
+		*p = (*p)[n+int(l):]
+		vs := []int64{first}
+		for len(data) > 0 {
+			vs = append(vs, vs[len(vs)-1]+varint(&data))
+		}
+		if len(vs) != rows {
+			t.Fatalf("expected %d rows, got %d", rows, len(vs))
+		}
+		return vs
+	}
+
+	series := map[string][][2]float64{}
+	for len(b) > 0 {
+		var lset labels.Labels
+		var name string
+		parts := bytes.Split(bytes.TrimSuffix(next(), []byte{1}), []byte{1})
+		for i, escaped := range parts {
+			var p []byte
+			for j := 0; j < len(escaped); j++ {
+				if escaped[j] == 0 {
+					j++
+					p = append(p, escaped[j]-'0')
+					continue
+				}
+				p = append(p, escaped[j])
+			}
+			switch {
+			case i == 0:
+				if len(p) > 0 {
+					lset = append(lset, labels.Label{Name: labels.MetricName, Value: string(p)})
+				}
+			case i%2 == 1:
+				name = string(p)
+			default:
+				lset = append(lset, labels.Label{Name: name, Value: string(p)})
+			}
+		}
+
+		block := next()
+		minT, maxT, first := varint(&block), varint(&block), varint(&block)
+		rows, n := binary.Uvarint(block)
+		block = block[n:]
+		scale := varint(&block)
+		if !bytes.Equal(block[:3], []byte{vmNativeNearestDelta, vmNativeNearestDelta, vmNativePrecision}) {
+			t.Fatalf("unexpected encoding %v", block[:3])
+		}
+		block = block[3:]
+		if rows == 0 || rows > vmNativeMaxRows {
+			t.Fatalf("unexpected number of rows %d", rows)
+		}
+		timestamps := deltas(&block, minT, int(rows))
+		decimals := deltas(&block, first, int(rows))
+		if len(block) > 0 || timestamps[len(timestamps)-1] != maxT {
+			t.Fatalf("invalid block of %s", lset)
+		}
+		for i, d := range decimals {
+			v := float64(d)
+			switch {
+			case d == vmDecimalInfPos:
+				v = math.Inf(1)
+			case d == vmDecimalInfNeg:
+				v = math.Inf(-1)
+			case d == vmDecimalStaleNaN:
+				v = math.Float64frombits(value.StaleNaN)
+			case scale < 0:
+				v /= math.Pow10(int(-scale))
+			default:
+				v *= math.Pow10(int(scale))
+			}
+			series[lset.String()] = append(series[lset.String()], [2]float64{float64(timestamps[i]), v})
+		}
+	}
+	return series
+}
+
+func TestVictoriaMetricsNativeWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter("victoriametrics-native", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := math.Float64frombits(value.StaleNaN)
+	a := labels.FromStrings("__name__", "a", "path", "/\x00\x01\x02")
+	if err := w.Write(&a, []int64{-1000, 0, 1000, 2000, 3000, 4000}, []float64{0.5, -1.25, math.NaN(), 1e10, math.Inf(-1), stale}); err != nil {
+		t.Fatal(err)
+	}
+	// A series that is split into two blocks.
+	b := labels.FromStrings("__name__", "b", "instance", "1")
+	var timestamps []int64
+	var values []float64
+	for i := 0; i < vmNativeMaxRows+10; i++ {
+		timestamps = append(timestamps, int64(i)*15000)
+		values = append(values, float64(i)/4)
+	}
+	if err := w.Write(&b, timestamps, values); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&b, []int64{2, 1}, []float64{1, 2}); err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Fatalf("expected an error for unsorted timestamps, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	series := decodeVMNative(t, buf.Bytes())
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %v", series)
+	}
+	// The NaN is dropped.
+	got := series[a.String()]
+	want := [][2]float64{{-1000, 0.5}, {0, -1.25}, {2000, 1e10}, {3000, math.Inf(-1)}, {4000, stale}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i][0] != want[i][0] || math.Float64bits(got[i][1]) != math.Float64bits(want[i][1]) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	got = series[b.String()]
+	if len(got) != len(timestamps) {
+		t.Fatalf("expected %d samples of b, got %d", len(timestamps), len(got))
+	}
+	for i := range got {
+		if got[i] != [2]float64{float64(timestamps[i]), values[i]} {
+			t.Fatalf("expected sample %d of b to be %d %v, got %v", i, timestamps[i], values[i], got[i])
+		}
+	}
+
+	// An empty dump still has a time range.
+	buf.Reset()
+	w, _ = NewWriter("victoriametrics-native", &buf)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), appendVMNativeHeader(nil)) {
+		t.Fatalf("expected only the time range, got %x", buf.Bytes())
+	}
+}
+
+func TestToDecimals(t *testing.T) {
+	tests := []struct {
+		values   []float64
+		decimals []int64
+		scale    int16
+	}{
+		{[]float64{0, 0}, []int64{0, 0}, 0},
+		{[]float64{1, 20, 300}, []int64{1, 20, 300}, 0},
+		{[]float64{1000, 2000}, []int64{1, 2}, 3},
+		{[]float64{0.1, -2.55, 3}, []int64{10, -255, 300}, -2},
+		{[]float64{math.Inf(1), 0.5}, []int64{vmDecimalInfPos, 5}, -1},
+		// 1e-20 cannot be scaled along with 1e10 and is rounded to 0.
+		{[]float64{1e10, 1e-20, 2.5}, []int64{1000000000000000000, 0, 250000000}, -8},
+	}
+	for _, tt := range tests {
+		decimals, scale := toDecimals(tt.values)
+		if scale != tt.scale || len(decimals) != len(tt.decimals) {
+			t.Fatalf("%v: expected %v e%d, got %v e%d", tt.values, tt.decimals, tt.scale, decimals, scale)
+		}
+		for i := range decimals {
+			if decimals[i] != tt.decimals[i] {
+				t.Fatalf("%v: expected %v e%d, got %v e%d", tt.values, tt.decimals, tt.scale, decimals, scale)
+			}
+		}
+	}
+}
+
+func TestVictoriaMetricsNativePushWriter(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	samples := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/insert/1/prometheus/api/v1/import/native" || r.URL.Query().Get("extra_label") != "source=dump" || r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// Every request starts with the time range.
+		for s, ss := range decodeVMNative(t, b) {
+			samples[s] += len(ss)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := NewPushWriter("victoriametrics-native", PushOptions{
+		URL:         srv.URL,
+		Tenant:      "1",
+		ExtraLabels: []string{"source=dump"},
+		BatchBytes:  1,
+		Concurrency: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instance := range []string{"1", "2", "3"} {
+		lset := labels.FromStrings("__name__", "a", "instance", instance)
+		if err := w.Write(&lset, []int64{1000, 2000, 3000}, []float64{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+	for _, instance := range []string{"1", "2", "3"} {
+		if n := samples[`{__name__="a", instance="`+instance+`"}`]; n != 3 {
+			t.Fatalf("expected 3 samples of instance %s, got %v", instance, samples)
+		}
+	}
+}
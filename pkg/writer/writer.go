@@ -4,16 +4,79 @@ import (
 	"fmt"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"io"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/metadata"
 )
 
 type Writer interface {
 	Write(*labels.Labels, []int64, []float64) error
+	// Close flushes any buffered output. The Writer must not be used
+	// afterwards.
+	Close() error
+}
+
+// HistogramWriter is implemented by writers of formats that support native
+// histograms.
+type HistogramWriter interface {
+	WriteHistograms(*labels.Labels, []int64, []*histogram.FloatHistogram) error
+}
+
+// Aborter is implemented by writers that only make their output visible on
+// Close and can discard it instead if the dump fails.
+type Aborter interface {
+	Abort() error
 }
 
+// NewWriter creates a Writer for a format that is written as a stream to out.
 func NewWriter(format string, out io.Writer) (Writer, error) {
+	return NewWriterWithMetadata(format, out, nil)
+}
+
+// NewWriterWithMetadata is like NewWriter, but formats that carry metric
+// metadata take it from md.
+func NewWriterWithMetadata(format string, out io.Writer, md *metadata.Store) (Writer, error) {
+	w, err := newStreamWriter(format, out, md)
+	if err != nil {
+		return nil, err
+	}
+	return newInstrumentedWriter(w, format), nil
+}
+
+func newStreamWriter(format string, out io.Writer, md *metadata.Store) (Writer, error) {
 	switch format {
 	case "victoriametrics":
 		return NewVictoriaMetricsWriter(out)
+	case "victoriametrics-native":
+		return NewVictoriaMetricsNativeWriter(out)
+	case "json":
+		return NewJSONWriter(out)
+	case "openmetrics":
+		return NewOpenMetricsWriter(out, md)
+	default:
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+}
+
+// NewDirWriter creates a Writer for a format that is written into the
+// directory dir.
+func NewDirWriter(format string, dir string) (Writer, error) {
+	var w Writer
+	var err error
+	switch format {
+	case "tsdb":
+		w, err = NewTSDBWriter(dir)
+	default:
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("invalid format: %s", format)
+	return newInstrumentedWriter(w, format), nil
+}
+
+// IsDirFormat reports whether format is written into a directory rather than
+// as a stream.
+func IsDirFormat(format string) bool {
+	return format == "tsdb"
 }
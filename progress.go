@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/chunkreader"
+)
+
+// progress tracks how far a dump has got and periodically reports it.
+// All counters may be read concurrently by the reporting goroutine. Rates
+// and the ETA only count the work of this run, not the series and output of
+// an interrupted dump that is resumed.
+type progress struct {
+	start       time.Time
+	totalSeries int64
+	resumed     int64
+	series      int64
+	chunks      int64
+	skipped     int64
+	samples     int64
+	out         *countingWriter
+	// outStart is the size of the output when the dump started.
+	outStart int64
+
+	w      io.Writer
+	format string
+	stopc  chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newProgress(w io.Writer, format string, out *countingWriter) (*progress, error) {
+	switch format {
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid progress format: %s", format)
+	}
+	p := &progress{start: time.Now(), w: w, format: format, out: out}
+	if out != nil {
+		p.outStart = out.count()
+	}
+	return p, nil
+}
+
+// setTotal sets the number of series the dump is expected to process.
+func (p *progress) setTotal(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.totalSeries, n)
+}
+
+func (p *progress) addSeries(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.series, n)
+}
+
+// addResumed records series that were written before the dump was resumed.
+func (p *progress) addResumed(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.resumed, n)
+}
+
+func (p *progress) addChunk(samples int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.chunks, 1)
+	atomic.AddInt64(&p.samples, int64(samples))
+}
+
+// skipChunk records a chunk that was not read because it lies outside of the
+// requested time range.
+func (p *progress) skipChunk() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.skipped, 1)
+}
+
+// startReporting reports progress every interval until stop is called.
+func (p *progress) startReporting(interval time.Duration) {
+	if p == nil || interval <= 0 {
+		return
+	}
+	p.stopc = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.report()
+			case <-p.stopc:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops periodic reporting and writes a final report.
+func (p *progress) stop() {
+	if p == nil {
+		return
+	}
+	if p.stopc != nil {
+		close(p.stopc)
+		p.wg.Wait()
+	}
+	p.report()
+}
+
+type progressReport struct {
+	Time             time.Time `json:"time"`
+	Series           int64     `json:"series"`
+	ResumedSeries    int64     `json:"resumedSeries"`
+	TotalSeries      int64     `json:"totalSeries"`
+	Chunks           int64     `json:"chunks"`
+	ChunksSkipped    int64     `json:"chunksSkipped"`
+	Samples          int64     `json:"samples"`
+	S3BytesRead      int64     `json:"s3BytesRead"`
+	BytesWritten     int64     `json:"bytesWritten,omitempty"`
+	SeriesPerSecond  float64   `json:"seriesPerSecond"`
+	SamplesPerSecond float64   `json:"samplesPerSecond"`
+	BytesPerSecond   float64   `json:"bytesWrittenPerSecond,omitempty"`
+	Percent          float64   `json:"percent"`
+	ETASeconds       float64   `json:"etaSeconds"`
+}
+
+// snapshot returns the progress at now. Series includes resumed series,
+// while the rates only count this run.
+func (p *progress) snapshot(now time.Time) progressReport {
+	series := atomic.LoadInt64(&p.series)
+	r := progressReport{
+		Time:          now,
+		ResumedSeries: atomic.LoadInt64(&p.resumed),
+		TotalSeries:   atomic.LoadInt64(&p.totalSeries),
+		Chunks:        atomic.LoadInt64(&p.chunks),
+		ChunksSkipped: atomic.LoadInt64(&p.skipped),
+		Samples:       atomic.LoadInt64(&p.samples),
+		S3BytesRead:   chunkreader.S3BytesRead(),
+	}
+	r.Series = r.ResumedSeries + series
+	var written int64
+	if p.out != nil {
+		r.BytesWritten = p.out.count()
+		written = r.BytesWritten - p.outStart
+	}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		r.SeriesPerSecond = float64(series) / elapsed
+		r.SamplesPerSecond = float64(r.Samples) / elapsed
+		r.BytesPerSecond = float64(written) / elapsed
+	}
+	if r.TotalSeries > 0 {
+		r.Percent = 100 * float64(r.Series) / float64(r.TotalSeries)
+	}
+	if r.SeriesPerSecond > 0 {
+		r.ETASeconds = float64(r.TotalSeries-r.Series) / r.SeriesPerSecond
+	}
+	return r
+}
+
+func (p *progress) report() {
+	r := p.snapshot(time.Now())
+	if p.format == "json" {
+		json.NewEncoder(p.w).Encode(r)
+		return
+	}
+	written := ""
+	if p.out != nil {
+		written = fmt.Sprintf(", %s written", formatBytes(r.BytesWritten))
+	}
+	fmt.Fprintf(p.w, "progress: %d/%d series (%.1f%%), %d chunks (%d skipped), %d samples, %s read from S3%s, %.1f series/s, %.0f samples/s, ETA %s\n",
+		r.Series, r.TotalSeries, r.Percent, r.Chunks, r.ChunksSkipped, r.Samples,
+		formatBytes(r.S3BytesRead), written,
+		r.SeriesPerSecond, r.SamplesPerSecond,
+		(time.Duration(r.ETASeconds) * time.Second).String())
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressSnapshot(t *testing.T) {
+	// A resumed dump whose output held 1000 bytes before this run.
+	out := &countingWriter{w: &bytes.Buffer{}, n: 1000}
+	p, err := newProgress(&bytes.Buffer{}, "json", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setTotal(100)
+	p.addResumed(20)
+	p.addSeries(40)
+	p.addChunk(500)
+	out.Write(make([]byte, 4000))
+
+	r := p.snapshot(p.start.Add(10 * time.Second))
+	want := progressReport{
+		Time:             r.Time,
+		Series:           60,
+		ResumedSeries:    20,
+		TotalSeries:      100,
+		Chunks:           1,
+		Samples:          500,
+		S3BytesRead:      r.S3BytesRead,
+		BytesWritten:     5000,
+		SeriesPerSecond:  4,
+		SamplesPerSecond: 50,
+		BytesPerSecond:   400,
+		Percent:          60,
+		ETASeconds:       10,
+	}
+	if r != want {
+		t.Fatalf("expected %+v, got %+v", want, r)
+	}
+
+	if r := p.snapshot(p.start); r.SeriesPerSecond != 0 || r.ETASeconds != 0 {
+		t.Fatalf("expected no rates without elapsed time, got %+v", r)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if got := formatBytes(n); got != want {
+			t.Fatalf("%d: expected %s, got %s", n, want, got)
+		}
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestProgressOutputDir(t *testing.T) {
+	// Bytes written to all files of -output-dir are counted.
+	out := &countingWriter{w: &bytes.Buffer{}}
+	create := countingCreator(func(name string) (io.WriteCloser, error) {
+		return nopWriteCloser{&bytes.Buffer{}}, nil
+	}, out)
+	for _, name := range []string{"a", "b"} {
+		f, err := create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(make([]byte, 1000))
+		f.Close()
+	}
+	if out.count() != 2000 {
+		t.Fatalf("expected 2000 bytes, got %d", out.count())
+	}
+
+	// Without an output to count, as with -push-url, bytes are left out.
+	var buf bytes.Buffer
+	p, err := newProgress(&buf, "text", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.report()
+	if strings.Contains(buf.String(), "written") {
+		t.Fatalf("expected no bytes written, got %q", buf.String())
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/chunkreader"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+type blockStats struct {
+	Series           int64             `json:"series"`
+	Chunks           int64             `json:"chunks"`
+	Samples          int64             `json:"samples"`
+	Histograms       int64             `json:"histograms"`
+	ChunkBytes       int64             `json:"chunkBytes"`
+	MinTime          int64             `json:"minTime"`
+	MaxTime          int64             `json:"maxTime"`
+	SamplesPerSeries samplesPerSeries  `json:"samplesPerSeries"`
+	Metrics          []*metricStats    `json:"metrics"`
+	LabelNames       []*labelNameStats `json:"labelNames"`
+	TopLabelPairs    []*labelPairStats `json:"topLabelPairs"`
+}
+
+type samplesPerSeries struct {
+	Min int64   `json:"min"`
+	Max int64   `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+type metricStats struct {
+	Name       string `json:"name"`
+	Series     int64  `json:"series"`
+	Chunks     int64  `json:"chunks"`
+	Samples    int64  `json:"samples"`
+	Histograms int64  `json:"histograms"`
+	ChunkBytes int64  `json:"chunkBytes"`
+}
+
+type labelNameStats struct {
+	Name   string `json:"name"`
+	Values int64  `json:"values"`
+	Series int64  `json:"series"`
+}
+
+type labelPairStats struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Series int64  `json:"series"`
+}
+
+// runStats reads every selected series and the header of each of its chunks
+// and reports cardinality and size statistics. Metrics and label/value pairs
+// are limited to the topN with the most series, unless topN is 0.
+func runStats(ctx context.Context, blockPath string, labelKey string, labelValues []string, metricName string, awsProfile string, format string, topN int, out io.Writer) error {
+	if format != "json" && format != "table" {
+		return fmt.Errorf("invalid stats format: %s", format)
+	}
+
+	indexr, err := dump.OpenIndexReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		return pkgerrors.Wrap(err, "open index")
+	}
+	defer indexr.Close()
+
+	chunkr, err := dump.OpenChunkReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		return pkgerrors.Wrap(err, "open chunks")
+	}
+	defer chunkr.Close()
+
+	postings, err := dump.SelectPostings(indexr, labelKey, labelValues, metricName)
+	if err != nil {
+		return err
+	}
+
+	stats := &blockStats{
+		MinTime:          math.MaxInt64,
+		MaxTime:          math.MinInt64,
+		SamplesPerSeries: samplesPerSeries{Min: math.MaxInt64},
+	}
+	metrics := map[string]*metricStats{}
+	names := map[string]*labelNameStats{}
+	values := map[string]map[string]int64{}
+
+	for postings.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		lset := labels.Labels{}
+		chks := []chunks.Meta{}
+		if err := indexr.Series(postings.At(), &lset, &chks); err != nil {
+			return pkgerrors.Wrap(err, "indexr.Series")
+		}
+
+		name := lset.Get(labels.MetricName)
+		m, ok := metrics[name]
+		if !ok {
+			m = &metricStats{Name: name}
+			metrics[name] = m
+		}
+		m.Series++
+		stats.Series++
+
+		for _, l := range lset {
+			n, ok := names[l.Name]
+			if !ok {
+				n = &labelNameStats{Name: l.Name}
+				names[l.Name] = n
+				values[l.Name] = map[string]int64{}
+			}
+			n.Series++
+			values[l.Name][l.Value]++
+		}
+
+		var seriesSamples int64
+		for _, meta := range chks {
+			info, err := chunkInfo(chunkr, meta.Ref)
+			if err != nil {
+				return err
+			}
+			samples := int64(info.Samples)
+			size := int64(info.Bytes)
+			// Samples count float samples only, histogram samples are
+			// counted on their own.
+			if info.Encoding == histogram.EncHistogram || info.Encoding == histogram.EncFloatHistogram {
+				m.Histograms += samples
+				stats.Histograms += samples
+			} else {
+				m.Samples += samples
+				stats.Samples += samples
+			}
+			seriesSamples += samples
+			m.Chunks++
+			m.ChunkBytes += size
+			stats.Chunks++
+			stats.ChunkBytes += size
+			if meta.MinTime < stats.MinTime {
+				stats.MinTime = meta.MinTime
+			}
+			if meta.MaxTime > stats.MaxTime {
+				stats.MaxTime = meta.MaxTime
+			}
+		}
+		if seriesSamples < stats.SamplesPerSeries.Min {
+			stats.SamplesPerSeries.Min = seriesSamples
+		}
+		if seriesSamples > stats.SamplesPerSeries.Max {
+			stats.SamplesPerSeries.Max = seriesSamples
+		}
+	}
+	if postings.Err() != nil {
+		return pkgerrors.Wrap(postings.Err(), "postings.Err")
+	}
+
+	if stats.Series == 0 {
+		stats.MinTime, stats.MaxTime = 0, 0
+		stats.SamplesPerSeries.Min = 0
+	} else {
+		stats.SamplesPerSeries.Avg = float64(stats.Samples+stats.Histograms) / float64(stats.Series)
+	}
+
+	for _, m := range metrics {
+		stats.Metrics = append(stats.Metrics, m)
+	}
+	sort.Slice(stats.Metrics, func(i, j int) bool {
+		a, b := stats.Metrics[i], stats.Metrics[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		return a.Name < b.Name
+	})
+	if topN > 0 && len(stats.Metrics) > topN {
+		stats.Metrics = stats.Metrics[:topN]
+	}
+
+	for name, n := range names {
+		n.Values = int64(len(values[name]))
+		stats.LabelNames = append(stats.LabelNames, n)
+		for value, series := range values[name] {
+			stats.TopLabelPairs = append(stats.TopLabelPairs, &labelPairStats{Name: name, Value: value, Series: series})
+		}
+	}
+	sort.Slice(stats.LabelNames, func(i, j int) bool {
+		a, b := stats.LabelNames[i], stats.LabelNames[j]
+		if a.Values != b.Values {
+			return a.Values > b.Values
+		}
+		return a.Name < b.Name
+	})
+	sort.Slice(stats.TopLabelPairs, func(i, j int) bool {
+		a, b := stats.TopLabelPairs[i], stats.TopLabelPairs[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Value < b.Value
+	})
+	if topN > 0 && len(stats.TopLabelPairs) > topN {
+		stats.TopLabelPairs = stats.TopLabelPairs[:topN]
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	return writeStatsTable(stats, out)
+}
+
+// chunkInfo describes a chunk, reading only its header if the chunk reader
+// supports it.
+func chunkInfo(chunkr tsdb.ChunkReader, ref uint64) (chunkreader.ChunkInfo, error) {
+	if r, ok := chunkr.(chunkreader.InfoReader); ok {
+		info, err := r.ChunkInfo(ref)
+		return info, pkgerrors.Wrap(err, "read chunk header")
+	}
+	chk, err := chunkr.Chunk(ref)
+	if err != nil {
+		return chunkreader.ChunkInfo{}, pkgerrors.Wrap(err, "chunkr.Chunk")
+	}
+	return chunkreader.ChunkInfo{Encoding: chk.Encoding(), Samples: chk.NumSamples(), Bytes: len(chk.Bytes())}, nil
+}
+
+func writeStatsTable(stats *blockStats, out io.Writer) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Series:\t%d\n", stats.Series)
+	fmt.Fprintf(tw, "Chunks:\t%d\n", stats.Chunks)
+	fmt.Fprintf(tw, "Samples:\t%d\n", stats.Samples)
+	fmt.Fprintf(tw, "Histogram samples:\t%d\n", stats.Histograms)
+	fmt.Fprintf(tw, "Chunk bytes:\t%d\n", stats.ChunkBytes)
+	fmt.Fprintf(tw, "Samples per series:\tmin %d, avg %.1f, max %d\n", stats.SamplesPerSeries.Min, stats.SamplesPerSeries.Avg, stats.SamplesPerSeries.Max)
+	fmt.Fprintf(tw, "Time range:\t%s - %s\n", formatTimestamp(stats.MinTime), formatTimestamp(stats.MaxTime))
+
+	fmt.Fprintf(tw, "\nMETRIC\tSERIES\tCHUNKS\tSAMPLES\tHISTOGRAMS\tCHUNK BYTES\n")
+	for _, m := range stats.Metrics {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", m.Name, m.Series, m.Chunks, m.Samples, m.Histograms, m.ChunkBytes)
+	}
+
+	fmt.Fprintf(tw, "\nLABEL NAME\tVALUES\tSERIES\n")
+	for _, n := range stats.LabelNames {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", n.Name, n.Values, n.Series)
+	}
+
+	fmt.Fprintf(tw, "\nLABEL PAIR\tSERIES\n")
+	for _, p := range stats.TopLabelPairs {
+		fmt.Fprintf(tw, "%s=%q\t%d\n", p.Name, p.Value, p.Series)
+	}
+
+	return tw.Flush()
+}
+
+// formatTimestamp formats a timestamp in milliseconds as RFC3339.
+func formatTimestamp(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
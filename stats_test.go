@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+func TestRunStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "a", "job", "api", "instance", "1"),
+		labels.FromStrings("__name__", "a", "job", "api", "instance", "2"),
+		labels.FromStrings("__name__", "b", "job", "db", "instance", "1"),
+	)
+
+	var buf bytes.Buffer
+	if err := runStats(context.Background(), block, "", nil, "", "", "json", 1, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var stats blockStats
+	if err := json.Unmarshal(buf.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Series != 3 || stats.Samples != 720 || stats.Histograms != 0 {
+		t.Fatalf("unexpected totals %+v", stats)
+	}
+	if stats.MinTime != 0 || stats.MaxTime != 239000 {
+		t.Fatalf("unexpected time range [%d, %d]", stats.MinTime, stats.MaxTime)
+	}
+	if stats.SamplesPerSeries != (samplesPerSeries{Min: 240, Max: 240, Avg: 240}) {
+		t.Fatalf("unexpected samples per series %+v", stats.SamplesPerSeries)
+	}
+	if len(stats.Metrics) != 1 || stats.Metrics[0].Name != "a" || stats.Metrics[0].Series != 2 {
+		t.Fatalf("expected only metric a with 2 series, got %+v", stats.Metrics)
+	}
+	if len(stats.TopLabelPairs) != 1 || *stats.TopLabelPairs[0] != (labelPairStats{Name: "__name__", Value: "a", Series: 2}) {
+		t.Fatalf("unexpected top label pairs %+v", stats.TopLabelPairs)
+	}
+	for _, n := range stats.LabelNames {
+		if n.Name == "instance" && (n.Values != 2 || n.Series != 3) {
+			t.Fatalf("unexpected stats of instance %+v", n)
+		}
+	}
+
+	// Chunks and bytes read from the chunk headers match those of the
+	// chunks themselves.
+	var chunkCount, chunkBytes int64
+	indexr, err := dump.OpenIndexReader(context.Background(), block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexr.Close()
+	chunkr, err := dump.OpenChunkReader(context.Background(), block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunkr.Close()
+	p, err := indexr.Postings(index.AllPostingsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p.Next() {
+		var lset labels.Labels
+		var chks []chunks.Meta
+		if err := indexr.Series(p.At(), &lset, &chks); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range chks {
+			chk, err := chunkr.Chunk(m.Ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunkCount++
+			chunkBytes += int64(len(chk.Bytes()))
+		}
+	}
+	if stats.Chunks != chunkCount || stats.ChunkBytes != chunkBytes {
+		t.Fatalf("expected %d chunks of %d bytes, got %d of %d", chunkCount, chunkBytes, stats.Chunks, stats.ChunkBytes)
+	}
+
+	buf.Reset()
+	if err := runStats(context.Background(), block, "job", []string{"db"}, "", "", "table", 0, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Series:              1\n") || !strings.Contains(buf.String(), "Samples:             240\n") {
+		t.Fatalf("unexpected table:\n%s", buf.String())
+	}
+
+	if err := runStats(context.Background(), filepath.Join(dir, "missing"), "", nil, "", "", "json", 0, &buf); err == nil {
+		t.Fatal("expected an error for a missing block")
+	}
+	if err := runStats(context.Background(), block, "", nil, "", "", "yaml", 0, &buf); err == nil {
+		t.Fatal("expected an error for an invalid format")
+	}
+}
+
+func TestRunStatsHistograms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A series with 4 histogram samples followed by 2 float samples.
+	block := testblock.WriteChunks(t, filepath.Join(dir, "block"), labels.FromStrings("__name__", "h"),
+		testblock.HistogramChunk(t), testblock.XORChunk(t, [2]float64{5000, 1}, [2]float64{6000, 2}))
+
+	var buf bytes.Buffer
+	if err := runStats(context.Background(), block, "", nil, "", "", "json", 0, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var stats blockStats
+	if err := json.Unmarshal(buf.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Samples != 2 || stats.Histograms != 4 {
+		t.Fatalf("expected 2 samples and 4 histograms, got %+v", stats)
+	}
+	if len(stats.Metrics) != 1 || stats.Metrics[0].Samples != 2 || stats.Metrics[0].Histograms != 4 {
+		t.Fatalf("expected 2 samples and 4 histograms of h, got %+v", stats.Metrics)
+	}
+	if stats.SamplesPerSeries != (samplesPerSeries{Min: 6, Max: 6, Avg: 6}) {
+		t.Fatalf("unexpected samples per series %+v", stats.SamplesPerSeries)
+	}
+}
+
+// fakeS3Endpoint serves the files below dir as the objects of a bucket for
+// the AWS SDK, which is pointed at it through the environment. onRequest is
+// called with the key of every request.
+func fakeS3Endpoint(t *testing.T, dir string, onRequest func(key string)) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests to an IP address use path-style URLs: /bucket/key.
+		key := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[1]
+		onRequest(key)
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(key)))
+		if err != nil {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, key, time.Time{}, f)
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "missing"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "missing"))
+}
+
+func TestRunStatsCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "a", "instance", "1"),
+		labels.FromStrings("__name__", "a", "instance", "2"),
+		labels.FromStrings("__name__", "a", "instance", "3"),
+	)
+
+	// Cancel while the index is read for the second series. index.Reader
+	// cannot return errors of these reads, so they must not fail.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var chunkRequests int
+	fakeS3Endpoint(t, dir, func(key string) {
+		if strings.Contains(key, "/chunks/") {
+			chunkRequests++
+		} else if strings.HasSuffix(key, "/index") && chunkRequests > 0 {
+			cancel()
+		}
+	})
+
+	var buf bytes.Buffer
+	err = runStats(ctx, "s3://bucket/"+filepath.Base(block), "", nil, "", "", "json", 0, &buf)
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no report, got %s", buf.String())
+	}
+	if chunkRequests == 0 {
+		t.Fatal("expected the chunks of the first series to be read")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// parseTimestamp parses the value of a time range flag into a unix time in
+// milliseconds. It accepts
+//
+//   - unix time in milliseconds, e.g. 1578636058619
+//   - unix time in seconds prefixed with @, e.g. @1578636058 or @1578636058.619
+//   - RFC3339 timestamps, e.g. 2020-01-10T06:00:58Z
+//   - durations relative to the maximum time of the block, e.g. -24h or -90m
+//
+// blockMaxTime is only called for relative durations. def is returned for
+// an empty value.
+func parseTimestamp(s string, def int64, blockMaxTime func() (int64, error)) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	if strings.HasPrefix(s, "@") {
+		sec, err := strconv.ParseFloat(s[1:], 64)
+		if err != nil || math.IsNaN(sec) || math.IsInf(sec, 0) {
+			return 0, fmt.Errorf("invalid unix time: %s", s)
+		}
+		return int64(math.Round(sec * 1000)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixMilli(), nil
+	}
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		maxt, err := blockMaxTime()
+		if err != nil {
+			return 0, err
+		}
+		return maxt + d.Milliseconds(), nil
+	}
+	return 0, fmt.Errorf("invalid timestamp %q: expected unix time in msec, @unix seconds, RFC3339 or a duration relative to the block max time such as -24h", s)
+}
+
+// parseRebaseTime parses the value of -rebase-to like parseTimestamp, but
+// durations are relative to now, which is also accepted as is.
+func parseRebaseTime(s string, now time.Time) (int64, error) {
+	nowMs := now.UnixMilli()
+	if s == "now" {
+		return nowMs, nil
+	}
+	return parseTimestamp(s, 0, func() (int64, error) { return nowMs, nil })
+}
+
+// isRelativeRebaseTime reports whether the value of -rebase-to depends on the
+// time it is parsed at.
+func isRelativeRebaseTime(s string) bool {
+	if s == "now" {
+		return true
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return false
+	}
+	return strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+")
+}
+
+// timeRange is a range of unix times in milliseconds, both inclusive.
+type timeRange struct {
+	mint, maxt int64
+}
+
+// dumpedRange returns the range of the samples dumped from the block of meta
+// between minTimestamp and maxTimestamp.
+func dumpedRange(meta *tsdb.BlockMeta, minTimestamp int64, maxTimestamp int64) timeRange {
+	r := timeRange{mint: meta.MinTime, maxt: meta.MaxTime - 1}
+	if minTimestamp > r.mint {
+		r.mint = minTimestamp
+	}
+	if maxTimestamp < r.maxt {
+		r.maxt = maxTimestamp
+	}
+	return r
+}
+
+func (r timeRange) shift(d int64) timeRange {
+	return timeRange{mint: r.mint + d, maxt: r.maxt + d}
+}
+
+func (r timeRange) String() string {
+	format := func(ms int64) string {
+		return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+	}
+	return format(r.mint) + " - " + format(r.maxt)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	blockMaxTime := func() (int64, error) { return 1578643200000, nil }
+	for _, tc := range []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: math.MinInt64},
+		{in: "1578636058619", want: 1578636058619},
+		{in: "-1000", want: -1000},
+		{in: "@1578636058", want: 1578636058000},
+		{in: "@1578636058.619", want: 1578636058619},
+		{in: "2020-01-10T06:00:58Z", want: 1578636058000},
+		{in: "2020-01-10T07:00:58.619+01:00", want: 1578636058619},
+		// Beyond the range of time.Time.UnixNano.
+		{in: "2300-01-01T00:00:00Z", want: 10413792000000},
+		{in: "-24h", want: 1578643200000 - 24*3600*1000},
+		{in: "+90m", want: 1578643200000 + 90*60*1000},
+		{in: "@NaN", wantErr: true},
+		{in: "-1x", wantErr: true},
+		{in: "yesterday", wantErr: true},
+	} {
+		got, err := parseTimestamp(tc.in, math.MinInt64, blockMaxTime)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("%q: expected an error, got %d", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.in, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: expected %d, got %d", tc.in, tc.want, got)
+		}
+	}
+
+	// The block is only read for relative durations.
+	failing := func() (int64, error) { return 0, errors.New("no block") }
+	if _, err := parseTimestamp("1000", 0, failing); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTimestamp("-1h", 0, failing); err == nil {
+		t.Fatal("expected the error of reading the block")
+	}
+}
+
+func TestParseRebaseTime(t *testing.T) {
+	now := time.Date(2020, 1, 10, 8, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		in       string
+		want     int64
+		relative bool
+	}{
+		{in: "now", want: now.UnixMilli(), relative: true},
+		{in: "-24h", want: now.Add(-24 * time.Hour).UnixMilli(), relative: true},
+		{in: "+1h", want: now.Add(time.Hour).UnixMilli(), relative: true},
+		{in: "1578636000000", want: 1578636000000},
+		{in: "-1000", want: -1000},
+		{in: "@1578636000", want: 1578636000000},
+		{in: "2020-01-10T06:00:00Z", want: 1578636000000},
+	} {
+		got, err := parseRebaseTime(tc.in, now)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.in, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: expected %d, got %d", tc.in, tc.want, got)
+		}
+		if isRelativeRebaseTime(tc.in) != tc.relative {
+			t.Fatalf("%q: expected relative %v", tc.in, tc.relative)
+		}
+	}
+	if _, err := parseRebaseTime("tomorrow", now); err == nil {
+		t.Fatal("expected an error")
+	}
+	if isRelativeRebaseTime("") {
+		t.Fatal("an empty -rebase-to is not relative")
+	}
+}
+
+func TestDumpedRange(t *testing.T) {
+	// The maximum time of a block is exclusive.
+	meta := &tsdb.BlockMeta{MinTime: 1000, MaxTime: 5000}
+	for _, tc := range []struct {
+		min, max int64
+		want     timeRange
+	}{
+		{min: math.MinInt64, max: math.MaxInt64, want: timeRange{mint: 1000, maxt: 4999}},
+		{min: 2000, max: 3000, want: timeRange{mint: 2000, maxt: 3000}},
+		{min: 0, max: 9000, want: timeRange{mint: 1000, maxt: 4999}},
+	} {
+		if got := dumpedRange(meta, tc.min, tc.max); got != tc.want {
+			t.Fatalf("[%d, %d]: expected %v, got %v", tc.min, tc.max, tc.want, got)
+		}
+	}
+
+	r := timeRange{mint: 1578636000000, maxt: 1578643199999}.shift(-3600 * 1000)
+	if got, want := r.String(), "2020-01-10T05:00:00Z - 2020-01-10T06:59:59Z"; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
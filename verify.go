@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/chunkreader"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/histogram"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// errVerifyFailed is returned by runVerify when problems were found.
+var errVerifyFailed = errors.New("block verification failed")
+
+type verifyReport struct {
+	Block         string          `json:"block"`
+	OK            bool            `json:"ok"`
+	Series        int64           `json:"series"`
+	Chunks        int64           `json:"chunks"`
+	Samples       int64           `json:"samples"`
+	Histograms    int64           `json:"histograms"`
+	Symbols       int64           `json:"symbols"`
+	ProblemCounts map[string]int  `json:"problemCounts"`
+	Problems      []verifyProblem `json:"problems"`
+}
+
+type verifyProblem struct {
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	SeriesRef uint64 `json:"seriesRef,omitempty"`
+	Labels    string `json:"labels,omitempty"`
+	ChunkRef  uint64 `json:"chunkRef,omitempty"`
+}
+
+// verifier collects the problems found while verifying a block.
+type verifier struct {
+	report      *verifyReport
+	maxProblems int
+}
+
+func (v *verifier) add(p verifyProblem) {
+	v.report.ProblemCounts[p.Kind]++
+	if v.maxProblems <= 0 || len(v.report.Problems) < v.maxProblems {
+		v.report.Problems = append(v.report.Problems, p)
+	}
+}
+
+func (v *verifier) addf(kind string, format string, args ...interface{}) {
+	v.add(verifyProblem{Kind: kind, Message: fmt.Sprintf(format, args...)})
+}
+
+// runVerify reads every series and chunk of a block, checks the invariants of
+// the index, chunks and meta.json and writes a report of all problems found.
+// At most maxProblems problems are listed in detail, while all of them are
+// counted. errVerifyFailed is returned if any problem was found.
+func runVerify(ctx context.Context, blockPath string, awsProfile string, maxProblems int, out io.Writer) error {
+	v := &verifier{
+		report:      &verifyReport{Block: blockID(blockPath), ProblemCounts: map[string]int{}, Problems: []verifyProblem{}},
+		maxProblems: maxProblems,
+	}
+
+	indexr, err := dump.OpenIndexReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		return pkgerrors.Wrap(err, "open index")
+	}
+	defer indexr.Close()
+
+	chunkr, err := dump.OpenChunkReader(ctx, blockPath, awsProfile)
+	if err != nil {
+		return pkgerrors.Wrap(err, "open chunks")
+	}
+	defer chunkr.Close()
+
+	meta, err := dump.ReadBlockMeta(ctx, blockPath, awsProfile)
+	if err != nil {
+		v.addf("meta_unreadable", "read meta.json: %s", err)
+	}
+
+	symbols := v.verifySymbols(indexr)
+	if err := v.verifyPostings(ctx, indexr); err != nil {
+		return err
+	}
+	if err := v.verifySeries(ctx, indexr, chunkr, symbols, meta); err != nil {
+		return err
+	}
+
+	if meta != nil {
+		if meta.Stats.NumSeries != uint64(v.report.Series) {
+			v.addf("meta_stats_mismatch", "meta.json reports %d series, found %d", meta.Stats.NumSeries, v.report.Series)
+		}
+		if meta.Stats.NumChunks != uint64(v.report.Chunks) {
+			v.addf("meta_stats_mismatch", "meta.json reports %d chunks, found %d", meta.Stats.NumChunks, v.report.Chunks)
+		}
+		if meta.Stats.NumSamples != uint64(v.report.Samples) {
+			v.addf("meta_stats_mismatch", "meta.json reports %d samples, found %d", meta.Stats.NumSamples, v.report.Samples)
+		}
+	}
+
+	v.report.OK = len(v.report.ProblemCounts) == 0
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v.report); err != nil {
+		return pkgerrors.Wrap(err, "encode report")
+	}
+	if !v.report.OK {
+		return errVerifyFailed
+	}
+	return nil
+}
+
+// verifySymbols checks that the symbol table is sorted and free of
+// duplicates, and returns its contents.
+func (v *verifier) verifySymbols(indexr *index.Reader) map[string]struct{} {
+	symbols := map[string]struct{}{}
+	it := indexr.Symbols()
+	var prev string
+	for i := 0; it.Next(); i++ {
+		sym := it.At()
+		if i > 0 && sym <= prev {
+			v.addf("unsorted_symbols", "symbol %q follows %q", sym, prev)
+		}
+		symbols[sym] = struct{}{}
+		prev = sym
+	}
+	if it.Err() != nil {
+		v.addf("symbols_unreadable", "read symbols: %s", it.Err())
+	}
+	v.report.Symbols = int64(len(symbols))
+	return symbols
+}
+
+// verifyPostings checks that the postings list of every label pair is sorted.
+// It only returns an error if ctx is done.
+func (v *verifier) verifyPostings(ctx context.Context, indexr *index.Reader) error {
+	names, err := indexr.LabelNames()
+	if err != nil {
+		v.addf("postings_unreadable", "read label names: %s", err)
+		return nil
+	}
+	allName, allValue := index.AllPostingsKey()
+	v.verifyPostingsList(indexr, allName, allValue)
+
+	for _, name := range names {
+		tuples, err := indexr.LabelValues(name)
+		if err != nil {
+			v.addf("postings_unreadable", "read values of label %q: %s", name, err)
+			continue
+		}
+		for i := 0; i < tuples.Len(); i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			t, err := tuples.At(i)
+			if err != nil {
+				v.addf("postings_unreadable", "read values of label %q: %s", name, err)
+				break
+			}
+			v.verifyPostingsList(indexr, name, t[0])
+		}
+	}
+	return nil
+}
+
+func (v *verifier) verifyPostingsList(indexr *index.Reader, name, value string) {
+	p, err := indexr.Postings(name, value)
+	if err != nil {
+		v.addf("postings_unreadable", "read postings of %s=%q: %s", name, value, err)
+		return
+	}
+	var prev uint64
+	for i := 0; p.Next(); i++ {
+		if i > 0 && p.At() <= prev {
+			v.addf("unsorted_postings", "postings of %s=%q: ref %d follows %d", name, value, p.At(), prev)
+			return
+		}
+		prev = p.At()
+	}
+	if p.Err() != nil {
+		v.addf("postings_unreadable", "read postings of %s=%q: %s", name, value, p.Err())
+	}
+}
+
+// verifySeries checks the labels, chunk metas, chunks and samples of every
+// series in the block. It only returns an error if ctx is done.
+func (v *verifier) verifySeries(ctx context.Context, indexr *index.Reader, chunkr tsdb.ChunkReader, symbols map[string]struct{}, meta *tsdb.BlockMeta) error {
+	allName, allValue := index.AllPostingsKey()
+	postings, err := indexr.Postings(allName, allValue)
+	if err != nil {
+		v.addf("postings_unreadable", "read all postings: %s", err)
+		return nil
+	}
+
+	var prevLset labels.Labels
+	for postings.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ref := postings.At()
+		lset := labels.Labels{}
+		chks := []chunks.Meta{}
+		if err := indexr.Series(ref, &lset, &chks); err != nil {
+			v.add(verifyProblem{Kind: "series_unreadable", Message: err.Error(), SeriesRef: ref})
+			continue
+		}
+		v.report.Series++
+		problem := func(kind string, chunkRef uint64, format string, args ...interface{}) {
+			v.add(verifyProblem{Kind: kind, Message: fmt.Sprintf(format, args...), SeriesRef: ref, Labels: lset.String(), ChunkRef: chunkRef})
+		}
+
+		if !sort.IsSorted(lset) {
+			problem("unsorted_labels", 0, "labels of series are not sorted")
+		}
+		for i, l := range lset {
+			if i > 0 && l.Name == lset[i-1].Name {
+				problem("duplicate_label", 0, "label %q appears more than once", l.Name)
+			}
+			if _, ok := symbols[l.Name]; !ok {
+				problem("missing_symbol", 0, "label name %q is not in the symbol table", l.Name)
+			}
+			if _, ok := symbols[l.Value]; !ok {
+				problem("missing_symbol", 0, "label value %q is not in the symbol table", l.Value)
+			}
+		}
+		if prevLset != nil && labels.Compare(prevLset, lset) >= 0 {
+			problem("unsorted_series", 0, "series does not sort after the previous series %s", prevLset)
+		}
+		prevLset = lset
+
+		if len(chks) == 0 {
+			problem("series_without_chunks", 0, "series has no chunks")
+		}
+
+		lastT := int64(0)
+		for i, c := range chks {
+			v.report.Chunks++
+			if c.MinTime > c.MaxTime {
+				problem("invalid_chunk_meta", c.Ref, "chunk minTime %d is after maxTime %d", c.MinTime, c.MaxTime)
+			}
+			if i > 0 && c.MinTime <= chks[i-1].MaxTime {
+				problem("overlapping_chunks", c.Ref, "chunk [%d, %d] overlaps previous chunk [%d, %d]", c.MinTime, c.MaxTime, chks[i-1].MinTime, chks[i-1].MaxTime)
+			}
+			if meta != nil && (c.MinTime < meta.MinTime || c.MaxTime >= meta.MaxTime) {
+				problem("chunk_outside_block", c.Ref, "chunk [%d, %d] is outside of block range [%d, %d)", c.MinTime, c.MaxTime, meta.MinTime, meta.MaxTime)
+			}
+
+			chk, err := chunkr.Chunk(c.Ref)
+			if err != nil {
+				kind := "chunk_unreadable"
+				if errors.Is(err, chunkreader.ErrChecksumMismatch) {
+					kind = "checksum_mismatch"
+				}
+				problem(kind, c.Ref, "read chunk: %s", err)
+				continue
+			}
+
+			timestamps, err := chunkTimestamps(chk)
+			if err != nil {
+				problem("chunk_unreadable", c.Ref, "iterate chunk: %s", err)
+				continue
+			}
+			if _, ok := chk.(*histogram.Chunk); ok {
+				v.report.Histograms += int64(len(timestamps))
+			}
+			n := len(timestamps)
+			for j, t := range timestamps {
+				if (j > 0 || i > 0) && t == lastT {
+					problem("duplicate_sample", c.Ref, "duplicate sample at %d", t)
+				} else if (j > 0 || i > 0) && t < lastT {
+					problem("out_of_order_sample", c.Ref, "sample at %d follows sample at %d", t, lastT)
+				}
+				if t < c.MinTime || t > c.MaxTime {
+					problem("sample_outside_chunk", c.Ref, "sample at %d is outside of chunk range [%d, %d]", t, c.MinTime, c.MaxTime)
+				}
+				lastT = t
+			}
+			v.report.Samples += int64(n)
+			if n == 0 {
+				problem("empty_chunk", c.Ref, "chunk has no samples")
+				continue
+			}
+			if first, last := timestamps[0], timestamps[n-1]; first != c.MinTime || last != c.MaxTime {
+				problem("chunk_meta_mismatch", c.Ref, "chunk samples span [%d, %d] but index reports [%d, %d]", first, last, c.MinTime, c.MaxTime)
+			}
+		}
+	}
+	if postings.Err() != nil {
+		v.addf("postings_unreadable", "read all postings: %s", postings.Err())
+	}
+	return nil
+}
+
+// chunkTimestamps returns the timestamps of the samples of a chunk. Native
+// histogram chunks are decoded as histograms, which are only checked for their
+// timestamps.
+func chunkTimestamps(chk chunkenc.Chunk) ([]int64, error) {
+	if hc, ok := chk.(*histogram.Chunk); ok {
+		timestamps, _, err := hc.Histograms()
+		return timestamps, err
+	}
+	var timestamps []int64
+	it := chk.Iterator(nil)
+	for it.Next() {
+		t, _ := it.At()
+		timestamps = append(timestamps, t)
+	}
+	return timestamps, it.Err()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ryotarai/prometheus-tsdb-dump/internal/testblock"
+	"github.com/ryotarai/prometheus-tsdb-dump/pkg/dump"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+func runVerifyReport(t *testing.T, block string, maxProblems int) (*verifyReport, error) {
+	var buf bytes.Buffer
+	err := runVerify(context.Background(), block, "", maxProblems, &buf)
+	var report verifyReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("decode report %q: %s", buf.String(), err)
+	}
+	return &report, err
+}
+
+func TestRunVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := testblock.Write(t, dir, 240,
+		labels.FromStrings("__name__", "a", "instance", "1"),
+		labels.FromStrings("__name__", "a", "instance", "2"),
+	)
+	report, err := runVerifyReport(t, block, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK || report.Series != 2 || report.Samples != 480 || report.Histograms != 0 || len(report.Problems) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// Corrupt the data of the first chunk of every series and the sample
+	// count in meta.json.
+	indexr, err := dump.OpenIndexReader(context.Background(), block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []uint64
+	p, err := indexr.Postings(index.AllPostingsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p.Next() {
+		var lset labels.Labels
+		var chks []chunks.Meta
+		if err := indexr.Series(p.At(), &lset, &chks); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, chks[0].Ref)
+	}
+	indexr.Close()
+	for _, ref := range refs {
+		testblock.CorruptChunk(t, block, ref)
+	}
+	var meta tsdb.BlockMeta
+	b, err := ioutil.ReadFile(filepath.Join(block, "meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	meta.Stats.NumSamples++
+	if b, err = json.Marshal(&meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(block, "meta.json"), b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = runVerifyReport(t, block, 1)
+	if err != errVerifyFailed {
+		t.Fatalf("expected %v, got %v", errVerifyFailed, err)
+	}
+	want := map[string]int{"checksum_mismatch": 2, "meta_stats_mismatch": 1}
+	if report.OK || !reflect.DeepEqual(report.ProblemCounts, want) {
+		t.Fatalf("expected problems %v, got %+v", want, report)
+	}
+	// All problems are counted, but only maxProblems are listed.
+	if len(report.Problems) != 1 || report.Problems[0].Kind != "checksum_mismatch" || report.Problems[0].ChunkRef != refs[0] {
+		t.Fatalf("unexpected problems %+v", report.Problems)
+	}
+}
+
+func TestRunVerifyHistograms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lset := labels.FromStrings("__name__", "h")
+	block := testblock.WriteChunks(t, filepath.Join(dir, "ok"), lset, testblock.HistogramChunk(t))
+	report, err := runVerifyReport(t, block, 0)
+	if err != nil {
+		t.Fatalf("%s: %+v", err, report)
+	}
+	if report.Samples != 4 || report.Histograms != 4 {
+		t.Fatalf("expected 4 histograms, got %+v", report)
+	}
+
+	// The timestamps of the histograms are checked against the chunk meta.
+	meta := testblock.HistogramChunk(t)
+	meta.MaxTime = 5000
+	block = testblock.WriteChunks(t, filepath.Join(dir, "mismatch"), lset, meta)
+	report, err = runVerifyReport(t, block, 0)
+	if err != errVerifyFailed || report.ProblemCounts["chunk_meta_mismatch"] != 1 {
+		t.Fatalf("expected a chunk_meta_mismatch, got %v %+v", err, report)
+	}
+}